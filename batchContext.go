@@ -0,0 +1,32 @@
+package kafka
+
+// BatchContext is the ConsumeContext of a batch of messages from the same
+// partition.
+type BatchContext struct {
+	*ConsumeContext
+
+	messages []*Message
+}
+
+// Offsets returns the offsets to commit for the whole batch.
+func (c *BatchContext) Offsets() []TopicPartition {
+	if len(c.messages) == 0 {
+		return nil
+	}
+
+	last := c.messages[len(c.messages)-1].TopicPartition
+	return []TopicPartition{{
+		Topic:     last.Topic,
+		Partition: last.Partition,
+		Offset:    last.Offset + 1,
+	}}
+}
+
+// CommitBatch commits the offsets of the whole batch in one request.
+func (c *BatchContext) CommitBatch() ([]TopicPartition, error) {
+	offsets := c.Offsets()
+	if offsets == nil {
+		return nil, nil
+	}
+	return c.CommitOffsets(offsets)
+}
@@ -0,0 +1,160 @@
+package kafka
+
+import (
+	"sync"
+	"time"
+)
+
+type messageBatch struct {
+	ctx      *ConsumeContext
+	messages []*Message
+	bytes    int
+	timer    *time.Timer
+}
+
+// batchDispatcher accumulates the messages per partition and delivers them
+// to the BatchHandleProc. The batches are delivered one by one in the order
+// they are flushed, and the handler is called without holding the mutex of
+// the accumulated batches, so a slow handler does not block the dispatch of
+// the messages which do not complete a batch.
+type batchDispatcher struct {
+	handler     BatchHandleProc
+	maxMessages int
+	maxBytes    int
+	linger      time.Duration
+
+	batches map[partitionKey]*messageBatch
+	pending []*messageBatch
+	mutex   sync.Mutex
+
+	// handlerMutex serializes the deliveries of the pending batches
+	handlerMutex sync.Mutex
+}
+
+func newBatchDispatcher(opt *BatchOption, handler BatchHandleProc) *batchDispatcher {
+	if opt == nil {
+		opt = &BatchOption{}
+	}
+
+	var (
+		maxMessages = opt.MaxMessages
+		linger      = opt.Linger
+	)
+	if maxMessages <= 0 {
+		maxMessages = DEFAULT_BATCH_MAX_MESSAGES
+	}
+	if linger <= 0 {
+		linger = DEFAULT_BATCH_LINGER
+	}
+
+	return &batchDispatcher{
+		handler:     handler,
+		maxMessages: maxMessages,
+		maxBytes:    opt.MaxBytes,
+		linger:      linger,
+		batches:     make(map[partitionKey]*messageBatch),
+	}
+}
+
+func (d *batchDispatcher) dispatch(ctx *ConsumeContext, message *Message) {
+	if d.append(ctx, message) {
+		d.deliver()
+	}
+}
+
+// append adds the message to the batch of its partition, and reports whether
+// a batch has been flushed.
+func (d *batchDispatcher) append(ctx *ConsumeContext, message *Message) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	key := newPartitionKey(message.TopicPartition)
+	batch, ok := d.batches[key]
+	if !ok {
+		batch = &messageBatch{
+			ctx: ctx,
+		}
+		batch.timer = time.AfterFunc(d.linger, func() {
+			d.mutex.Lock()
+			// the batch might have been flushed by another trigger
+			var flushed = d.batches[key] == batch
+			if flushed {
+				d.flush(key)
+			}
+			d.mutex.Unlock()
+
+			if flushed {
+				d.deliver()
+			}
+		})
+		d.batches[key] = batch
+	}
+	batch.messages = append(batch.messages, message)
+	batch.bytes += len(message.Key) + len(message.Value)
+
+	if len(batch.messages) >= d.maxMessages ||
+		(d.maxBytes > 0 && batch.bytes >= d.maxBytes) {
+		d.flush(key)
+		return true
+	}
+	return false
+}
+
+func (d *batchDispatcher) drain(partitions []TopicPartition) {
+	d.mutex.Lock()
+	for _, tp := range partitions {
+		d.flush(newPartitionKey(tp))
+	}
+	d.mutex.Unlock()
+
+	d.deliver()
+}
+
+func (d *batchDispatcher) close() {
+	d.mutex.Lock()
+	for key := range d.batches {
+		d.flush(key)
+	}
+	d.mutex.Unlock()
+
+	d.deliver()
+}
+
+// flush moves the batch of the partition to the pending batches. It must be
+// called with the mutex held.
+func (d *batchDispatcher) flush(key partitionKey) {
+	batch, ok := d.batches[key]
+	if !ok {
+		return
+	}
+	delete(d.batches, key)
+	batch.timer.Stop()
+
+	d.pending = append(d.pending, batch)
+}
+
+// deliver hands the pending batches to the handler in order. It returns once
+// the batches flushed before the call have been handled, either by the
+// caller or by the delivery in progress.
+func (d *batchDispatcher) deliver() {
+	d.handlerMutex.Lock()
+	defer d.handlerMutex.Unlock()
+
+	for {
+		d.mutex.Lock()
+		if len(d.pending) == 0 {
+			d.mutex.Unlock()
+			return
+		}
+		batch := d.pending[0]
+		d.pending[0] = nil
+		d.pending = d.pending[1:]
+		d.mutex.Unlock()
+
+		ctx := &BatchContext{
+			ConsumeContext: batch.ctx,
+			messages:       batch.messages,
+		}
+		d.handler(ctx, batch.messages)
+	}
+}
@@ -0,0 +1,20 @@
+package kafka
+
+import "time"
+
+const (
+	DEFAULT_BATCH_MAX_MESSAGES = 500
+	DEFAULT_BATCH_LINGER       = 1 * time.Second
+)
+
+// BatchOption specifies when the accumulated messages of a partition are
+// delivered to the BatchHandler. A batch is delivered once any limit is
+// reached.
+type BatchOption struct {
+	MaxMessages int
+	// MaxBytes limits the total size of the keys and values in a batch.
+	MaxBytes int
+	// Linger is the maximum duration to wait since the first message of a
+	// batch arrives.
+	Linger time.Duration
+}
@@ -0,0 +1,102 @@
+package kafka
+
+import (
+	"context"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+var (
+	_ ConsumerClient = new(kafka.Consumer)
+	_ ProducerClient = new(kafka.Producer)
+
+	_ MessageWriter       = new(Producer)
+	_ OffsetCommitter     = new(ConsumeContext)
+	_ PartitionController = new(ConsumeContext)
+)
+
+// MessageWriter writes the messages. It is implemented by *Producer, and is
+// what the DeadLetterOption and the RetryTopicOption write through.
+type MessageWriter interface {
+	WriteMessage(message *Message, deliveryChan chan Event) error
+	WriteAndWait(ctx context.Context, message *Message) (TopicPartition, error)
+}
+
+// OffsetCommitter stores and commits the offsets of the consumed messages.
+// It is implemented by ConsumerClient and *ConsumeContext.
+type OffsetCommitter interface {
+	Commit() ([]TopicPartition, error)
+	CommitMessage(m *Message) ([]TopicPartition, error)
+	CommitOffsets(offsets []TopicPartition) ([]TopicPartition, error)
+	Committed(partitions []TopicPartition, timeoutMs int) (offsets []TopicPartition, err error)
+	StoreOffsets(offsets []TopicPartition) (storedOffsets []TopicPartition, err error)
+	GetConsumerGroupMetadata() (*ConsumerGroupMetadata, error)
+}
+
+// PartitionController pauses, resumes and rewinds the consumption of the
+// partitions. It is implemented by ConsumerClient and *ConsumeContext.
+type PartitionController interface {
+	Pause(partitions []TopicPartition) error
+	Resume(partitions []TopicPartition) error
+	Seek(partition TopicPartition, timeoutMs int) error
+}
+
+// ConsumerClient is the underlying consumer which the Consumer polls. It is
+// implemented by *kafka.Consumer, and can be replaced through
+// Consumer.ClientProvider, e.g. by the in-memory broker of the kafkatest
+// package.
+type ConsumerClient interface {
+	OffsetCommitter
+	PartitionController
+
+	SubscribeTopics(topics []string, rebalanceCb RebalanceCb) error
+	Subscription() (topics []string, err error)
+	Unsubscribe() error
+	Poll(timeoutMs int) Event
+	Assign(partitions []TopicPartition) error
+	Unassign() error
+	Assignment() (partitions []TopicPartition, err error)
+	GetWatermarkOffsets(topic string, partition int32) (low, high int64, err error)
+	GetMetadata(topic *string, allTopics bool, timeoutMs int) (*Metadata, error)
+	Close() error
+}
+
+// ProducerClient is the underlying producer which the Producer writes
+// through. It is implemented by *kafka.Producer, and can be replaced through
+// ProducerOption.ClientProvider.
+type ProducerClient interface {
+	Produce(message *Message, deliveryChan chan Event) error
+	Events() chan Event
+	Flush(timeoutMs int) int
+	GetMetadata(topic *string, allTopics bool, timeoutMs int) (*Metadata, error)
+	Close()
+	InitTransactions(ctx context.Context) error
+	BeginTransaction() error
+	SendOffsetsToTransaction(ctx context.Context, offsets []TopicPartition, consumerMetadata *ConsumerGroupMetadata) error
+	CommitTransaction(ctx context.Context) error
+	AbortTransaction(ctx context.Context) error
+}
+
+func createConsumerClient(provider ConsumerClientProvider, conf *ConfigMap) (ConsumerClient, error) {
+	if provider != nil {
+		return provider(conf)
+	}
+
+	consumer, err := kafka.NewConsumer(conf)
+	if err != nil {
+		return nil, err
+	}
+	return consumer, nil
+}
+
+func createProducerClient(provider ProducerClientProvider, conf *ConfigMap) (ProducerClient, error) {
+	if provider != nil {
+		return provider(conf)
+	}
+
+	producer, err := kafka.NewProducer(conf)
+	if err != nil {
+		return nil, err
+	}
+	return producer, nil
+}
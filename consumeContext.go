@@ -1,6 +1,7 @@
 package kafka
 
 import (
+	"context"
 	"time"
 
 	"github.com/confluentinc/confluent-kafka-go/kafka"
@@ -9,44 +10,87 @@ import (
 var _ MessageHandleProc = StopRecursiveForwardUnhandledMessageHandler
 
 func StopRecursiveForwardUnhandledMessageHandler(ctx *ConsumeContext, message *Message) {
-	logger.Fatal("invalid forward; it might be recursive forward message to unhandledMessageHandler")
+	panic("invalid forward; it might be recursive forward message to unhandledMessageHandler")
 }
 
 type ConsumeContext struct {
 	unhandledMessageHandler MessageHandleProc
-	handle                  *kafka.Consumer
+	committer               OffsetCommitter
+	controller              PartitionController
+	context                 context.Context
+	stop                    func()
+	logger                  Logger
 }
 
+// NewConsumeContext returns a ConsumeContext which commits the offsets
+// through the committer and controls the partitions through the
+// controller, e.g. for testing the handlers against fakes.
+func NewConsumeContext(ctx context.Context, committer OffsetCommitter, controller PartitionController) *ConsumeContext {
+	return &ConsumeContext{
+		committer:  committer,
+		controller: controller,
+		context:    ctx,
+	}
+}
+
+// Context returns the context of the message's partition. It is cancelled
+// when the partition is revoked or the Consumer shuts down.
+func (c *ConsumeContext) Context() context.Context {
+	if c.context != nil {
+		return c.context
+	}
+	return context.Background()
+}
+
+// Logger returns the Logger of the Consumer.
+func (c *ConsumeContext) Logger() Logger {
+	return loggerOrDefault(c.logger)
+}
+
+// Handle returns the underlying *kafka.Consumer, or nil if the underlying
+// consumer is not one.
+//
+// Deprecated: use the methods of ConsumeContext, which implements
+// OffsetCommitter and PartitionController, instead.
 func (c *ConsumeContext) Handle() *kafka.Consumer {
-	return c.handle
+	consumer, _ := c.committer.(*kafka.Consumer)
+	return consumer
 }
 
 func (c *ConsumeContext) Commit() ([]TopicPartition, error) {
-	return c.handle.Commit()
+	return c.committer.Commit()
 }
 
 func (c *ConsumeContext) CommitMessage(m *Message) ([]TopicPartition, error) {
-	return c.handle.CommitMessage(m)
+	return c.committer.CommitMessage(m)
 }
 
 func (c *ConsumeContext) CommitOffsets(offsets []TopicPartition) ([]TopicPartition, error) {
-	return c.handle.CommitOffsets(offsets)
+	return c.committer.CommitOffsets(offsets)
 }
 
 func (c *ConsumeContext) Committed(partitions []TopicPartition, timeoutMs int) (offsets []TopicPartition, err error) {
-	return c.handle.Committed(partitions, timeoutMs)
+	return c.committer.Committed(partitions, timeoutMs)
 }
 
 func (c *ConsumeContext) Pause(partitions []TopicPartition) error {
-	return c.handle.Pause(partitions)
+	return c.controller.Pause(partitions)
 }
 
 func (c *ConsumeContext) Resume(partitions []TopicPartition) error {
-	return c.handle.Resume(partitions)
+	return c.controller.Resume(partitions)
+}
+
+func (c *ConsumeContext) Seek(partition TopicPartition, timeoutMs int) error {
+	return c.controller.Seek(partition, timeoutMs)
+}
+
+func (c *ConsumeContext) GetConsumerGroupMetadata() (*ConsumerGroupMetadata, error) {
+	return c.committer.GetConsumerGroupMetadata()
 }
 
 func (c *ConsumeContext) StoreOffsets(partitions []TopicPartition) (storedOffsets []TopicPartition, err error) {
-	return c.handle.StoreOffsets(partitions)
+	return c.committer.StoreOffsets(partitions)
 }
 
 func (c *ConsumeContext) Wait(partitions []TopicPartition, duration time.Duration, callback func() error) error {
@@ -66,11 +110,34 @@ func (c *ConsumeContext) Wait(partitions []TopicPartition, duration time.Duratio
 	return err
 }
 
+// stopConsumeLoop stops the underlying consumer which polled the message.
+func (c *ConsumeContext) stopConsumeLoop() {
+	if c.stop != nil {
+		c.stop()
+	}
+}
+
+// withContext returns a copy of the ConsumeContext with the context.
+func (c *ConsumeContext) withContext(ctx context.Context) *ConsumeContext {
+	return &ConsumeContext{
+		unhandledMessageHandler: c.unhandledMessageHandler,
+		committer:               c.committer,
+		controller:              c.controller,
+		context:                 ctx,
+		stop:                    c.stop,
+		logger:                  c.logger,
+	}
+}
+
 func (c *ConsumeContext) ForwardUnhandledMessage(message *Message) {
 	if c.unhandledMessageHandler != nil {
 		ctx := &ConsumeContext{
 			unhandledMessageHandler: StopRecursiveForwardUnhandledMessageHandler,
-			handle:                  c.handle,
+			committer:               c.committer,
+			controller:              c.controller,
+			context:                 c.context,
+			stop:                    c.stop,
+			logger:                  c.logger,
 		}
 		c.unhandledMessageHandler(ctx, message)
 	}
@@ -0,0 +1,58 @@
+package kafka
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+type recordingCommitter struct {
+	OffsetCommitter
+	PartitionController
+
+	committed []TopicPartition
+	paused    []TopicPartition
+}
+
+func (c *recordingCommitter) CommitOffsets(offsets []TopicPartition) ([]TopicPartition, error) {
+	c.committed = append(c.committed, offsets...)
+	return offsets, nil
+}
+
+func (c *recordingCommitter) Pause(partitions []TopicPartition) error {
+	c.paused = append(c.paused, partitions...)
+	return nil
+}
+
+func TestNewConsumeContext(t *testing.T) {
+	fake := &recordingCommitter{}
+	ctx := NewConsumeContext(context.Background(), fake, fake)
+
+	if ctx.Handle() != nil {
+		t.Errorf("assert ConsumeContext.Handle() expect '%v', got '%v'", nil, ctx.Handle())
+	}
+
+	topic := "gotest"
+	batch := &BatchContext{
+		ConsumeContext: ctx,
+		messages: []*Message{
+			{TopicPartition: TopicPartition{Topic: &topic, Partition: 1, Offset: 10}},
+			{TopicPartition: TopicPartition{Topic: &topic, Partition: 1, Offset: 11}},
+		},
+	}
+	if _, err := batch.CommitBatch(); err != nil {
+		t.Fatalf("%s", err)
+	}
+	expected := []TopicPartition{{Topic: &topic, Partition: 1, Offset: 12}}
+	if !reflect.DeepEqual(fake.committed, expected) {
+		t.Errorf("assert committed offsets expect '%v', got '%v'", expected, fake.committed)
+	}
+
+	partitions := []TopicPartition{{Topic: &topic, Partition: 1}}
+	if err := ctx.Pause(partitions); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if !reflect.DeepEqual(fake.paused, partitions) {
+		t.Errorf("assert paused partitions expect '%v', got '%v'", partitions, fake.paused)
+	}
+}
@@ -0,0 +1,269 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+var (
+	errConsumeLoopClosed   = fmt.Errorf("the underlying consumer has been closed")
+	errConsumeLoopsStopped = fmt.Errorf("all the underlying consumers have stopped")
+)
+
+type partitionContext struct {
+	ctx    *ConsumeContext
+	cancel context.CancelFunc
+}
+
+// consumeLoop polls the events of an underlying ConsumerClient.
+type consumeLoop struct {
+	consumer *Consumer
+	handle   ConsumerClient
+
+	context    context.Context
+	stopChan   <-chan struct{}
+	stopped    chan struct{}
+	stopOnce   sync.Once
+	partitions map[partitionKey]*partitionContext
+	mutex      sync.Mutex
+
+	closed      bool
+	closedMutex sync.RWMutex
+}
+
+func newConsumeLoop(ctx context.Context, stopChan <-chan struct{}, consumer *Consumer, handle ConsumerClient) *consumeLoop {
+	return &consumeLoop{
+		consumer:   consumer,
+		handle:     handle,
+		context:    ctx,
+		stopChan:   stopChan,
+		stopped:    make(chan struct{}),
+		partitions: make(map[partitionKey]*partitionContext),
+	}
+}
+
+func (l *consumeLoop) run() {
+	var (
+		c                = l.consumer
+		consumer         = l.handle
+		pollingTimeoutMs = int(c.PollingTimeout / time.Millisecond)
+	)
+
+	defer func() {
+		partitions, err := consumer.Assignment()
+		if err == nil {
+			l.release(partitions)
+		}
+		if !l.isStopped() {
+			l.commit()
+		}
+		consumer.Unassign()
+		consumer.Unsubscribe()
+
+		l.closedMutex.Lock()
+		l.closed = true
+		consumer.Close()
+		l.closedMutex.Unlock()
+	}()
+
+	for {
+		select {
+		case <-l.stopChan:
+			return
+		case <-l.stopped:
+			c.logger().Info("stop polling", "topics", l.subscription())
+			return
+
+		default:
+			var ev kafka.Event
+			if ev == nil {
+				// hold up polling until got non-nil kafka.Event
+				ev = consumer.Poll(pollingTimeoutMs)
+				if ev == nil {
+					continue
+				}
+			} else {
+				ev = consumer.Poll(0)
+			}
+
+			switch e := ev.(type) {
+			case kafka.AssignedPartitions:
+				consumer.Assign(e.Partitions)
+
+			case kafka.RevokedPartitions:
+				l.revoke(e.Partitions)
+				consumer.Unassign()
+
+			case *kafka.Stats:
+				handleStats(e, c.StatsHandler, c.Metrics, c.logger())
+
+			case kafka.PartitionEOF:
+				c.logger().Info("reached end of partition", "partition", kafka.TopicPartition(e))
+
+			case *kafka.Message:
+				l.observeMessage(e)
+				c.dispatcher.dispatch(l.consumeContext(e.TopicPartition), e)
+
+			case kafka.Error:
+				switch c.processKafkaError(e) {
+				case ErrorDecisionStopConsumer:
+					return
+				case ErrorDecisionEscalate:
+					c.reportFatalError(e)
+					return
+				}
+			default:
+				// TODO: catch GroupCoordinator: Disconnected (after %dms in state UP)
+				c.logger().Debug("ignored event", "event", e)
+			}
+		}
+	}
+}
+
+// consumeContext returns the ConsumeContext of the specified partition. Its
+// context is cancelled when the partition is revoked or the Consumer shuts
+// down.
+func (l *consumeLoop) consumeContext(tp TopicPartition) *ConsumeContext {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	key := newPartitionKey(tp)
+	p, ok := l.partitions[key]
+	if !ok {
+		ctx, cancel := context.WithCancel(l.context)
+		p = &partitionContext{
+			ctx: &ConsumeContext{
+				unhandledMessageHandler: l.consumer.UnhandledMessageHandler,
+				committer:               l.handle,
+				controller:              l.handle,
+				context:                 ctx,
+				stop:                    l.stop,
+				logger:                  l.consumer.logger(),
+			},
+			cancel: cancel,
+		}
+		l.partitions[key] = p
+	}
+	return p.ctx
+}
+
+// observeMessage records the consumed message and the lag of its partition
+// against the cached high watermark.
+func (l *consumeLoop) observeMessage(message *kafka.Message) {
+	var metrics = l.consumer.Metrics
+	if metrics == nil {
+		return
+	}
+
+	tp := message.TopicPartition
+	metrics.observeConsumed(tp)
+	if tp.Topic == nil {
+		return
+	}
+	_, high, err := l.handle.GetWatermarkOffsets(*tp.Topic, tp.Partition)
+	if err == nil && high >= 0 {
+		metrics.observeLag(tp, high-int64(tp.Offset)-1)
+	}
+}
+
+// stop makes the consumeLoop exit and skip the final commit.
+func (l *consumeLoop) stop() {
+	l.stopOnce.Do(func() {
+		close(l.stopped)
+	})
+}
+
+func (l *consumeLoop) isStopped() bool {
+	select {
+	case <-l.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+// checkHealth runs the health check through the underlying consumer. It
+// returns errConsumeLoopClosed if the consumer has been closed.
+func (l *consumeLoop) checkHealth(ctx context.Context, conf *ConfigMap, topics []string) (*HealthReport, error) {
+	l.closedMutex.RLock()
+	defer l.closedMutex.RUnlock()
+
+	if l.closed {
+		return nil, errConsumeLoopClosed
+	}
+	return checkHealth(ctx, l.handle, conf, topics)
+}
+
+func (l *consumeLoop) subscription() []string {
+	topics, _ := l.handle.Subscription()
+	return topics
+}
+
+// revoke cancels the context of the revoked partitions, so their handlers
+// give up in time, and then waits for their queued messages and the
+// messages waiting in background to be done.
+func (l *consumeLoop) revoke(partitions []TopicPartition) {
+	l.cancel(partitions)
+	l.consumer.dispatcher.drain(partitions)
+	l.consumer.retries.wait(partitions)
+	l.consumer.Metrics.deleteLag(partitions)
+}
+
+// release waits for the queued messages of the specified partitions to be
+// handled on shutdown, and then cancels their context to abandon the
+// messages waiting in background.
+func (l *consumeLoop) release(partitions []TopicPartition) {
+	l.consumer.dispatcher.drain(partitions)
+	l.cancel(partitions)
+	l.consumer.retries.wait(partitions)
+	l.consumer.Metrics.deleteLag(partitions)
+}
+
+func (l *consumeLoop) cancel(partitions []TopicPartition) {
+	var revoked []*partitionContext
+
+	l.mutex.Lock()
+	for _, tp := range partitions {
+		key := newPartitionKey(tp)
+		if p, ok := l.partitions[key]; ok {
+			delete(l.partitions, key)
+			revoked = append(revoked, p)
+		}
+	}
+	l.mutex.Unlock()
+
+	for _, p := range revoked {
+		p.cancel()
+	}
+}
+
+func (l *consumeLoop) commit() {
+	_, err := l.handle.Commit()
+	if err != nil {
+		if e, ok := err.(kafka.Error); ok && e.Code() == kafka.ErrNoOffset {
+			return
+		}
+		l.consumer.logger().Error("cannot commit final offsets", "error", err)
+	}
+}
+
+// createRebalanceCb wraps the specified RebalanceCb to ensure the queued
+// messages of revoked partitions are handled before the partitions are
+// unassigned.
+func (l *consumeLoop) createRebalanceCb(rebalanceCb RebalanceCb) RebalanceCb {
+	return func(consumer *kafka.Consumer, ev kafka.Event) error {
+		switch e := ev.(type) {
+		case kafka.RevokedPartitions:
+			l.revoke(e.Partitions)
+		}
+
+		if rebalanceCb != nil {
+			return rebalanceCb(consumer, ev)
+		}
+		return nil
+	}
+}
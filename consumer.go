@@ -1,25 +1,82 @@
 package kafka
 
 import (
-	"strings"
+	"context"
+	"fmt"
 	"sync"
 	"time"
 
-	"github.com/bcowtech/lib-kafka/internal"
 	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Consumer struct {
 	MessageHandler          MessageHandleProc
+	MessageProcessor        MessageProcessProc
+	RetryPolicy             *RetryPolicy
+	DeadLetter              *DeadLetterOption
+	RetryTopics             *RetryTopicOption
+	BatchHandler            BatchHandleProc
+	Batch                   *BatchOption
 	UnhandledMessageHandler MessageHandleProc
-	ErrorHandler            ErrorHandleProc
-	ConfigMap               *ConfigMap
-	PollingTimeout          time.Duration
-	PingTimeout             time.Duration
-
-	consumers []*kafka.Consumer
-	stopChan  chan bool
-	wg        sync.WaitGroup
+	// Logger is used instead of the Logger set by SetLogger. The librdkafka
+	// logs are written to it as well if go.logs.channel.enable is set.
+	Logger Logger
+	// Metrics records the consumed messages, the consumer lag, the handler
+	// latency, retries and dead letters, and the client errors.
+	Metrics *Metrics
+	// StatsHandler receives the librdkafka statistics if
+	// statistics.interval.ms is set.
+	StatsHandler StatsHandleProc
+	// Tracer starts a consumer span around every handler invocation, as the
+	// child of the trace context carried by the message headers. The span
+	// context is carried by ConsumeContext.Context(). Use
+	// otel.Tracer(name) for the global TracerProvider.
+	Tracer trace.Tracer
+	// PanicHandler decides how to deal with the message whose handler
+	// panics. The message of a batch is the first message of the batch. If
+	// it is nil, the panic is logged, the underlying consumer is stopped and
+	// Run returns the PanicError.
+	PanicHandler      PanicHandleProc
+	ErrorHandler      ErrorHandleProc
+	ErrorPolicy       ErrorPolicy
+	FatalErrorHandler FatalErrorHandleProc
+	ConfigMap         *ConfigMap
+	PollingTimeout    time.Duration
+	// PingTimeout bounds the health check which Subscribe runs if the
+	// bootstrap.servers is specified. It is DEFAULT_HEALTH_CHECK_TIMEOUT
+	// if zero.
+	PingTimeout     time.Duration
+	ShutdownTimeout time.Duration
+	WorkerPool      *WorkerPoolOption
+	// SharedSubscription subscribes all topics, including the regex
+	// patterns beginning with "^", through one underlying consumer, so the
+	// Consumer joins the group once. Otherwise every topic is subscribed
+	// through its own underlying consumer.
+	SharedSubscription bool
+	// TopicHandlers routes the messages to the handlers by their topic, or
+	// by their original topic if they come from a retry topic. The messages
+	// of the other topics are handled by MessageProcessor or MessageHandler.
+	TopicHandlers map[string]MessageHandleProc
+	// ClientProvider creates the underlying consumers instead of
+	// kafka.NewConsumer. The RebalanceCb passed to Subscribe receives the
+	// *kafka.Consumer only if the underlying consumer is one.
+	ClientProvider ConsumerClientProvider
+
+	consumers      []ConsumerClient
+	loops          []*consumeLoop
+	topics         []string
+	conf           *ConfigMap
+	dispatcher     messageDispatcher
+	context        context.Context
+	cancel         context.CancelFunc
+	stopChan       chan struct{}
+	loopsDone      chan struct{}
+	fatalErrorChan chan error
+	retries        *partitionWaitGroup
+	wg             sync.WaitGroup
+	transactional  bool
 
 	mutex       sync.Mutex
 	initialized bool
@@ -29,10 +86,20 @@ type Consumer struct {
 
 func (c *Consumer) Subscribe(topics []string, rebalanceCb RebalanceCb) error {
 	if c.disposed {
-		logger.Panic("the Consumer has been disposed")
+		panic("the Consumer has been disposed")
 	}
 	if c.running {
-		logger.Panic("the Consumer is running")
+		panic("the Consumer is running")
+	}
+	if c.DeadLetter != nil {
+		if err := c.DeadLetter.validateTopics(topics); err != nil {
+			return err
+		}
+	}
+	if c.RetryTopics != nil {
+		if err := c.RetryTopics.validateTopics(topics); err != nil {
+			return err
+		}
 	}
 
 	var err error
@@ -41,146 +108,114 @@ func (c *Consumer) Subscribe(topics []string, rebalanceCb RebalanceCb) error {
 		if err != nil {
 			c.running = false
 			c.disposed = true
+			if c.dispatcher != nil {
+				c.dispatcher.close()
+				c.dispatcher = nil
+			}
+			c.cancel()
 		}
 		c.mutex.Unlock()
 	}()
 	c.init()
 	c.running = true
+	c.dispatcher = c.createDispatcher()
 
-	{
-		// ping address
-		var conf = c.ConfigMap
-		v, _ := conf.Get(KAFKA_CONF_BOOTSTRAP_SERVERS, nil)
-		if v != nil {
-			bootstrapServers := v.(string)
-			addrs := strings.Split(bootstrapServers, ",")
-			err = internal.Ping(addrs, c.PingTimeout)
-			if err != nil {
-				return err
-			}
-		}
+	if c.RetryTopics != nil {
+		topics = c.RetryTopics.expandTopics(topics)
 	}
 
-	for _, topic := range topics {
-		var consumer *kafka.Consumer
-		consumer, err = kafka.NewConsumer(c.ConfigMap)
+	var conf = c.createConfigMap()
+	if logs := createLogsChannel(conf); logs != nil {
+		go forwardLogs(c.logger(), logs, c.context.Done())
+	}
+	var loops []*consumeLoop
+	for _, subscription := range c.createSubscriptions(topics) {
+		var consumer ConsumerClient
+		consumer, err = createConsumerClient(c.ClientProvider, conf)
 		if err != nil {
 			return err
 		}
+		if len(loops) == 0 {
+			err = startupHealthCheck(consumer, conf, topics, c.PingTimeout)
+			if err != nil {
+				consumer.Close()
+				return err
+			}
+		}
 
-		err = consumer.SubscribeTopics([]string{topic}, rebalanceCb)
+		loop := newConsumeLoop(c.context, c.stopChan, c, consumer)
+		err = consumer.SubscribeTopics(subscription, loop.createRebalanceCb(rebalanceCb))
 		if err != nil {
 			return err
 		}
 
 		c.consumers = append(c.consumers, consumer)
+		loops = append(loops, loop)
 	}
 
-	var (
-		pollingTimeoutMs = int(c.PollingTimeout / time.Millisecond)
-	)
+	c.loops = loops
+	c.topics = topics
+	c.conf = conf
 
-	for _, consumer := range c.consumers {
-		var (
-			ctx *ConsumeContext
-		)
-		ctx = &ConsumeContext{
-			unhandledMessageHandler: c.UnhandledMessageHandler,
-			handle:                  consumer,
+	for _, loop := range loops {
+		c.wg.Add(1)
+		go func(loop *consumeLoop) {
+			defer c.wg.Done()
+			defer c.recoverLoopPanic()
+			loop.run()
+		}(loop)
+	}
+	go func() {
+		c.wg.Wait()
+		close(c.loopsDone)
+	}()
+	return nil
+}
+
+// Run blocks until ctx is cancelled, a fatal error occurs or all the
+// underlying consumers stop, and then shuts the Consumer down within
+// ShutdownTimeout. It returns nil if the Consumer is shut down by Shutdown
+// or Close. The Consumer must be subscribed before calling Run.
+func (c *Consumer) Run(ctx context.Context) error {
+	if !c.running {
+		return fmt.Errorf("the Consumer is not running")
+	}
+
+	var err error
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+	case err = <-c.fatalErrorChan:
+	case <-c.loopsDone:
+		select {
+		case err = <-c.fatalErrorChan:
+		case <-c.stopChan:
+		default:
+			err = errConsumeLoopsStopped
 		}
+	}
 
-		go func(consumer *kafka.Consumer, stopChan chan bool) {
-			c.wg.Add(1)
-			defer c.wg.Done()
+	var shutdownCtx = context.Background()
+	if c.ShutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		shutdownCtx, cancel = context.WithTimeout(shutdownCtx, c.ShutdownTimeout)
+		defer cancel()
+	}
 
-			defer func() {
-				consumer.Unassign()
-				consumer.Unsubscribe()
-				consumer.Close()
-			}()
-
-			for {
-				select {
-				case <-stopChan:
-					return
-
-				default:
-					var ev kafka.Event
-					if ev == nil {
-						// hold up polling until got non-nil kafka.Event
-						ev = consumer.Poll(pollingTimeoutMs)
-						if ev == nil {
-							continue
-						}
-					} else {
-						ev = consumer.Poll(0)
-					}
-
-					switch e := ev.(type) {
-					case kafka.AssignedPartitions:
-						consumer.Assign(e.Partitions)
-
-					case kafka.RevokedPartitions:
-						consumer.Unassign()
-
-					case kafka.PartitionEOF:
-						logger.Printf("%% Notice: Reached %v\n", e)
-
-					case *kafka.Message:
-						c.processMessage(ctx, e)
-
-					case kafka.Error:
-						switch e.Code() {
-						case kafka.ErrUnknownTopic, kafka.ErrUnknownTopicOrPart:
-							if !c.processKafkaError(e) {
-								logger.Fatalf("%% Error: (%#v) %+v: %v\n", e.Code(), e.Code(), e)
-							}
-
-						/* NOTE: https://github.com/edenhill/librdkafka/issues/64
-						Currently the only error codes signaled through the error_cb are:
-						- RD_KAFKA_RESP_ERR__ALL_BROKERS_DOWN - all brokers are down
-						- RD_KAFKA_RESP_ERR__FAIL - generic low level errors (socket failures because of lacking ipv4/ipv6 support)
-						- RD_KAFKA_RESP_ERR__RESOLVE - failure to resolve the broker address
-						- RD_KAFKA_RESP_ERR__CRIT_SYS_RESOURCE - failed to create new thread
-						- RD_KAFKA_RESP_ERR__FS - various file errors in the consumer offset management code
-						- RD_KAFKA_RESP_ERR__TRANSPORT - failed to connect to single broker, or connection error for single broker
-						- RD_KAFKA_RESP_ERR__BAD_MSG - received malformed packet from broker (version mismatch?)
-						I guess you could treat all but .._TRANSPORT as fatal.
-						*/
-						case kafka.ErrTransport:
-							if !c.processKafkaError(e) {
-								logger.Printf("%% Error: (%#v) %+v: %v\n", e.Code(), e.Code(), e)
-							}
-							continue
-						case kafka.ErrAllBrokersDown,
-							kafka.ErrFail,
-							kafka.ErrResolve,
-							kafka.ErrCritSysResource,
-							kafka.ErrFs,
-							kafka.ErrBadMsg:
-							logger.Fatalf("%% Error: (%#v) %+v: %v\n", e.Code(), e.Code(), e)
-
-						default:
-							if !c.processKafkaError(e) {
-								logger.Printf("%% Error: (%#v) %+v: %v\n", e.Code(), e.Code(), e)
-							}
-							return
-						}
-					default:
-						// TODO: catch GroupCoordinator: Disconnected (after %dms in state UP)
-						logger.Printf("%% Notice: Ignored %v\n", e)
-						logger.Printf("%% Notice: Ignored %#v\n", e)
-					}
-				}
-			}
-		}(consumer, c.stopChan)
+	shutdownErr := c.Shutdown(shutdownCtx)
+	if shutdownErr != nil {
+		c.logger().Error("cannot shutdown the Consumer", "error", shutdownErr)
 	}
-	return nil
+	return err
 }
 
-func (c *Consumer) Close() {
+// Shutdown stops polling, waits for the in-flight messages to be handled,
+// commits the final offsets and then cancels the context of every
+// ConsumeContext. It gives up waiting when ctx is done, cancels the contexts
+// right away and returns ctx.Err().
+func (c *Consumer) Shutdown(ctx context.Context) error {
 	if c.disposed {
-		return
+		return nil
 	}
 
 	c.mutex.Lock()
@@ -189,17 +224,62 @@ func (c *Consumer) Close() {
 		c.disposed = true
 		// dispose
 		c.consumers = nil
-		c.stopChan = nil
+		c.loops = nil
 		c.mutex.Unlock()
 	}()
 
-	count := len(c.consumers)
-	for i := 0; i < count; i++ {
-		c.stopChan <- true
+	if !c.initialized {
+		return nil
 	}
 	close(c.stopChan)
 
-	c.wg.Wait()
+	var (
+		done       = make(chan struct{})
+		dispatcher = c.dispatcher
+	)
+	go func() {
+		defer close(done)
+
+		c.wg.Wait()
+		if dispatcher != nil {
+			dispatcher.close()
+		}
+		c.cancel()
+		c.retries.waitAll()
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		c.cancel()
+		return ctx.Err()
+	}
+}
+
+// HealthCheck requests the cluster metadata, verifies the subscribed
+// topics exist, and reports the reachability of every broker. It fails if
+// the Consumer is not running.
+func (c *Consumer) HealthCheck(ctx context.Context) (*HealthReport, error) {
+	c.mutex.Lock()
+	var (
+		loops  = c.loops
+		topics = c.topics
+		conf   = c.conf
+	)
+	c.mutex.Unlock()
+
+	for _, loop := range loops {
+		report, err := loop.checkHealth(ctx, conf, topics)
+		if err != errConsumeLoopClosed {
+			return report, err
+		}
+	}
+	return nil, fmt.Errorf("the Consumer is not running")
+}
+
+func (c *Consumer) Close() {
+	c.Shutdown(context.Background())
 }
 
 func (c *Consumer) init() {
@@ -207,23 +287,343 @@ func (c *Consumer) init() {
 		return
 	}
 
-	if c.stopChan == nil {
-		c.stopChan = make(chan bool, 1)
-	}
+	c.context, c.cancel = context.WithCancel(context.Background())
+	c.stopChan = make(chan struct{})
+	c.loopsDone = make(chan struct{})
+	c.fatalErrorChan = make(chan error, 1)
+	c.retries = newPartitionWaitGroup()
 	c.initialized = true
 }
 
-func (c *Consumer) processKafkaError(err kafka.Error) (disposed bool) {
-	if c.ErrorHandler != nil {
-		return c.ErrorHandler(err)
+func (c *Consumer) createConfigMap() *ConfigMap {
+	var conf = *copyConfigMap(c.ConfigMap)
+
+	if c.WorkerPool != nil && c.WorkerPool.Ordering == OrderByKey {
+		// the offsets are stored by the keyDispatcher
+		conf[KAFKA_CONF_ENABLE_AUTO_OFFSET_STORE] = false
+	}
+	if c.storesOffsets() {
+		// the offsets are stored once the messages are handled or republished
+		conf[KAFKA_CONF_ENABLE_AUTO_OFFSET_STORE] = false
+	}
+	if c.transactional {
+		// the offsets are committed through the transactions of the Processor
+		conf[KAFKA_CONF_ENABLE_AUTO_COMMIT] = false
+		conf[KAFKA_CONF_ENABLE_AUTO_OFFSET_STORE] = false
+	}
+	return &conf
+}
+
+// createSubscriptions groups the topics by the underlying consumer which
+// subscribes them.
+func (c *Consumer) createSubscriptions(topics []string) [][]string {
+	if c.SharedSubscription {
+		return [][]string{topics}
+	}
+
+	var subscriptions = make([][]string, 0, len(topics))
+	for _, topic := range topics {
+		subscriptions = append(subscriptions, []string{topic})
+	}
+	return subscriptions
+}
+
+func (c *Consumer) createDispatcher() messageDispatcher {
+	if c.BatchHandler != nil {
+		return newBatchDispatcher(c.Batch, c.processBatch)
+	}
+	if c.WorkerPool != nil {
+		switch c.WorkerPool.Ordering {
+		case OrderByKey:
+			return newKeyDispatcher(c.WorkerPool, c.processMessage)
+		default:
+			return newPartitionDispatcher(c.WorkerPool, c.processMessage)
+		}
+	}
+	return &serialDispatcher{
+		handler: c.processMessage,
+	}
+}
+
+func (c *Consumer) logger() Logger {
+	return loggerOrDefault(c.Logger)
+}
+
+func (c *Consumer) reportFatalError(err error) {
+	select {
+	case c.fatalErrorChan <- err:
+	default:
+	}
+}
+
+func (c *Consumer) processKafkaError(err kafka.Error) ErrorDecision {
+	c.Metrics.observeError(err)
+	executor := &errorPolicyExecutor{
+		policy:            c.ErrorPolicy,
+		errorHandler:      c.ErrorHandler,
+		fatalErrorHandler: c.FatalErrorHandler,
+		logger:            c.logger(),
+	}
+	return executor.execute(err)
+}
+
+func (c *Consumer) processBatch(ctx *BatchContext, messages []*Message) {
+	if len(messages) == 0 {
+		return
 	}
-	return false
+	defer c.recoverBatchPanic(ctx, messages)
+
+	start := time.Now()
+	c.BatchHandler(ctx, messages)
+	c.Metrics.observeHandlerDuration(messages[0].TopicPartition, time.Since(start))
+	c.storeOffset(ctx.ConsumeContext, messages[len(messages)-1])
 }
 
 func (c *Consumer) processMessage(ctx *ConsumeContext, message *kafka.Message) {
+	// the worker owns the message's partition or key, so the following
+	// messages are queued until the message is handled
+	var blocking = c.WorkerPool != nil
+	c.handleMessage(ctx, message, blocking)
+}
+
+// handleMessage invokes the handler of the message. If blocking is false,
+// the message which needs to wait is handled in background with its
+// partition paused, so the Consumer keeps polling the other partitions.
+func (c *Consumer) handleMessage(ctx *ConsumeContext, message *kafka.Message, blocking bool) {
+	if delay := c.RetryTopics.delayOf(message); delay > 0 {
+		if !blocking {
+			c.handleInBackground(ctx, message, func() {
+				c.handleMessage(ctx, message, true)
+			})
+			return
+		}
+		if !c.sleep(ctx, delay) {
+			return
+		}
+	}
+
+	err := c.invokeHandler(ctx, message)
+	if err == errConsumeLoopStopped {
+		return
+	}
+	if err == nil {
+		c.storeOffset(ctx, message)
+		return
+	}
+	if !c.RetryPolicy.shouldRetry(err, 1) {
+		c.giveUpMessage(ctx, message, err, 1)
+		return
+	}
+
+	if !blocking {
+		c.handleInBackground(ctx, message, func() {
+			c.retryMessage(ctx, message, err)
+		})
+		return
+	}
+	c.retryMessage(ctx, message, err)
+}
+
+// invokeHandler handles the message with the handler of its topic, the
+// MessageProcessor or the MessageHandler. The panic of the handler is
+// returned as the error to retry or give up according to the PanicHandler.
+func (c *Consumer) invokeHandler(ctx *ConsumeContext, message *kafka.Message) (err error) {
+	if c.Tracer != nil {
+		var span trace.Span
+		ctx, span = c.startSpan(ctx, message)
+		defer func() {
+			endSpan(span, err)
+		}()
+	}
+	defer c.recoverMessagePanic(ctx, message, &err)
+
+	start := time.Now()
+	defer func() {
+		c.Metrics.observeHandlerDuration(message.TopicPartition, time.Since(start))
+	}()
+
+	if handler, ok := c.topicHandlerOf(message); ok {
+		handler(ctx, message)
+		return nil
+	}
+	if c.MessageProcessor != nil {
+		return c.MessageProcessor(ctx, message)
+	}
 	if c.MessageHandler != nil {
 		c.MessageHandler(ctx, message)
-	} else {
-		ctx.ForwardUnhandledMessage(message)
+		return nil
 	}
+	ctx.ForwardUnhandledMessage(message)
+	return nil
+}
+
+func (c *Consumer) startSpan(ctx *ConsumeContext, message *kafka.Message) (*ConsumeContext, trace.Span) {
+	attributes := messagingAttributes(message, "process")
+	if groupID, _ := c.ConfigMap.Get(KAFKA_CONF_GROUP_ID, nil); groupID != nil {
+		attributes = append(attributes, attribute.String(TRACE_ATTR_MESSAGING_KAFKA_GROUP, fmt.Sprint(groupID)))
+	}
+
+	parent := ExtractTraceContext(ctx.Context(), message)
+	spanCtx, span := c.Tracer.Start(parent, spanNameOf(message, "process"),
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attributes...))
+	return ctx.withContext(spanCtx), span
+}
+
+func (c *Consumer) topicHandlerOf(message *kafka.Message) (MessageHandleProc, bool) {
+	if len(c.TopicHandlers) == 0 {
+		return nil, false
+	}
+
+	original := OriginalTopicPartition(message)
+	if original.Topic == nil {
+		return nil, false
+	}
+	handler, ok := c.TopicHandlers[*original.Topic]
+	return handler, ok && handler != nil
+}
+
+func (c *Consumer) handleInBackground(ctx *ConsumeContext, message *kafka.Message, fn func()) {
+	var partitions = []TopicPartition{message.TopicPartition}
+	if err := ctx.Pause(partitions); err != nil {
+		ctx.Logger().Error("cannot pause partition", "partition", message.TopicPartition, "error", err)
+	}
+	c.retries.goRun(message.TopicPartition, func() {
+		defer ctx.Resume(partitions)
+		fn()
+	})
+}
+
+func (c *Consumer) retryMessage(ctx *ConsumeContext, message *kafka.Message, err error) {
+	for attempt := 1; ; attempt++ {
+		if !c.sleep(ctx, c.RetryPolicy.backoff(attempt)) {
+			ctx.Logger().Info("abandon retrying message", "partition", message.TopicPartition, "attempts", attempt, "error", ctx.Context().Err())
+			return
+		}
+
+		c.Metrics.observeHandlerRetry(message.TopicPartition)
+		err = c.invokeHandler(ctx, message)
+		if err == errConsumeLoopStopped {
+			return
+		}
+		if err == nil {
+			c.storeOffset(ctx, message)
+			return
+		}
+		if !c.RetryPolicy.shouldRetry(err, attempt+1) {
+			c.giveUpMessage(ctx, message, err, attempt+1)
+			return
+		}
+	}
+}
+
+// sleep waits for the duration, and returns false if the context of ctx is
+// done before.
+func (c *Consumer) sleep(ctx *ConsumeContext, duration time.Duration) bool {
+	return sleepContext(ctx.Context(), duration)
+}
+
+// sleepUntilShutdown waits for the duration like sleep, and also returns
+// false if the Consumer shuts down before, which waits for the handlers
+// instead of cancelling their context.
+func (c *Consumer) sleepUntilShutdown(ctx *ConsumeContext, duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Context().Done():
+		return false
+	case <-c.stopChan:
+		return false
+	}
+}
+
+func (c *Consumer) giveUpMessage(ctx *ConsumeContext, message *kafka.Message, err error, attempts int) {
+	ctx.Logger().Error("give up message", "partition", message.TopicPartition, "attempts", attempts, "error", err)
+
+	// count the attempts made before the message was sent to a retry topic
+	attempts += retryAttemptsOf(message)
+
+	if c.RetryTopics != nil {
+		if retry := c.RetryTopics.createMessage(message, err, attempts); retry != nil {
+			c.republishMessage(ctx, message, c.RetryTopics.Producer, retry, c.RetryTopics.RetryBackoff)
+			return
+		}
+	}
+	if c.DeadLetter != nil {
+		deadLetter := c.DeadLetter.createMessage(message, err, attempts)
+		if c.republishMessage(ctx, message, c.DeadLetter.Producer, deadLetter, c.DeadLetter.RetryBackoff) {
+			c.Metrics.observeDeadLetter(message.TopicPartition)
+		}
+		return
+	}
+	ctx.ForwardUnhandledMessage(message)
+	c.storeOffset(ctx, message)
+}
+
+// republishMessage produces the republished message, and stores and commits
+// the offset of the source message once the delivery succeeds. The delivery is retried
+// until it succeeds, the partition is revoked or the Consumer shuts down,
+// and it returns whether the message has been delivered. The offset of the
+// message which is not delivered is left uncommitted, so the message is
+// consumed again.
+func (c *Consumer) republishMessage(ctx *ConsumeContext, source *kafka.Message, producer MessageWriter, message *kafka.Message, retryBackoff time.Duration) bool {
+	if retryBackoff <= 0 {
+		retryBackoff = DEFAULT_RETRY_INITIAL_BACKOFF
+	}
+
+	for {
+		err := c.deliverMessage(ctx, producer, message)
+		if err == nil {
+			break
+		}
+		ctx.Logger().Error("cannot republish message", "partition", source.TopicPartition, "topic", *message.TopicPartition.Topic, "error", err)
+
+		if !c.sleepUntilShutdown(ctx, retryBackoff) {
+			ctx.Logger().Info("abandon republishing message", "partition", source.TopicPartition, "topic", *message.TopicPartition.Topic)
+			return false
+		}
+	}
+
+	if c.WorkerPool != nil && c.WorkerPool.Ordering == OrderByKey {
+		// the offset is stored by the keyDispatcher once the handler returns
+		return true
+	}
+	c.storeOffset(ctx, source)
+	_, err := ctx.CommitMessage(source)
+	if err != nil {
+		ctx.Logger().Error("cannot commit message", "partition", source.TopicPartition, "error", err)
+	}
+	return true
+}
+
+// storesOffsets reports whether the Consumer stores the offsets of the
+// handled messages itself, so that the offset of a message which is going
+// to be republished is not committed in advance.
+func (c *Consumer) storesOffsets() bool {
+	if c.transactional || (c.WorkerPool != nil && c.WorkerPool.Ordering == OrderByKey) {
+		return false
+	}
+	return c.DeadLetter != nil || c.RetryTopics != nil
+}
+
+// storeOffset stores the offset following the message if the Consumer
+// stores the offsets itself.
+func (c *Consumer) storeOffset(ctx *ConsumeContext, message *kafka.Message) {
+	if !c.storesOffsets() {
+		return
+	}
+
+	tp := message.TopicPartition
+	_, err := ctx.StoreOffsets([]TopicPartition{{Topic: tp.Topic, Partition: tp.Partition, Offset: tp.Offset + 1}})
+	if err != nil {
+		ctx.Logger().Error("cannot store offset", "partition", tp, "error", err)
+	}
+}
+
+func (c *Consumer) deliverMessage(ctx *ConsumeContext, producer MessageWriter, message *kafka.Message) error {
+	_, err := producer.WriteAndWait(ctx.Context(), message)
+	return err
 }
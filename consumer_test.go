@@ -1,8 +1,12 @@
 package kafka
 
 import (
+	"context"
+	"reflect"
 	"testing"
 	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
 )
 
 func TestConsumer_WithoutGroupID(t *testing.T) {
@@ -140,3 +144,310 @@ func TestConsumer_PreventStartAnotherWhenDisposed(t *testing.T) {
 	t.Logf("%s", err)
 	c.Close()
 }
+
+func TestConsumer_WithWorkerPool(t *testing.T) {
+	var (
+		c   *Consumer
+		err error
+	)
+
+	c = &Consumer{
+		PollingTimeout: 30 * time.Millisecond,
+		WorkerPool: &WorkerPoolOption{
+			Workers:   4,
+			QueueSize: 10,
+		},
+		ConfigMap: &ConfigMap{
+			"group.id":                 "gotest",
+			"socket.timeout.ms":        1000,
+			"session.timeout.ms":       10,
+			"enable.auto.offset.store": false, // permit StoreOffsets()
+		},
+	}
+	err = c.Subscribe([]string{"gotest1", "gotest2", "gotest3"}, nil)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	t.Logf("Consumer %+v", c)
+	c.Close()
+
+	{
+		var expectedDisposed bool = true
+		if c.disposed != expectedDisposed {
+			t.Errorf("assert Consumer.disposed expect '%v', got '%v'", expectedDisposed, c.disposed)
+		}
+	}
+}
+
+func TestConsumer_Run(t *testing.T) {
+	c := &Consumer{
+		PollingTimeout:  30 * time.Millisecond,
+		ShutdownTimeout: 5 * time.Second,
+		ConfigMap: &ConfigMap{
+			"group.id":           "gotest",
+			"socket.timeout.ms":  1000,
+			"session.timeout.ms": 10,
+		},
+	}
+
+	err := c.Run(context.Background())
+	if err == nil {
+		t.Fatal("Expected Run() to fail before Subscribe()")
+	}
+
+	err = c.Subscribe([]string{"gotest1", "gotest2"}, nil)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	err = c.Run(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("assert Consumer.Run() expect '%v', got '%v'", context.DeadlineExceeded, err)
+	}
+
+	{
+		var expectedDisposed bool = true
+		if c.disposed != expectedDisposed {
+			t.Errorf("assert Consumer.disposed expect '%v', got '%v'", expectedDisposed, c.disposed)
+		}
+	}
+}
+
+func TestConsumer_RunWithFatalError(t *testing.T) {
+	c := &Consumer{
+		PollingTimeout: 30 * time.Millisecond,
+		ConfigMap: &ConfigMap{
+			"group.id":           "gotest",
+			"socket.timeout.ms":  1000,
+			"session.timeout.ms": 10,
+		},
+	}
+
+	err := c.Subscribe([]string{"gotest1"}, nil)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	fatalErr := NewError(ErrAllBrokersDown, "all brokers down", false)
+	c.reportFatalError(fatalErr)
+
+	err = c.Run(context.Background())
+	if err != fatalErr {
+		t.Errorf("assert Consumer.Run() expect '%v', got '%v'", fatalErr, err)
+	}
+}
+
+func TestConsumer_PartitionContextCancelledOnRevoke(t *testing.T) {
+	c := &Consumer{
+		PollingTimeout: 30 * time.Millisecond,
+		ConfigMap: &ConfigMap{
+			"group.id": "gotest",
+		},
+	}
+	c.init()
+	c.dispatcher = c.createDispatcher()
+	defer c.cancel()
+
+	handle, err := kafka.NewConsumer(c.ConfigMap)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer handle.Close()
+
+	var (
+		topic = "gotest"
+		tp0   = TopicPartition{Topic: &topic, Partition: 0}
+		tp1   = TopicPartition{Topic: &topic, Partition: 1}
+	)
+
+	loop := newConsumeLoop(c.context, c.stopChan, c, handle)
+	ctx0 := loop.consumeContext(tp0)
+	ctx1 := loop.consumeContext(tp1)
+
+	loop.revoke([]TopicPartition{tp0})
+	if ctx0.Context().Err() != context.Canceled {
+		t.Errorf("assert revoked partition context expect '%v', got '%v'", context.Canceled, ctx0.Context().Err())
+	}
+	if ctx1.Context().Err() != nil {
+		t.Errorf("assert assigned partition context expect '%v', got '%v'", nil, ctx1.Context().Err())
+	}
+
+	c.cancel()
+	if ctx1.Context().Err() != context.Canceled {
+		t.Errorf("assert partition context on shutdown expect '%v', got '%v'", context.Canceled, ctx1.Context().Err())
+	}
+}
+
+func TestConsumer_PartitionContextCancelledOnRevokeWithWorkerPool(t *testing.T) {
+	var started = make(chan struct{})
+	c := &Consumer{
+		ConfigMap: &ConfigMap{
+			"group.id": "gotest",
+		},
+		WorkerPool: &WorkerPoolOption{Workers: 1},
+		MessageHandler: func(ctx *ConsumeContext, message *Message) {
+			close(started)
+			// the handler gives up once the partition is revoked
+			<-ctx.Context().Done()
+		},
+	}
+	c.init()
+	c.dispatcher = c.createDispatcher()
+	defer c.cancel()
+	defer c.dispatcher.close()
+
+	handle, err := kafka.NewConsumer(c.ConfigMap)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer handle.Close()
+
+	var (
+		topic = "gotest"
+		tp0   = TopicPartition{Topic: &topic, Partition: 0}
+	)
+
+	loop := newConsumeLoop(c.context, c.stopChan, c, handle)
+	c.dispatcher.dispatch(loop.consumeContext(tp0), &Message{TopicPartition: tp0})
+	<-started
+
+	var revoked = make(chan struct{})
+	go func() {
+		loop.revoke([]TopicPartition{tp0})
+		close(revoked)
+	}()
+	select {
+	case <-revoked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected revoke() to cancel the context of the in-flight handler")
+	}
+}
+
+// errorPollingConsumer polls the error only.
+type errorPollingConsumer struct {
+	ConsumerClient
+	err Error
+}
+
+func (c *errorPollingConsumer) Poll(timeoutMs int) Event {
+	return c.err
+}
+
+func TestConsumer_RunStopsWithConsumeLoops(t *testing.T) {
+	c := &Consumer{
+		PollingTimeout: 30 * time.Millisecond,
+		ConfigMap: &ConfigMap{
+			"group.id": "gotest",
+		},
+		ClientProvider: func(conf *ConfigMap) (ConsumerClient, error) {
+			consumer, err := createConsumerClient(nil, conf)
+			if err != nil {
+				return nil, err
+			}
+			return &errorPollingConsumer{
+				ConsumerClient: consumer,
+				err:            NewError(ErrMaxPollExceeded, "max.poll.interval.ms exceeded", false),
+			}, nil
+		},
+	}
+
+	err := c.Subscribe([]string{"gotest1", "gotest2"}, nil)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// the default ErrorPolicy stops the underlying consumers
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = c.Run(ctx)
+	if err != errConsumeLoopsStopped {
+		t.Errorf("assert Consumer.Run() expect '%v', got '%v'", errConsumeLoopsStopped, err)
+	}
+}
+
+func TestConsumer_WithSharedSubscription(t *testing.T) {
+	var (
+		c   *Consumer
+		err error
+	)
+
+	c = &Consumer{
+		PollingTimeout:     30 * time.Millisecond,
+		SharedSubscription: true,
+		ConfigMap: &ConfigMap{
+			"group.id":           "gotest",
+			"socket.timeout.ms":  1000,
+			"session.timeout.ms": 10,
+		},
+	}
+	err = c.Subscribe([]string{"gotest1", "gotest2", `^gotest\..*`}, nil)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	{
+		var expectedConsumers int = 1
+		if len(c.consumers) != expectedConsumers {
+			t.Errorf("assert Consumer.consumers expect '%v', got '%v'", expectedConsumers, len(c.consumers))
+		}
+	}
+	c.Close()
+}
+
+func TestConsumer_TopicHandlers(t *testing.T) {
+	var handled []string
+
+	c := &Consumer{
+		TopicHandlers: map[string]MessageHandleProc{
+			"orders": func(ctx *ConsumeContext, message *Message) {
+				handled = append(handled, "orders")
+			},
+		},
+		MessageHandler: func(ctx *ConsumeContext, message *Message) {
+			handled = append(handled, "default")
+		},
+	}
+
+	var (
+		orders      = "orders"
+		ordersRetry = "orders.retry.1"
+		payments    = "payments"
+	)
+	for _, message := range []*Message{
+		{TopicPartition: TopicPartition{Topic: &orders}},
+		{
+			TopicPartition: TopicPartition{Topic: &ordersRetry},
+			Headers:        []Header{{Key: RETRY_TOPIC_HEADER_ORIGINAL_TOPIC, Value: []byte(orders)}},
+		},
+		{TopicPartition: TopicPartition{Topic: &payments}},
+	} {
+		c.handleMessage(&ConsumeContext{}, message, true)
+	}
+
+	expected := []string{"orders", "orders", "default"}
+	if !reflect.DeepEqual(handled, expected) {
+		t.Errorf("assert handled expect '%v', got '%v'", expected, handled)
+	}
+}
+
+func TestConsumer_SubscribeDeadLetterPattern(t *testing.T) {
+	c := &Consumer{
+		MessageHandler: func(ctx *ConsumeContext, message *Message) {},
+		DeadLetter:     &DeadLetterOption{},
+		ConfigMap: &ConfigMap{
+			"group.id": "gotest",
+		},
+	}
+
+	err := c.Subscribe([]string{`^orders\..*`}, nil)
+	if err == nil {
+		c.Close()
+		t.Fatal("Expected Subscribe() to fail with the default dead-letter topics")
+	}
+	if c.running || c.disposed {
+		t.Errorf("assert Consumer state expect not running and not disposed, got running '%v', disposed '%v'", c.running, c.disposed)
+	}
+}
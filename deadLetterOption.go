@@ -0,0 +1,101 @@
+package kafka
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+const (
+	DEAD_LETTER_TOPIC_SUFFIX = ".dlq"
+
+	DEAD_LETTER_HEADER_SOURCE_TOPIC     = "x-dlq-source-topic"
+	DEAD_LETTER_HEADER_SOURCE_PARTITION = "x-dlq-source-partition"
+	DEAD_LETTER_HEADER_SOURCE_OFFSET    = "x-dlq-source-offset"
+	DEAD_LETTER_HEADER_ERROR            = "x-dlq-error"
+	DEAD_LETTER_HEADER_ATTEMPTS         = "x-dlq-attempts"
+	DEAD_LETTER_HEADER_TIMESTAMP        = "x-dlq-timestamp"
+)
+
+// DeadLetterOption routes the messages which the MessageProcessor keeps
+// failing on to a dead-letter topic. The Consumer disables
+// enable.auto.offset.store, and stores the offset of a message only after it
+// has been handled or delivered to the dead-letter topic.
+type DeadLetterOption struct {
+	// Topic is the topic which the poison messages are sent to. The messages
+	// are sent to "<source topic>.dlq" if it is empty, which is not allowed
+	// with the regex pattern subscriptions, since the pattern might match
+	// the dead-letter topics as well.
+	Topic    string
+	Producer MessageWriter
+	// RetryBackoff is the duration to wait before resending a message which
+	// cannot be delivered to the dead-letter topic.
+	RetryBackoff time.Duration
+}
+
+func (opt *DeadLetterOption) topicOf(message *Message) string {
+	if len(opt.Topic) > 0 {
+		return opt.Topic
+	}
+	return *OriginalTopicPartition(message).Topic + DEAD_LETTER_TOPIC_SUFFIX
+}
+
+// validateTopics rejects the subscriptions which would consume the dead
+// letters again. A pattern subscription cannot tell the default
+// "<topic>.dlq" topics from the source topics, so it requires the Topic to be
+// specified and not matched by the pattern.
+func (opt *DeadLetterOption) validateTopics(topics []string) error {
+	for _, topic := range topics {
+		if !isTopicPattern(topic) {
+			if topic == opt.Topic {
+				return fmt.Errorf("the dead-letter topic %s is subscribed", topic)
+			}
+			continue
+		}
+
+		if len(opt.Topic) == 0 {
+			return fmt.Errorf("the DeadLetter.Topic is required by the pattern subscription %s", topic)
+		}
+		pattern, err := regexp.Compile(topic)
+		if err != nil {
+			// leave the invalid pattern to librdkafka
+			continue
+		}
+		if pattern.MatchString(opt.Topic) {
+			return fmt.Errorf("the dead-letter topic %s is matched by the pattern subscription %s", opt.Topic, topic)
+		}
+	}
+	return nil
+}
+
+func (opt *DeadLetterOption) createMessage(message *Message, err error, attempts int) *Message {
+	var (
+		topic  = opt.topicOf(message)
+		source = OriginalTopicPartition(message)
+	)
+
+	headers := make([]kafka.Header, 0, len(message.Headers)+6)
+	for _, h := range message.Headers {
+		if !isRetryTopicHeader(h.Key) {
+			headers = append(headers, h)
+		}
+	}
+	headers = append(headers,
+		kafka.Header{Key: DEAD_LETTER_HEADER_SOURCE_TOPIC, Value: []byte(*source.Topic)},
+		kafka.Header{Key: DEAD_LETTER_HEADER_SOURCE_PARTITION, Value: []byte(strconv.Itoa(int(source.Partition)))},
+		kafka.Header{Key: DEAD_LETTER_HEADER_SOURCE_OFFSET, Value: []byte(strconv.FormatInt(int64(source.Offset), 10))},
+		kafka.Header{Key: DEAD_LETTER_HEADER_ERROR, Value: []byte(fmt.Sprintf("%v", err))},
+		kafka.Header{Key: DEAD_LETTER_HEADER_ATTEMPTS, Value: []byte(strconv.Itoa(attempts))},
+		kafka.Header{Key: DEAD_LETTER_HEADER_TIMESTAMP, Value: []byte(time.Now().UTC().Format(time.RFC3339Nano))},
+	)
+
+	return &Message{
+		TopicPartition: TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+		Key:            message.Key,
+		Value:          message.Value,
+		Headers:        headers,
+	}
+}
@@ -0,0 +1,194 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestDeadLetterOption_CreateMessage(t *testing.T) {
+	var (
+		topic = "gotest"
+		opt   = &DeadLetterOption{}
+	)
+
+	message := &Message{
+		TopicPartition: TopicPartition{Topic: &topic, Partition: 3, Offset: 42},
+		Key:            []byte("key"),
+		Value:          []byte("value"),
+		Headers:        []Header{{Key: "trace", Value: []byte("1")}},
+	}
+
+	deadLetter := opt.createMessage(message, fmt.Errorf("poison"), 5)
+	if *deadLetter.TopicPartition.Topic != "gotest.dlq" {
+		t.Errorf("assert dead-letter topic expect '%v', got '%v'", "gotest.dlq", *deadLetter.TopicPartition.Topic)
+	}
+	if deadLetter.TopicPartition.Partition != PartitionAny {
+		t.Errorf("assert dead-letter partition expect '%v', got '%v'", PartitionAny, deadLetter.TopicPartition.Partition)
+	}
+	if string(deadLetter.Key) != "key" || string(deadLetter.Value) != "value" {
+		t.Errorf("assert dead-letter key/value expect '%v'/'%v', got '%s'/'%s'", "key", "value", deadLetter.Key, deadLetter.Value)
+	}
+
+	headers := make(map[string]string)
+	for _, h := range deadLetter.Headers {
+		headers[h.Key] = string(h.Value)
+	}
+	expectedHeaders := map[string]string{
+		"trace":                             "1",
+		DEAD_LETTER_HEADER_SOURCE_TOPIC:     "gotest",
+		DEAD_LETTER_HEADER_SOURCE_PARTITION: "3",
+		DEAD_LETTER_HEADER_SOURCE_OFFSET:    "42",
+		DEAD_LETTER_HEADER_ERROR:            "poison",
+		DEAD_LETTER_HEADER_ATTEMPTS:         "5",
+	}
+	for k, v := range expectedHeaders {
+		if headers[k] != v {
+			t.Errorf("assert header %s expect '%v', got '%v'", k, v, headers[k])
+		}
+	}
+	if _, err := time.Parse(time.RFC3339Nano, headers[DEAD_LETTER_HEADER_TIMESTAMP]); err != nil {
+		t.Errorf("assert header %s expect RFC3339 timestamp, got '%v'", DEAD_LETTER_HEADER_TIMESTAMP, headers[DEAD_LETTER_HEADER_TIMESTAMP])
+	}
+
+	opt.Topic = "poison"
+	deadLetter = opt.createMessage(message, fmt.Errorf("poison"), 5)
+	if *deadLetter.TopicPartition.Topic != "poison" {
+		t.Errorf("assert dead-letter topic expect '%v', got '%v'", "poison", *deadLetter.TopicPartition.Topic)
+	}
+}
+
+func TestConsumer_SendToDeadLetterUntilRevoked(t *testing.T) {
+	p, err := NewProducer(&ProducerOption{
+		FlushTimeout: 100 * time.Millisecond,
+		ConfigMap: &ConfigMap{
+			"socket.timeout.ms":  10,
+			"message.timeout.ms": 10,
+		},
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer p.Close()
+
+	var unhandled int
+
+	c := &Consumer{
+		MessageProcessor: func(ctx *ConsumeContext, message *Message) error {
+			return fmt.Errorf("poison")
+		},
+		UnhandledMessageHandler: func(ctx *ConsumeContext, message *Message) {
+			unhandled++
+		},
+		WorkerPool: &WorkerPoolOption{},
+		DeadLetter: &DeadLetterOption{
+			Producer:     p,
+			RetryBackoff: 10 * time.Millisecond,
+		},
+	}
+
+	// the delivery never succeeds without brokers
+	revoked, revoke := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer revoke()
+
+	topic := "gotest"
+	c.processMessage(&ConsumeContext{context: revoked}, &Message{
+		TopicPartition: TopicPartition{Topic: &topic, Partition: 0},
+	})
+	if revoked.Err() == nil {
+		t.Errorf("assert processMessage() returns after the partition is revoked")
+	}
+	if unhandled != 0 {
+		t.Errorf("assert unhandled messages expect '%v', got '%v'", 0, unhandled)
+	}
+}
+
+func TestConsumer_SendToDeadLetterUntilShutdown(t *testing.T) {
+	p, err := NewProducer(&ProducerOption{
+		FlushTimeout: 100 * time.Millisecond,
+		ConfigMap: &ConfigMap{
+			"socket.timeout.ms":  10,
+			"message.timeout.ms": 10,
+		},
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer p.Close()
+
+	c := &Consumer{
+		MessageProcessor: func(ctx *ConsumeContext, message *Message) error {
+			return fmt.Errorf("poison")
+		},
+		WorkerPool: &WorkerPoolOption{},
+		DeadLetter: &DeadLetterOption{
+			Producer:     p,
+			RetryBackoff: 10 * time.Millisecond,
+		},
+		stopChan: make(chan struct{}),
+	}
+
+	// the Consumer shuts down while the delivery never succeeds without
+	// brokers, and the partition stays assigned until its handler returns
+	time.AfterFunc(200*time.Millisecond, func() {
+		close(c.stopChan)
+	})
+
+	var done = make(chan struct{})
+	go func() {
+		topic := "gotest"
+		c.processMessage(&ConsumeContext{context: context.Background()}, &Message{
+			TopicPartition: TopicPartition{Topic: &topic, Partition: 0},
+		})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected processMessage() to return after the Consumer shuts down")
+	}
+}
+
+func TestConsumer_CreateDeadLetterConfigMap(t *testing.T) {
+	c := &Consumer{
+		ConfigMap: &ConfigMap{
+			"group.id":                 "gotest",
+			"enable.auto.offset.store": true,
+		},
+		DeadLetter: &DeadLetterOption{},
+	}
+
+	conf := c.createConfigMap()
+	if v, _ := conf.Get(KAFKA_CONF_ENABLE_AUTO_OFFSET_STORE, nil); v != false {
+		t.Errorf("assert ConfigMap[%s] expect '%v', got '%v'", KAFKA_CONF_ENABLE_AUTO_OFFSET_STORE, false, v)
+	}
+
+	// the keyDispatcher stores the offsets by itself
+	c.WorkerPool = &WorkerPoolOption{Ordering: OrderByKey}
+	if c.storesOffsets() {
+		t.Errorf("assert Consumer.storesOffsets() expect '%v', got '%v'", false, true)
+	}
+}
+
+func TestDeadLetterOption_ValidateTopics(t *testing.T) {
+	cases := []struct {
+		topic   string
+		topics  []string
+		invalid bool
+	}{
+		{"", []string{"orders", "payments"}, false},
+		{"", []string{"orders.dlq"}, false},
+		{"", []string{`^orders\..*`}, true},
+		{"orders.dlq", []string{`^orders\..*`}, true},
+		{"dead-letters", []string{`^orders\..*`}, false},
+		{"dead-letters", []string{"orders", "dead-letters"}, true},
+	}
+	for _, c := range cases {
+		opt := &DeadLetterOption{Topic: c.topic}
+		err := opt.validateTopics(c.topics)
+		if (err != nil) != c.invalid {
+			t.Errorf("assert validateTopics(%q) with Topic %q expect invalid '%v', got '%v'", c.topics, c.topic, c.invalid, err)
+		}
+	}
+}
@@ -1,9 +1,6 @@
 package kafka
 
 import (
-	"log"
-	"os"
-
 	"github.com/confluentinc/confluent-kafka-go/kafka"
 )
 
@@ -11,13 +8,16 @@ const (
 	KAFKA_CONF_BOOTSTRAP_SERVERS = "bootstrap.servers"
 	KAFKA_CONF_GROUP_ID          = "group.id"
 
-	LOGGER_PREFIX string = "[bcowtech/lib-kafka] "
+	KAFKA_CONF_ENABLE_AUTO_COMMIT       = "enable.auto.commit"
+	KAFKA_CONF_ENABLE_AUTO_OFFSET_STORE = "enable.auto.offset.store"
+	KAFKA_CONF_TRANSACTIONAL_ID         = "transactional.id"
+	KAFKA_CONF_GO_LOGS_CHANNEL_ENABLE   = "go.logs.channel.enable"
+	KAFKA_CONF_GO_LOGS_CHANNEL          = "go.logs.channel"
 
-	PartitionAny = kafka.PartitionAny
-)
+	LOGGER_PREFIX string = "[bcowtech/lib-kafka] "
 
-var (
-	logger *log.Logger = log.New(os.Stdout, LOGGER_PREFIX, log.LstdFlags|log.Lmsgprefix)
+	PartitionAny  = kafka.PartitionAny
+	OffsetInvalid = kafka.OffsetInvalid
 )
 
 type (
@@ -26,13 +26,24 @@ type (
 	Error                 = kafka.Error
 	ErrorCode             = kafka.ErrorCode
 	Event                 = kafka.Event
+	Header                = kafka.Header
 	Message               = kafka.Message
+	Metadata              = kafka.Metadata
 	Offset                = kafka.Offset
 	RebalanceCb           = kafka.RebalanceCb
 	TopicPartition        = kafka.TopicPartition
 
-	MessageHandleProc func(ctx *ConsumeContext, message *Message)
-	ErrorHandleProc   func(err kafka.Error) (disposed bool)
+	MessageHandleProc       func(ctx *ConsumeContext, message *Message)
+	MessageProcessProc      func(ctx *ConsumeContext, message *Message) error
+	BatchHandleProc         func(ctx *BatchContext, messages []*Message)
+	TransformProc           func(ctx *BatchContext, messages []*Message) ([]*Message, error)
+	PanicHandleProc         func(ctx *ConsumeContext, message *Message, err *PanicError) PanicDecision
+	StatsHandleProc         func(stats *Statistics)
+	ErrorHandleProc         func(err kafka.Error) (disposed bool)
+	FatalErrorHandleProc    func(err kafka.Error)
+	DeliveryErrorHandleProc func(message *Message, err error)
+	ConsumerClientProvider  func(conf *ConfigMap) (ConsumerClient, error)
+	ProducerClientProvider  func(conf *ConfigMap) (ProducerClient, error)
 )
 
 type (
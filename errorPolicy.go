@@ -0,0 +1,135 @@
+package kafka
+
+import "github.com/confluentinc/confluent-kafka-go/kafka"
+
+const (
+	// ErrorDecisionIgnore drops the error silently and keeps the event loop running.
+	ErrorDecisionIgnore ErrorDecision = iota
+	// ErrorDecisionRetry reports the error and keeps the event loop running;
+	// librdkafka recovers from transient failures on its own.
+	ErrorDecisionRetry
+	// ErrorDecisionStopConsumer reports the error and stops the event loop
+	// which received it.
+	ErrorDecisionStopConsumer
+	// ErrorDecisionEscalate reports the error to the FatalErrorHandler and
+	// stops the event loop which received it.
+	ErrorDecisionEscalate
+)
+
+var _ ErrorPolicy = ErrorPolicyFunc(nil)
+
+// DefaultErrorPolicy is used by Consumer and Producer when no ErrorPolicy
+// is specified.
+var DefaultErrorPolicy ErrorPolicy = ErrorPolicyFunc(decideDefaultErrorPolicy)
+
+type ErrorDecision int
+
+func (d ErrorDecision) String() string {
+	switch d {
+	case ErrorDecisionIgnore:
+		return "Ignore"
+	case ErrorDecisionRetry:
+		return "Retry"
+	case ErrorDecisionStopConsumer:
+		return "StopConsumer"
+	case ErrorDecisionEscalate:
+		return "Escalate"
+	}
+	return "Unknown"
+}
+
+type ErrorPolicy interface {
+	Decide(err Error) ErrorDecision
+}
+
+type ErrorPolicyFunc func(err Error) ErrorDecision
+
+func (fn ErrorPolicyFunc) Decide(err Error) ErrorDecision {
+	return fn(err)
+}
+
+func decideDefaultErrorPolicy(err Error) ErrorDecision {
+	if err.IsFatal() {
+		return ErrorDecisionEscalate
+	}
+
+	switch err.Code() {
+	case kafka.ErrUnknownTopic, kafka.ErrUnknownTopicOrPart:
+		return ErrorDecisionEscalate
+
+	/* NOTE: https://github.com/edenhill/librdkafka/issues/64
+	Currently the only error codes signaled through the error_cb are:
+	- RD_KAFKA_RESP_ERR__ALL_BROKERS_DOWN - all brokers are down
+	- RD_KAFKA_RESP_ERR__FAIL - generic low level errors (socket failures because of lacking ipv4/ipv6 support)
+	- RD_KAFKA_RESP_ERR__RESOLVE - failure to resolve the broker address
+	- RD_KAFKA_RESP_ERR__CRIT_SYS_RESOURCE - failed to create new thread
+	- RD_KAFKA_RESP_ERR__FS - various file errors in the consumer offset management code
+	- RD_KAFKA_RESP_ERR__TRANSPORT - failed to connect to single broker, or connection error for single broker
+	- RD_KAFKA_RESP_ERR__BAD_MSG - received malformed packet from broker (version mismatch?)
+	I guess you could treat all but .._TRANSPORT as fatal.
+	*/
+	case kafka.ErrTransport:
+		return ErrorDecisionRetry
+
+	case kafka.ErrAllBrokersDown,
+		kafka.ErrFail,
+		kafka.ErrResolve,
+		kafka.ErrCritSysResource,
+		kafka.ErrFs,
+		kafka.ErrBadMsg:
+		return ErrorDecisionEscalate
+	}
+	return ErrorDecisionStopConsumer
+}
+
+// errorPolicyExecutor applies an ErrorPolicy to the errors received by an
+// event loop, and tells the loop whether it should keep running.
+type errorPolicyExecutor struct {
+	policy            ErrorPolicy
+	errorHandler      ErrorHandleProc
+	fatalErrorHandler FatalErrorHandleProc
+	logger            Logger
+}
+
+func (e *errorPolicyExecutor) execute(err Error) ErrorDecision {
+	var policy = e.policy
+	if policy == nil {
+		policy = DefaultErrorPolicy
+	}
+
+	var logger = loggerOrDefault(e.logger)
+
+	decision := policy.Decide(err)
+	switch decision {
+	case ErrorDecisionIgnore:
+		// do nothing
+
+	case ErrorDecisionRetry, ErrorDecisionStopConsumer:
+		if !e.handleError(err) {
+			logger.Error(err.Error(), "code", err.Code(), "decision", decision)
+		}
+
+	case ErrorDecisionEscalate:
+		if e.handleError(err) {
+			// the ErrorHandler has taken over the error
+			return ErrorDecisionRetry
+		}
+		if e.fatalErrorHandler != nil {
+			e.fatalErrorHandler(err)
+		} else {
+			logger.Error(err.Error(), "code", err.Code(), "decision", decision, "fatal", true)
+		}
+
+	default:
+		logger.Error("unknown ErrorDecision", "decision", int(decision), "code", err.Code(), "error", err)
+		return ErrorDecisionStopConsumer
+	}
+	return decision
+}
+
+func (e *errorPolicyExecutor) handleError(err Error) (disposed bool) {
+	if e.errorHandler != nil {
+		return e.errorHandler(err)
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+package kafka
+
+import (
+	"testing"
+)
+
+func TestDefaultErrorPolicy(t *testing.T) {
+	cases := []struct {
+		code     ErrorCode
+		expected ErrorDecision
+	}{
+		{ErrUnknownTopic, ErrorDecisionEscalate},
+		{ErrUnknownTopicOrPart, ErrorDecisionEscalate},
+		{ErrTransport, ErrorDecisionRetry},
+		{ErrAllBrokersDown, ErrorDecisionEscalate},
+		{ErrFail, ErrorDecisionEscalate},
+		{ErrResolve, ErrorDecisionEscalate},
+		{ErrCritSysResource, ErrorDecisionEscalate},
+		{ErrFs, ErrorDecisionEscalate},
+		{ErrBadMsg, ErrorDecisionEscalate},
+		{ErrMsgTimedOut, ErrorDecisionStopConsumer},
+	}
+
+	for _, c := range cases {
+		err := NewError(c.code, c.code.String(), false)
+		decision := DefaultErrorPolicy.Decide(err)
+		if decision != c.expected {
+			t.Errorf("assert DefaultErrorPolicy.Decide(%v) expect '%v', got '%v'", c.code, c.expected, decision)
+		}
+	}
+
+	{
+		err := NewError(ErrTransport, "fatal transport", true)
+		decision := DefaultErrorPolicy.Decide(err)
+		if decision != ErrorDecisionEscalate {
+			t.Errorf("assert DefaultErrorPolicy.Decide() of fatal error expect '%v', got '%v'", ErrorDecisionEscalate, decision)
+		}
+	}
+}
+
+func TestConsumer_ProcessKafkaErrorWithoutExit(t *testing.T) {
+	var escalated []Error
+
+	c := &Consumer{
+		FatalErrorHandler: func(err Error) {
+			escalated = append(escalated, err)
+		},
+	}
+
+	for _, code := range []ErrorCode{
+		ErrAllBrokersDown,
+		ErrFail,
+		ErrResolve,
+		ErrCritSysResource,
+		ErrFs,
+		ErrBadMsg,
+	} {
+		decision := c.processKafkaError(NewError(code, code.String(), false))
+		if decision != ErrorDecisionEscalate {
+			t.Errorf("assert Consumer.processKafkaError(%v) expect '%v', got '%v'", code, ErrorDecisionEscalate, decision)
+		}
+	}
+	if len(escalated) != 6 {
+		t.Errorf("assert FatalErrorHandler calls expect '%v', got '%v'", 6, len(escalated))
+	}
+}
+
+func TestConsumer_ProcessKafkaErrorWithErrorHandler(t *testing.T) {
+	var (
+		handled   int
+		escalated int
+	)
+
+	c := &Consumer{
+		ErrorHandler: func(err Error) (disposed bool) {
+			handled++
+			return err.Code() == ErrUnknownTopic
+		},
+		FatalErrorHandler: func(err Error) {
+			escalated++
+		},
+	}
+
+	// the ErrorHandler takes over the error
+	decision := c.processKafkaError(NewError(ErrUnknownTopic, "unknown topic", false))
+	if decision != ErrorDecisionRetry {
+		t.Errorf("assert Consumer.processKafkaError() expect '%v', got '%v'", ErrorDecisionRetry, decision)
+	}
+	// the ErrorHandler ignores the error
+	decision = c.processKafkaError(NewError(ErrUnknownTopicOrPart, "unknown topic or partition", false))
+	if decision != ErrorDecisionEscalate {
+		t.Errorf("assert Consumer.processKafkaError() expect '%v', got '%v'", ErrorDecisionEscalate, decision)
+	}
+	if handled != 2 {
+		t.Errorf("assert ErrorHandler calls expect '%v', got '%v'", 2, handled)
+	}
+	if escalated != 1 {
+		t.Errorf("assert FatalErrorHandler calls expect '%v', got '%v'", 1, escalated)
+	}
+}
+
+func TestProducer_ProcessKafkaErrorWithErrorPolicy(t *testing.T) {
+	var escalated int
+
+	p := &Producer{
+		errorPolicyExecutor: &errorPolicyExecutor{
+			policy: ErrorPolicyFunc(func(err Error) ErrorDecision {
+				if err.Code() == ErrAllBrokersDown {
+					return ErrorDecisionIgnore
+				}
+				return ErrorDecisionEscalate
+			}),
+			fatalErrorHandler: func(err Error) {
+				escalated++
+			},
+		},
+	}
+
+	decision := p.handleError(NewError(ErrAllBrokersDown, "all brokers down", false))
+	if decision != ErrorDecisionIgnore {
+		t.Errorf("assert Producer.handleError() expect '%v', got '%v'", ErrorDecisionIgnore, decision)
+	}
+	decision = p.handleError(NewError(ErrTransport, "transport", false))
+	if decision != ErrorDecisionEscalate {
+		t.Errorf("assert Producer.handleError() expect '%v', got '%v'", ErrorDecisionEscalate, decision)
+	}
+	if escalated != 1 {
+		t.Errorf("assert FatalErrorHandler calls expect '%v', got '%v'", 1, escalated)
+	}
+}
@@ -5,11 +5,11 @@ type ForwarderRunner struct {
 }
 
 func (r *ForwarderRunner) Start() {
-	logger.Println("Started")
+	r.handle.logger().Info("Started")
 }
 
 func (r *ForwarderRunner) Stop() {
-	logger.Println("Stopping")
+	r.handle.logger().Info("Stopping")
 	r.handle.Close()
-	logger.Println("Stopped")
+	r.handle.logger().Info("Stopped")
 }
@@ -2,4 +2,11 @@ module github.com/bcowtech/lib-kafka
 
 go 1.14
 
-require github.com/confluentinc/confluent-kafka-go v1.5.2
+require (
+	github.com/confluentinc/confluent-kafka-go v1.5.2
+	github.com/prometheus/client_golang v1.11.1
+	github.com/prometheus/common v0.26.0
+	go.opentelemetry.io/otel v1.0.1
+	go.opentelemetry.io/otel/sdk v1.0.1
+	go.opentelemetry.io/otel/trace v1.0.1
+)
@@ -0,0 +1,294 @@
+package kafka
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+const (
+	DEFAULT_HEALTH_CHECK_TIMEOUT = 10 * time.Second
+
+	KAFKA_CONF_SECURITY_PROTOCOL                     = "security.protocol"
+	KAFKA_CONF_SSL_CA_LOCATION                       = "ssl.ca.location"
+	KAFKA_CONF_SSL_CERTIFICATE_LOCATION              = "ssl.certificate.location"
+	KAFKA_CONF_SSL_KEY_LOCATION                      = "ssl.key.location"
+	KAFKA_CONF_ENABLE_SSL_CERTIFICATE_VERIFICATION   = "enable.ssl.certificate.verification"
+	KAFKA_CONF_SSL_ENDPOINT_IDENTIFICATION_ALGORITHM = "ssl.endpoint.identification.algorithm"
+)
+
+// HealthReport is the result of a health check.
+type HealthReport struct {
+	// Brokers are the brokers advertised by the cluster metadata, and
+	// whether their advertised listeners can be connected.
+	Brokers []BrokerHealth
+	// Topics are the topics checked for existence.
+	Topics []TopicHealth
+}
+
+// Err returns the error of the first missing topic, or an error if none
+// of the brokers is reachable. The unreachable brokers are reported
+// without failing the check as long as another broker is reachable.
+func (r *HealthReport) Err() error {
+	for _, t := range r.Topics {
+		if t.Err != nil {
+			return t.Err
+		}
+	}
+
+	if len(r.Brokers) == 0 {
+		return nil
+	}
+	var errs []string
+	for _, b := range r.Brokers {
+		if b.Reachable {
+			return nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", b.Address(), b.Err))
+	}
+	return fmt.Errorf("none of the brokers is reachable: %s", strings.Join(errs, "; "))
+}
+
+type BrokerHealth struct {
+	ID        int32
+	Host      string
+	Port      int
+	Reachable bool
+	Err       error
+}
+
+func (b BrokerHealth) Address() string {
+	return net.JoinHostPort(b.Host, strconv.Itoa(b.Port))
+}
+
+type TopicHealth struct {
+	Topic      string
+	Partitions int
+	Err        error
+}
+
+type metadataClient interface {
+	GetMetadata(topic *string, allTopics bool, timeoutMs int) (*Metadata, error)
+}
+
+// checkHealth requests the cluster metadata through the client, which
+// connects and authenticates with the security settings of the ConfigMap,
+// verifies the topics exist, and then connects to every advertised broker.
+// The connection is a TLS handshake if the security.protocol is ssl or
+// sasl_ssl; the SASL authentication is verified by the metadata request.
+// The regex topic patterns are not verified.
+func checkHealth(ctx context.Context, client metadataClient, conf *ConfigMap, topics []string) (*HealthReport, error) {
+	var timeout = DEFAULT_HEALTH_CHECK_TIMEOUT
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if timeout < time.Millisecond {
+		return nil, context.DeadlineExceeded
+	}
+
+	// request all topics, since the metadata request of a single topic
+	// creates it on the brokers with auto.create.topics.enable
+	metadata, err := client.GetMetadata(nil, true, int(timeout/time.Millisecond))
+	if err != nil {
+		return nil, err
+	}
+
+	var report = &HealthReport{}
+	for _, topic := range topics {
+		if isTopicPattern(topic) {
+			continue
+		}
+
+		health := TopicHealth{Topic: topic}
+		if t, ok := metadata.Topics[topic]; !ok {
+			health.Err = kafka.NewError(kafka.ErrUnknownTopicOrPart, fmt.Sprintf("topic %s does not exist", topic), false)
+		} else if t.Error.Code() != kafka.ErrNoError {
+			health.Err = t.Error
+		} else {
+			health.Partitions = len(t.Partitions)
+		}
+		report.Topics = append(report.Topics, health)
+	}
+
+	tlsConfig, err := createTLSConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	report.Brokers = make([]BrokerHealth, len(metadata.Brokers))
+	var wg sync.WaitGroup
+	for i, b := range metadata.Brokers {
+		report.Brokers[i] = BrokerHealth{
+			ID:   b.ID,
+			Host: b.Host,
+			Port: b.Port,
+		}
+
+		wg.Add(1)
+		go func(health *BrokerHealth) {
+			defer wg.Done()
+
+			health.Err = dialBroker(ctx, health.Address(), timeout, tlsConfig)
+			health.Reachable = health.Err == nil
+		}(&report.Brokers[i])
+	}
+	wg.Wait()
+
+	return report, report.Err()
+}
+
+// startupHealthCheck runs the health check on creating the Consumer or the
+// Producer. It is skipped without bootstrap.servers, e.g. in the dry tests
+// or with the fakes of a ClientProvider.
+func startupHealthCheck(client metadataClient, conf *ConfigMap, topics []string, timeout time.Duration) error {
+	if len(configStringOf(conf, KAFKA_CONF_BOOTSTRAP_SERVERS)) == 0 {
+		return nil
+	}
+	if timeout <= 0 {
+		timeout = DEFAULT_HEALTH_CHECK_TIMEOUT
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	_, err := checkHealth(ctx, client, conf, topics)
+	return err
+}
+
+func dialBroker(ctx context.Context, address string, timeout time.Duration, tlsConfig *tls.Config) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if tlsConfig == nil {
+		return nil
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	config := tlsConfig.Clone()
+	if host, _, err := net.SplitHostPort(address); err == nil && !config.InsecureSkipVerify {
+		config.ServerName = host
+	}
+	return tls.Client(conn, config).Handshake()
+}
+
+// createTLSConfig returns the tls.Config equivalent to the ssl settings of
+// librdkafka, or nil if the security.protocol does not use SSL.
+func createTLSConfig(conf *ConfigMap) (*tls.Config, error) {
+	switch strings.ToLower(configStringOf(conf, KAFKA_CONF_SECURITY_PROTOCOL)) {
+	case "ssl", "sasl_ssl":
+	default:
+		return nil, nil
+	}
+
+	var config = &tls.Config{}
+
+	if location := configStringOf(conf, KAFKA_CONF_SSL_CA_LOCATION); len(location) > 0 {
+		if info, err := os.Stat(location); err == nil && !info.IsDir() {
+			pem, err := ioutil.ReadFile(location)
+			if err != nil {
+				return nil, err
+			}
+			config.RootCAs = x509.NewCertPool()
+			if !config.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("cannot parse certificates of %s", location)
+			}
+		}
+	}
+
+	var (
+		certificate = configStringOf(conf, KAFKA_CONF_SSL_CERTIFICATE_LOCATION)
+		key         = configStringOf(conf, KAFKA_CONF_SSL_KEY_LOCATION)
+	)
+	if len(certificate) > 0 && len(key) > 0 {
+		pair, err := tls.LoadX509KeyPair(certificate, key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+
+	if !configBoolOf(conf, KAFKA_CONF_ENABLE_SSL_CERTIFICATE_VERIFICATION, true) {
+		config.InsecureSkipVerify = true
+		return config, nil
+	}
+	if !strings.EqualFold(configStringOf(conf, KAFKA_CONF_SSL_ENDPOINT_IDENTIFICATION_ALGORITHM), "https") {
+		// librdkafka verifies the certificate chain without the hostname
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = verifyCertificateChain(config.RootCAs)
+	}
+	return config, nil
+}
+
+func verifyCertificateChain(roots *x509.CertPool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("no certificate presented by the broker")
+		}
+
+		var certs = make([]*x509.Certificate, 0, len(rawCerts))
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			certs = append(certs, cert)
+		}
+
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := certs[0].Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+		})
+		return err
+	}
+}
+
+func configStringOf(conf *ConfigMap, key string) string {
+	if conf == nil {
+		return ""
+	}
+	if s, ok := (*conf)[key].(string); ok {
+		return s
+	}
+	return ""
+}
+
+func configBoolOf(conf *ConfigMap, key string, defval bool) bool {
+	if conf == nil {
+		return defval
+	}
+	switch b := (*conf)[key].(type) {
+	case bool:
+		return b
+	case string:
+		if parsed, err := strconv.ParseBool(b); err == nil {
+			return parsed
+		}
+	}
+	return defval
+}
@@ -0,0 +1,111 @@
+package kafka
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+type fakeMetadataClient struct {
+	metadata *Metadata
+}
+
+func (c *fakeMetadataClient) GetMetadata(topic *string, allTopics bool, timeoutMs int) (*Metadata, error) {
+	return c.metadata, nil
+}
+
+func TestCheckHealth(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer listener.Close()
+	reachable := listener.Addr().(*net.TCPAddr)
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	unreachable := closed.Addr().(*net.TCPAddr)
+	closed.Close()
+
+	client := &fakeMetadataClient{
+		metadata: &Metadata{
+			Brokers: []kafka.BrokerMetadata{
+				{ID: 1, Host: "127.0.0.1", Port: reachable.Port},
+				{ID: 2, Host: "127.0.0.1", Port: unreachable.Port},
+			},
+			Topics: map[string]kafka.TopicMetadata{
+				"gotest": {Topic: "gotest", Partitions: []kafka.PartitionMetadata{{ID: 0}, {ID: 1}}},
+			},
+		},
+	}
+
+	report, err := checkHealth(context.Background(), client, &ConfigMap{}, []string{"gotest", "^gotest.*"})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(report.Brokers) != 2 || !report.Brokers[0].Reachable || report.Brokers[1].Reachable {
+		t.Errorf("assert HealthReport.Brokers expect reachable broker 1 only, got '%+v'", report.Brokers)
+	}
+	if len(report.Topics) != 1 || report.Topics[0].Partitions != 2 {
+		t.Errorf("assert HealthReport.Topics expect '%v' with 2 partitions, got '%+v'", "gotest", report.Topics)
+	}
+
+	// the missing topic
+	_, err = checkHealth(context.Background(), client, &ConfigMap{}, []string{"unknown"})
+	if e, ok := err.(kafka.Error); !ok || e.Code() != kafka.ErrUnknownTopicOrPart {
+		t.Errorf("assert checkHealth() expect '%v', got '%v'", kafka.ErrUnknownTopicOrPart, err)
+	}
+
+	// none of the brokers is reachable
+	client.metadata.Brokers = client.metadata.Brokers[1:]
+	report, err = checkHealth(context.Background(), client, &ConfigMap{}, nil)
+	if err == nil {
+		t.Error("Expected checkHealth() to fail without reachable brokers")
+	}
+	if report == nil || len(report.Brokers) != 1 || report.Brokers[0].Err == nil {
+		t.Errorf("assert HealthReport.Brokers expect the unreachable broker, got '%+v'", report)
+	}
+}
+
+func TestCreateTLSConfig(t *testing.T) {
+	config, err := createTLSConfig(&ConfigMap{})
+	if err != nil || config != nil {
+		t.Errorf("assert createTLSConfig() of plaintext expect '%v', got '%v', '%v'", nil, config, err)
+	}
+
+	config, err = createTLSConfig(&ConfigMap{
+		"security.protocol":                   "SASL_SSL",
+		"enable.ssl.certificate.verification": "false",
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if config == nil || !config.InsecureSkipVerify || config.VerifyPeerCertificate != nil {
+		t.Errorf("assert createTLSConfig() expect the verification disabled, got '%+v'", config)
+	}
+
+	config, err = createTLSConfig(&ConfigMap{
+		"security.protocol": "ssl",
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if config == nil || config.VerifyPeerCertificate == nil {
+		t.Errorf("assert createTLSConfig() expect the certificate chain verified, got '%+v'", config)
+	}
+
+	config, err = createTLSConfig(&ConfigMap{
+		"security.protocol":                     "ssl",
+		"ssl.endpoint.identification.algorithm": "https",
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if config == nil || config.InsecureSkipVerify {
+		t.Errorf("assert createTLSConfig() expect the hostname verified, got '%+v'", config)
+	}
+}
@@ -2,39 +2,77 @@ package test
 
 import (
 	"context"
-	"os"
+	"sync"
 	"testing"
 	"time"
 
 	kafka "github.com/bcowtech/lib-kafka"
+	"github.com/bcowtech/lib-kafka/kafkatest"
 )
 
+var words = []string{"Welcome", "to", "the", "Confluent", "Kafka", "Golang", "client"}
+
 func TestConsumer(t *testing.T) {
+	cluster := kafkatest.NewMockCluster(t, 3)
+	err := cluster.CreateTopic("myTopic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := kafka.NewProducer(&kafka.ProducerOption{
+		FlushTimeout: 3 * time.Second,
+		ConfigMap:    cluster.ConfigMap(nil),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
 
+	topic := "myTopic"
+	for _, word := range words {
+		p.WriteMessage(&kafka.Message{
+			TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+			Value:          []byte(word),
+		}, nil)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var (
+		mutex    sync.Mutex
+		received = make(map[string]bool)
+	)
 	c := &kafka.Consumer{
 		PollingTimeout: 30 * time.Millisecond,
 		MessageHandler: func(ctx *kafka.ConsumeContext, message *kafka.Message) {
 			t.Logf("Message on %s: %s: %s\n", message.TopicPartition, string(message.Key), string(message.Value))
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			received[string(message.Value)] = true
+			if len(received) == len(words) {
+				cancel()
+			}
 		},
-		ConfigMap: &kafka.ConfigMap{
-			"bootstrap.servers": os.Getenv("KAFKA_BOOTSTRAP_SERVERS"),
+		ConfigMap: cluster.ConfigMap(kafka.ConfigMap{
 			"group.id":          "gotest",
 			"auto.offset.reset": "earliest",
-		},
+		}),
 	}
 
-	ctx, _ := context.WithTimeout(context.Background(), 15*time.Second)
-
-	err := c.Subscribe([]string{"myTopic"}, nil)
+	err = c.Subscribe([]string{"myTopic"}, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 	t.Logf("Consumer %+v", c)
 
-	select {
-	case <-ctx.Done():
-		t.Logf("Consumer stopping")
-		c.Close()
-		return
+	err = c.Run(ctx)
+	if err != context.Canceled {
+		t.Fatalf("assert Consumer.Run() expect '%v', got '%v'", context.Canceled, err)
+	}
+	if len(received) != len(words) {
+		t.Errorf("assert received messages expect '%v', got '%v'", len(words), len(received))
 	}
+	t.Logf("Consumer stopped")
 }
@@ -1,33 +1,48 @@
 package test
 
 import (
-	"os"
 	"testing"
 	"time"
 
 	kafka "github.com/bcowtech/lib-kafka"
+	"github.com/bcowtech/lib-kafka/kafkatest"
 )
 
 func TestForwarder(t *testing.T) {
+	cluster := kafkatest.NewMockCluster(t, 3)
+	err := cluster.CreateTopic("myTopic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	p, err := kafka.NewForwarder(&kafka.ForwarderOption{
 		FlushTimeout: 3 * time.Second,
 		PingTimeout:  3 * time.Second,
-		ConfigMap: &kafka.ConfigMap{
-			"client.id":         "gotest",
-			"bootstrap.servers": os.Getenv("KAFKA_BOOTSTRAP_SERVERS"),
-		},
+		ConfigMap: cluster.ConfigMap(kafka.ConfigMap{
+			"client.id": "gotest",
+		}),
 	})
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	topic := "myTopic"
-	for _, word := range []string{"Welcome", "to", "the", "Confluent", "Kafka", "Golang", "client"} {
-		p.WriteMessage(&kafka.Message{
+	deliveryChan := make(chan kafka.Event, len(words))
+	for _, word := range words {
+		err = p.WriteMessage(&kafka.Message{
 			TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
 			Key:            []byte("forwarder"),
 			Value:          []byte(word),
-		}, nil)
+		}, deliveryChan)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for range words {
+		m := (<-deliveryChan).(*kafka.Message)
+		if m.TopicPartition.Error != nil {
+			t.Errorf("Delivery failed: %v", m.TopicPartition)
+		}
 	}
 	p.Close()
 }
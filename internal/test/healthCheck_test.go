@@ -0,0 +1,81 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	kafka "github.com/bcowtech/lib-kafka"
+	"github.com/bcowtech/lib-kafka/kafkatest"
+)
+
+func TestHealthCheck(t *testing.T) {
+	cluster := kafkatest.NewMockCluster(t, 3)
+	err := cluster.CreateTopic("myTopic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := kafka.NewProducer(&kafka.ProducerOption{
+		PingTimeout: 3 * time.Second,
+		ConfigMap:   cluster.ConfigMap(nil),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	report, err := p.HealthCheck(ctx, "myTopic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Brokers) != 3 {
+		t.Errorf("assert HealthReport.Brokers expect '%v', got '%v'", 3, len(report.Brokers))
+	}
+	for _, b := range report.Brokers {
+		if !b.Reachable {
+			t.Errorf("Broker %d is unreachable: %v", b.ID, b.Err)
+		}
+	}
+	if len(report.Topics) != 1 || report.Topics[0].Partitions == 0 {
+		t.Errorf("assert HealthReport.Topics expect '%v', got '%+v'", "myTopic", report.Topics)
+	}
+
+	_, err = p.HealthCheck(ctx, "unknownTopic")
+	if err == nil {
+		t.Error("Expected HealthCheck() of unknown topic to fail")
+	}
+
+	// the startup gate of the Consumer
+	c := &kafka.Consumer{
+		PingTimeout: 3 * time.Second,
+		ConfigMap: cluster.ConfigMap(kafka.ConfigMap{
+			"group.id": "gotest",
+		}),
+	}
+	err = c.Subscribe([]string{"unknownTopic"}, nil)
+	if err == nil {
+		c.Close()
+		t.Error("Expected Consumer.Subscribe() of unknown topic to fail")
+	}
+
+	c = &kafka.Consumer{
+		PingTimeout: 3 * time.Second,
+		ConfigMap: cluster.ConfigMap(kafka.ConfigMap{
+			"group.id": "gotest",
+		}),
+	}
+	err = c.Subscribe([]string{"myTopic"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	_, err = c.HealthCheck(ctx)
+	if err != nil {
+		t.Errorf("assert Consumer.HealthCheck() expect '%v', got '%v'", nil, err)
+	}
+}
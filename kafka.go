@@ -5,3 +5,18 @@ import "github.com/confluentinc/confluent-kafka-go/kafka"
 func LibraryVersion() (int, string) {
 	return kafka.LibraryVersion()
 }
+
+func copyConfigMap(source *ConfigMap) *ConfigMap {
+	if source == nil {
+		return &ConfigMap{}
+	}
+	var conf = make(ConfigMap, len(*source))
+	for k, v := range *source {
+		conf[k] = v
+	}
+	return &conf
+}
+
+func NewError(code ErrorCode, str string, fatal bool) Error {
+	return kafka.NewError(code, str, fatal)
+}
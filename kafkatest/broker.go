@@ -0,0 +1,459 @@
+package kafkatest
+
+import (
+	"fmt"
+	"hash/crc32"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	kafka "github.com/bcowtech/lib-kafka"
+	confluent "github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+const (
+	DEFAULT_TOPIC_PARTITIONS = 1
+)
+
+// Broker is an in-memory broker for unit tests. It keeps the messages of
+// the topics, the consumer groups and their committed offsets in memory, and
+// creates the ConsumerClient and ProducerClient which work against it:
+//
+//	broker := kafkatest.NewBroker()
+//	broker.CreateTopic("myTopic", 2)
+//
+//	consumer := &kafka.Consumer{
+//		ClientProvider: broker.NewConsumer,
+//		...
+//	}
+//	producer, err := kafka.NewProducer(&kafka.ProducerOption{
+//		ClientProvider: broker.NewProducer,
+//		...
+//	})
+//
+// The consumer groups assign the partitions with the range strategy, and
+// rebalance eagerly whenever a member joins or leaves, or a topic is
+// created. The messages written in a transaction are visible to the
+// consumers with the isolation.level read_committed, the default, once the
+// transaction commits.
+type Broker struct {
+	// AutoCreateTopics creates the unknown topics with
+	// DEFAULT_TOPIC_PARTITIONS partitions when the messages are written to
+	// them. Otherwise the deliveries fail with ErrUnknownTopicOrPart.
+	AutoCreateTopics bool
+
+	topics    map[string]*topic
+	groups    map[string]*group
+	metadata  map[*kafka.ConsumerGroupMetadata]string
+	producers map[string]*Producer
+	notify    chan struct{}
+	mutex     sync.Mutex
+}
+
+func NewBroker() *Broker {
+	return &Broker{
+		topics:    make(map[string]*topic),
+		groups:    make(map[string]*group),
+		metadata:  make(map[*kafka.ConsumerGroupMetadata]string),
+		producers: make(map[string]*Producer),
+		notify:    make(chan struct{}),
+	}
+}
+
+// CreateTopic creates the topic with the number of partitions, and
+// rebalances the consumer groups subscribing it.
+func (b *Broker) CreateTopic(name string, partitions int) error {
+	if partitions <= 0 {
+		return kafka.NewError(confluent.ErrInvalidPartitions, fmt.Sprintf("invalid number of partitions %d", partitions), false)
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, ok := b.topics[name]; ok {
+		return kafka.NewError(confluent.ErrTopicAlreadyExists, fmt.Sprintf("topic %s already exists", name), false)
+	}
+	b.createTopic(name, partitions)
+	return nil
+}
+
+// Topics returns the names of the topics in order.
+func (b *Broker) Topics() []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.topicNames()
+}
+
+// Produce writes the message synchronously, and returns its TopicPartition
+// with the assigned partition and offset.
+func (b *Broker) Produce(message *kafka.Message) (kafka.TopicPartition, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.append(message, nil)
+}
+
+// Messages returns the visible messages of the topic, ordered by partition
+// and offset. The messages of the pending and aborted transactions are
+// excluded.
+func (b *Broker) Messages(topic string) []*kafka.Message {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	t, ok := b.topics[topic]
+	if !ok {
+		return nil
+	}
+
+	var messages []*kafka.Message
+	for _, p := range t.partitions {
+		for _, e := range p.entries {
+			if e.isVisible() {
+				messages = append(messages, copyMessage(e.message))
+			}
+		}
+	}
+	return messages
+}
+
+// CommittedOffset returns the offset committed by the consumer group, or
+// OffsetInvalid if there is none.
+func (b *Broker) CommittedOffset(groupID string, topic string, partition int32) kafka.Offset {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	g, ok := b.groups[groupID]
+	if !ok {
+		return kafka.OffsetInvalid
+	}
+	offset, ok := g.committed[partitionKey{topic, partition}]
+	if !ok {
+		return kafka.OffsetInvalid
+	}
+	return offset
+}
+
+// Members returns the number of the members of the consumer group.
+func (b *Broker) Members(groupID string) int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	g, ok := b.groups[groupID]
+	if !ok {
+		return 0
+	}
+	return len(g.members)
+}
+
+// getMetadata returns the metadata of the topics. It lists no brokers,
+// since the Broker has no network listener.
+func (b *Broker) getMetadata(topic *string, allTopics bool) (*kafka.Metadata, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	var names []string
+	if topic != nil {
+		if _, ok := b.topics[*topic]; !ok && b.AutoCreateTopics {
+			b.createTopic(*topic, DEFAULT_TOPIC_PARTITIONS)
+		}
+		names = []string{*topic}
+	} else if allTopics {
+		names = b.topicNames()
+	}
+
+	var metadata = &kafka.Metadata{
+		Topics: make(map[string]confluent.TopicMetadata, len(names)),
+	}
+	for _, name := range names {
+		t, ok := b.topics[name]
+		if !ok {
+			metadata.Topics[name] = confluent.TopicMetadata{
+				Topic: name,
+				Error: kafka.NewError(confluent.ErrUnknownTopicOrPart, "Broker: Unknown topic or partition", false),
+			}
+			continue
+		}
+
+		var partitions = make([]confluent.PartitionMetadata, len(t.partitions))
+		for i := range t.partitions {
+			partitions[i] = confluent.PartitionMetadata{ID: int32(i)}
+		}
+		metadata.Topics[name] = confluent.TopicMetadata{
+			Topic:      name,
+			Partitions: partitions,
+		}
+	}
+	return metadata, nil
+}
+
+func (b *Broker) createTopic(name string, partitions int) *topic {
+	t := &topic{
+		name:       name,
+		partitions: make([]*partition, partitions),
+	}
+	for i := range t.partitions {
+		t.partitions[i] = &partition{}
+	}
+	b.topics[name] = t
+
+	for _, g := range b.groups {
+		g.rebalance(b)
+	}
+	b.broadcast()
+	return t
+}
+
+func (b *Broker) topicNames() []string {
+	var names = make([]string, 0, len(b.topics))
+	for name := range b.topics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (b *Broker) groupOf(groupID string) *group {
+	g, ok := b.groups[groupID]
+	if !ok {
+		g = &group{
+			id:        groupID,
+			committed: make(map[partitionKey]kafka.Offset),
+		}
+		b.groups[groupID] = g
+	}
+	return g
+}
+
+func (b *Broker) append(message *kafka.Message, txn *transaction) (kafka.TopicPartition, error) {
+	var tp = message.TopicPartition
+	if tp.Topic == nil {
+		return tp, kafka.NewError(confluent.ErrUnknownTopicOrPart, "no topic specified", false)
+	}
+
+	t, ok := b.topics[*tp.Topic]
+	if !ok {
+		if !b.AutoCreateTopics {
+			return tp, kafka.NewError(confluent.ErrUnknownTopicOrPart, fmt.Sprintf("unknown topic %s", *tp.Topic), false)
+		}
+		t = b.createTopic(*tp.Topic, DEFAULT_TOPIC_PARTITIONS)
+	}
+
+	if tp.Partition == kafka.PartitionAny {
+		tp.Partition = t.partitionOf(message.Key)
+	}
+	if tp.Partition < 0 || int(tp.Partition) >= len(t.partitions) {
+		return tp, kafka.NewError(confluent.ErrUnknownPartition, fmt.Sprintf("unknown partition %d of topic %s", tp.Partition, t.name), false)
+	}
+
+	p := t.partitions[tp.Partition]
+	tp.Offset = kafka.Offset(len(p.entries))
+
+	stored := copyMessage(message)
+	stored.TopicPartition = tp
+	stored.Opaque = nil
+	if stored.Timestamp.IsZero() {
+		stored.Timestamp = time.Now()
+		stored.TimestampType = confluent.TimestampCreateTime
+	}
+	p.entries = append(p.entries, &entry{
+		message: stored,
+		txn:     txn,
+	})
+
+	b.broadcast()
+	return tp, nil
+}
+
+func (b *Broker) commitTransaction(txn *transaction) {
+	txn.state = transactionCommitted
+	for groupID, offsets := range txn.offsets {
+		g := b.groupOf(groupID)
+		for _, tp := range offsets {
+			g.commit(tp)
+		}
+	}
+	b.broadcast()
+}
+
+func (b *Broker) abortTransaction(txn *transaction) {
+	txn.state = transactionAborted
+	b.broadcast()
+}
+
+// broadcast wakes up the consumers waiting in Poll.
+func (b *Broker) broadcast() {
+	close(b.notify)
+	b.notify = make(chan struct{})
+}
+
+type partitionKey struct {
+	topic     string
+	partition int32
+}
+
+type topic struct {
+	name       string
+	partitions []*partition
+	next       int32
+}
+
+// partitionOf returns the partition of the key by its CRC32 like the
+// consistent_random partitioner of librdkafka, or the next partition in
+// turn if the key is nil.
+func (t *topic) partitionOf(key []byte) int32 {
+	var n = int32(len(t.partitions))
+	if key == nil {
+		p := t.next % n
+		t.next++
+		return p
+	}
+	return int32(crc32.ChecksumIEEE(key) % uint32(n))
+}
+
+type partition struct {
+	entries []*entry
+}
+
+type entry struct {
+	message *kafka.Message
+	txn     *transaction
+}
+
+func (e *entry) isVisible() bool {
+	return e.txn == nil || e.txn.state == transactionCommitted
+}
+
+type transactionState int
+
+const (
+	transactionPending transactionState = iota
+	transactionCommitted
+	transactionAborted
+)
+
+type transaction struct {
+	state   transactionState
+	offsets map[string][]kafka.TopicPartition
+}
+
+type group struct {
+	id        string
+	members   []*Consumer
+	committed map[partitionKey]kafka.Offset
+}
+
+func (g *group) commit(tp kafka.TopicPartition) {
+	if tp.Topic == nil || tp.Offset < 0 {
+		return
+	}
+	g.committed[partitionKey{*tp.Topic, tp.Partition}] = tp.Offset
+}
+
+func (g *group) join(b *Broker, member *Consumer) {
+	for _, m := range g.members {
+		if m == member {
+			g.rebalance(b)
+			return
+		}
+	}
+	g.members = append(g.members, member)
+	g.rebalance(b)
+}
+
+func (g *group) leave(b *Broker, member *Consumer) {
+	for i, m := range g.members {
+		if m == member {
+			g.members = append(g.members[:i:i], g.members[i+1:]...)
+			break
+		}
+	}
+	g.rebalance(b)
+}
+
+// rebalance assigns the partitions of every subscribed topic to the
+// members subscribing it with the range strategy, and queues the revocation
+// and the assignment events of the members whose assignment changes.
+func (g *group) rebalance(b *Broker) {
+	var assignments = make(map[*Consumer][]kafka.TopicPartition, len(g.members))
+
+	for _, name := range b.topicNames() {
+		var members []*Consumer
+		for _, m := range g.members {
+			if m.subscribes(name) {
+				members = append(members, m)
+			}
+		}
+		if len(members) == 0 {
+			continue
+		}
+
+		var (
+			t     = b.topics[name]
+			n     = len(t.partitions)
+			share = n / len(members)
+			extra = n % len(members)
+			next  = 0
+		)
+		for i, m := range members {
+			count := share
+			if i < extra {
+				count++
+			}
+			for p := next; p < next+count; p++ {
+				topic := name
+				assignments[m] = append(assignments[m], kafka.TopicPartition{
+					Topic:     &topic,
+					Partition: int32(p),
+					Offset:    kafka.OffsetInvalid,
+				})
+			}
+			next += count
+		}
+	}
+
+	for _, m := range g.members {
+		m.reassign(assignments[m])
+	}
+}
+
+func copyMessage(message *kafka.Message) *kafka.Message {
+	var copied = *message
+	if message.TopicPartition.Topic != nil {
+		topic := *message.TopicPartition.Topic
+		copied.TopicPartition.Topic = &topic
+	}
+	if message.Headers != nil {
+		copied.Headers = make([]kafka.Header, len(message.Headers))
+		copy(copied.Headers, message.Headers)
+	}
+	return &copied
+}
+
+func compileSubscription(topics []string) ([]*regexp.Regexp, error) {
+	var patterns []*regexp.Regexp
+	for _, topic := range topics {
+		if strings.HasPrefix(topic, "^") {
+			pattern, err := regexp.Compile(topic)
+			if err != nil {
+				return nil, kafka.NewError(confluent.ErrInvalidArg, fmt.Sprintf("invalid topic pattern %s: %v", topic, err), false)
+			}
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns, nil
+}
+
+func equalPartitions(a, b []kafka.TopicPartition) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if *a[i].Topic != *b[i].Topic || a[i].Partition != b[i].Partition {
+			return false
+		}
+	}
+	return true
+}
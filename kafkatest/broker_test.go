@@ -0,0 +1,353 @@
+package kafkatest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	kafka "github.com/bcowtech/lib-kafka"
+	confluent "github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+func TestBroker_ProduceAndConsume(t *testing.T) {
+	broker := NewBroker()
+	broker.CreateTopic("gotest", 2)
+
+	producer, err := broker.NewProducer(&kafka.ConfigMap{})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer producer.Close()
+
+	topic := "gotest"
+	for i := 0; i < 4; i++ {
+		err = producer.Produce(&kafka.Message{
+			TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+			Value:          []byte(fmt.Sprintf("value %d", i)),
+			Opaque:         i,
+		}, nil)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		report := (<-producer.Events()).(*kafka.Message)
+		if report.TopicPartition.Error != nil {
+			t.Fatalf("%s", report.TopicPartition.Error)
+		}
+		if report.Opaque != i {
+			t.Errorf("assert delivery report Opaque expect '%v', got '%v'", i, report.Opaque)
+		}
+		if expected := int32(i % 2); report.TopicPartition.Partition != expected {
+			t.Errorf("assert delivery report Partition expect '%v', got '%v'", expected, report.TopicPartition.Partition)
+		}
+	}
+
+	consumer, err := broker.NewConsumer(&kafka.ConfigMap{
+		"group.id":          "gotest",
+		"auto.offset.reset": "earliest",
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	err = consumer.SubscribeTopics([]string{"gotest"}, nil)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	var values = make(map[string]bool)
+	for len(values) < 4 {
+		switch e := consumer.Poll(100).(type) {
+		case *kafka.Message:
+			values[string(e.Value)] = true
+		case nil:
+			t.Fatalf("assert consumed messages expect '%v', got '%v'", 4, len(values))
+		}
+	}
+	consumer.Close()
+
+	for partition := int32(0); partition < 2; partition++ {
+		if offset := broker.CommittedOffset("gotest", "gotest", partition); offset != 2 {
+			t.Errorf("assert committed offset of partition %d expect '%v', got '%v'", partition, 2, offset)
+		}
+	}
+
+	// the unknown topic
+	unknown := "unknown"
+	producer.Produce(&kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &unknown, Partition: kafka.PartitionAny},
+	}, nil)
+	report := (<-producer.Events()).(*kafka.Message)
+	if err, ok := report.TopicPartition.Error.(kafka.Error); !ok || err.Code() != confluent.ErrUnknownTopicOrPart {
+		t.Errorf("assert delivery report Error expect '%v', got '%v'", confluent.ErrUnknownTopicOrPart, report.TopicPartition.Error)
+	}
+}
+
+func TestBroker_Rebalance(t *testing.T) {
+	broker := NewBroker()
+	broker.CreateTopic("gotest", 4)
+
+	newConsumer := func() kafka.ConsumerClient {
+		consumer, err := broker.NewConsumer(&kafka.ConfigMap{"group.id": "gotest"})
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		err = consumer.SubscribeTopics([]string{"^go.*"}, nil)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		return consumer
+	}
+	assignmentOf := func(consumer kafka.ConsumerClient) []kafka.TopicPartition {
+		// handle the pending rebalance events
+		consumer.Poll(0)
+		partitions, _ := consumer.Assignment()
+		return partitions
+	}
+
+	first := newConsumer()
+	if n := len(assignmentOf(first)); n != 4 {
+		t.Errorf("assert assigned partitions expect '%v', got '%v'", 4, n)
+	}
+
+	second := newConsumer()
+	defer second.Close()
+	if n := len(assignmentOf(first)); n != 2 {
+		t.Errorf("assert assigned partitions of first member expect '%v', got '%v'", 2, n)
+	}
+	if n := len(assignmentOf(second)); n != 2 {
+		t.Errorf("assert assigned partitions of second member expect '%v', got '%v'", 2, n)
+	}
+
+	// the topic matched by the pattern
+	broker.CreateTopic("gotest2", 2)
+	if n := len(assignmentOf(second)); n != 3 {
+		t.Errorf("assert assigned partitions of second member expect '%v', got '%v'", 3, n)
+	}
+
+	first.Close()
+	if n := broker.Members("gotest"); n != 1 {
+		t.Errorf("assert group members expect '%v', got '%v'", 1, n)
+	}
+	if n := len(assignmentOf(second)); n != 6 {
+		t.Errorf("assert assigned partitions of second member expect '%v', got '%v'", 6, n)
+	}
+}
+
+func TestBroker_Transaction(t *testing.T) {
+	broker := NewBroker()
+	broker.CreateTopic("gotest", 1)
+
+	consumer, _ := broker.NewConsumer(&kafka.ConfigMap{
+		"group.id":          "gotest",
+		"auto.offset.reset": "earliest",
+	})
+	defer consumer.Close()
+	consumer.SubscribeTopics([]string{"gotest"}, nil)
+	consumer.Poll(0)
+
+	producer, _ := broker.NewProducer(&kafka.ConfigMap{"transactional.id": "gotest"})
+	defer producer.Close()
+
+	ctx := context.Background()
+	if err := producer.Produce(&kafka.Message{}, nil); err == nil {
+		t.Error("Expected the write outside a transaction to fail")
+	}
+	if err := producer.InitTransactions(ctx); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	topic := "gotest"
+	produce := func(value string) {
+		producer.Produce(&kafka.Message{
+			TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+			Value:          []byte(value),
+		}, nil)
+		<-producer.Events()
+	}
+
+	producer.BeginTransaction()
+	produce("aborted")
+	producer.AbortTransaction(ctx)
+
+	producer.BeginTransaction()
+	produce("committed")
+	if ev := consumer.Poll(10); ev != nil {
+		t.Errorf("assert Poll() of pending transaction expect '%v', got '%v'", nil, ev)
+	}
+
+	metadata, _ := consumer.GetConsumerGroupMetadata()
+	err := producer.SendOffsetsToTransaction(ctx, []kafka.TopicPartition{{Topic: &topic, Partition: 0, Offset: 42}}, metadata)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := producer.CommitTransaction(ctx); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	message, ok := consumer.Poll(100).(*kafka.Message)
+	if !ok || string(message.Value) != "committed" {
+		t.Errorf("assert Poll() expect '%v', got '%v'", "committed", message)
+	}
+	if offset := broker.CommittedOffset("gotest", "gotest", 0); offset != 42 {
+		t.Errorf("assert committed offset expect '%v', got '%v'", 42, offset)
+	}
+
+	// fence the producer
+	successor, _ := broker.NewProducer(&kafka.ConfigMap{"transactional.id": "gotest"})
+	defer successor.Close()
+	successor.InitTransactions(ctx)
+	err = producer.BeginTransaction()
+	if e, ok := err.(kafka.Error); !ok || !e.IsFatal() {
+		t.Errorf("assert BeginTransaction() of fenced producer expect fatal error, got '%v'", err)
+	}
+}
+
+func TestConsumer_DeadLetter(t *testing.T) {
+	broker := NewBroker()
+	broker.CreateTopic("gotest", 1)
+	broker.CreateTopic("gotest.dlq", 1)
+
+	producer, err := kafka.NewProducer(&kafka.ProducerOption{
+		ConfigMap:      &kafka.ConfigMap{},
+		ClientProvider: broker.NewProducer,
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer producer.Close()
+
+	var (
+		wg    sync.WaitGroup
+		mutex sync.Mutex
+		seen  []string
+	)
+	wg.Add(2)
+	c := &kafka.Consumer{
+		PollingTimeout: 10 * time.Millisecond,
+		MessageProcessor: func(ctx *kafka.ConsumeContext, message *kafka.Message) error {
+			defer wg.Done()
+			mutex.Lock()
+			seen = append(seen, string(message.Value))
+			mutex.Unlock()
+
+			if string(message.Value) == "poison" {
+				return kafka.Permanent(fmt.Errorf("cannot handle poison"))
+			}
+			return nil
+		},
+		DeadLetter: &kafka.DeadLetterOption{
+			Producer: producer,
+		},
+		ConfigMap: &kafka.ConfigMap{
+			"group.id":          "gotest",
+			"auto.offset.reset": "earliest",
+		},
+		ClientProvider: broker.NewConsumer,
+	}
+
+	topic := "gotest"
+	for _, value := range []string{"poison", "ok"} {
+		producer.WriteMessage(&kafka.Message{
+			TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+			Value:          []byte(value),
+		}, nil)
+	}
+
+	err = c.Subscribe([]string{"gotest"}, nil)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	wg.Wait()
+	c.Close()
+
+	if len(seen) != 2 || seen[0] != "poison" || seen[1] != "ok" {
+		t.Errorf("assert handled messages expect '%v', got '%v'", []string{"poison", "ok"}, seen)
+	}
+
+	deadLetters := broker.Messages("gotest.dlq")
+	if len(deadLetters) != 1 || string(deadLetters[0].Value) != "poison" {
+		t.Fatalf("assert dead letters expect '%v', got '%v'", "poison", deadLetters)
+	}
+	// the offsets are stored only after the messages are handled or
+	// dead-lettered, and committed on close
+	if offset := broker.CommittedOffset("gotest", "gotest", 0); offset != 2 {
+		t.Errorf("assert committed offset expect '%v', got '%v'", 2, offset)
+	}
+}
+
+func TestConsumer_RunStopsOnPanic(t *testing.T) {
+	broker := NewBroker()
+	broker.CreateTopic("gotest", 1)
+	produceValues(broker, "gotest", "boom")
+
+	c := &kafka.Consumer{
+		PollingTimeout: 10 * time.Millisecond,
+		MessageHandler: func(ctx *kafka.ConsumeContext, message *kafka.Message) {
+			panic("boom")
+		},
+		ConfigMap: &kafka.ConfigMap{
+			"group.id":          "gotest",
+			"auto.offset.reset": "earliest",
+		},
+		ClientProvider: broker.NewConsumer,
+	}
+	err := c.Subscribe([]string{"gotest"}, nil)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer c.Close()
+
+	// the default PanicDecisionStopConsumer makes Run return the panic
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = c.Run(ctx)
+	if panicErr, ok := err.(*kafka.PanicError); !ok || panicErr.Value != "boom" {
+		t.Errorf("assert Consumer.Run() expect '*PanicError', got '%v'", err)
+	}
+}
+
+func TestConsumer_HealthCheck(t *testing.T) {
+	broker := NewBroker()
+	broker.CreateTopic("gotest", 2)
+
+	c := &kafka.Consumer{
+		PollingTimeout: 10 * time.Millisecond,
+		MessageHandler: func(ctx *kafka.ConsumeContext, message *kafka.Message) {},
+		ConfigMap: &kafka.ConfigMap{
+			"group.id": "gotest",
+		},
+		ClientProvider: broker.NewConsumer,
+	}
+	err := c.Subscribe([]string{"gotest"}, nil)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	report, err := c.HealthCheck(ctx)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(report.Topics) != 1 || report.Topics[0].Partitions != 2 || report.Topics[0].Err != nil {
+		t.Errorf("assert HealthReport.Topics expect '%v' of '%v' partitions, got '%+v'", "gotest", 2, report.Topics)
+	}
+
+	// the Consumer without ConfigMap fails to subscribe instead of panicking
+	c = &kafka.Consumer{
+		MessageHandler: func(ctx *kafka.ConsumeContext, message *kafka.Message) {},
+		ClientProvider: broker.NewConsumer,
+	}
+	err = c.Subscribe([]string{"gotest"}, nil)
+	if err == nil {
+		c.Close()
+		t.Error("Expected Consumer.Subscribe() without group.id to fail")
+	}
+	if _, err := c.HealthCheck(ctx); err == nil {
+		t.Error("Expected Consumer.HealthCheck() of the stopped Consumer to fail")
+	}
+}
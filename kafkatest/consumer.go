@@ -0,0 +1,661 @@
+package kafkatest
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	kafka "github.com/bcowtech/lib-kafka"
+	confluent "github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+var _ kafka.ConsumerClient = new(Consumer)
+
+// Consumer is the ConsumerClient of the Broker. It honours group.id,
+// enable.auto.commit, enable.auto.offset.store, auto.offset.reset,
+// isolation.level, enable.partition.eof and
+// go.application.rebalance.enable. The stored offsets are committed on
+// every Poll if enable.auto.commit is set, instead of periodically.
+//
+// The RebalanceCb passed to SubscribeTopics receives a nil *kafka.Consumer.
+type Consumer struct {
+	broker *Broker
+
+	groupID         string
+	autoCommit      bool
+	autoOffsetStore bool
+	autoOffsetReset string
+	readCommitted   bool
+	partitionEOF    bool
+	appRebalance    bool
+
+	// the following fields are guarded by the mutex of the Broker
+	group        *group
+	subscription []string
+	patterns     []*regexp.Regexp
+	rebalanceCb  kafka.RebalanceCb
+	generation   []kafka.TopicPartition
+	events       []kafka.Event
+	assignment   []*assignedPartition
+	next         int
+	reassigned   bool
+	closed       bool
+}
+
+// NewConsumer creates a Consumer of the Broker. It can be used as the
+// ClientProvider of kafka.Consumer.
+func (b *Broker) NewConsumer(conf *kafka.ConfigMap) (kafka.ConsumerClient, error) {
+	var c = &Consumer{
+		broker: b,
+	}
+
+	var err error
+	c.groupID, err = stringOf(conf, kafka.KAFKA_CONF_GROUP_ID, "")
+	if err != nil {
+		return nil, err
+	}
+	if len(c.groupID) == 0 {
+		return nil, kafka.NewError(confluent.ErrInvalidArg, "Required property group.id not set", false)
+	}
+	c.autoCommit, err = boolOf(conf, kafka.KAFKA_CONF_ENABLE_AUTO_COMMIT, true)
+	if err != nil {
+		return nil, err
+	}
+	c.autoOffsetStore, err = boolOf(conf, kafka.KAFKA_CONF_ENABLE_AUTO_OFFSET_STORE, true)
+	if err != nil {
+		return nil, err
+	}
+	autoOffsetReset, err := stringOf(conf, "auto.offset.reset", "latest")
+	if err != nil {
+		return nil, err
+	}
+	c.autoOffsetReset = strings.ToLower(autoOffsetReset)
+	isolationLevel, err := stringOf(conf, "isolation.level", "read_committed")
+	if err != nil {
+		return nil, err
+	}
+	c.readCommitted = strings.ToLower(isolationLevel) != "read_uncommitted"
+	c.partitionEOF, err = boolOf(conf, "enable.partition.eof", false)
+	if err != nil {
+		return nil, err
+	}
+	c.appRebalance, err = boolOf(conf, "go.application.rebalance.enable", false)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Consumer) SubscribeTopics(topics []string, rebalanceCb kafka.RebalanceCb) error {
+	patterns, err := compileSubscription(topics)
+	if err != nil {
+		return err
+	}
+
+	var b = c.broker
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if c.closed {
+		return errClosed()
+	}
+	c.subscription = append([]string(nil), topics...)
+	c.patterns = patterns
+	c.rebalanceCb = rebalanceCb
+	c.group = b.groupOf(c.groupID)
+	c.group.join(b, c)
+	b.broadcast()
+	return nil
+}
+
+func (c *Consumer) Subscription() (topics []string, err error) {
+	var b = c.broker
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return append([]string(nil), c.subscription...), nil
+}
+
+func (c *Consumer) Unsubscribe() error {
+	var b = c.broker
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	c.leave()
+	return nil
+}
+
+// Poll returns the next rebalance event, message or PartitionEOF, or nil if
+// there is none within timeoutMs. A negative timeoutMs waits indefinitely.
+func (c *Consumer) Poll(timeoutMs int) kafka.Event {
+	var (
+		b        = c.broker
+		deadline = time.Now().Add(time.Duration(timeoutMs) * time.Millisecond)
+	)
+
+	for {
+		b.mutex.Lock()
+		if c.closed {
+			b.mutex.Unlock()
+			return nil
+		}
+		if len(c.events) > 0 {
+			ev := c.events[0]
+			c.events[0] = nil
+			c.events = c.events[1:]
+			b.mutex.Unlock()
+
+			if ev = c.rebalance(ev); ev != nil {
+				return ev
+			}
+			continue
+		}
+		if c.autoCommit {
+			c.commitStored()
+		}
+		if ev := c.fetch(); ev != nil {
+			b.mutex.Unlock()
+			return ev
+		}
+		notify := b.notify
+		b.mutex.Unlock()
+
+		if timeoutMs < 0 {
+			<-notify
+			continue
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil
+		}
+		timer := time.NewTimer(remaining)
+		select {
+		case <-notify:
+			timer.Stop()
+		case <-timer.C:
+			return nil
+		}
+	}
+}
+
+func (c *Consumer) Assign(partitions []kafka.TopicPartition) error {
+	var b = c.broker
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	var assignment = make([]*assignedPartition, 0, len(partitions))
+	for _, tp := range partitions {
+		p, err := c.assign(tp)
+		if err != nil {
+			return err
+		}
+		assignment = append(assignment, p)
+	}
+	c.assignment = assignment
+	c.next = 0
+	c.reassigned = true
+	b.broadcast()
+	return nil
+}
+
+func (c *Consumer) Unassign() error {
+	var b = c.broker
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	c.assignment = nil
+	c.reassigned = true
+	return nil
+}
+
+func (c *Consumer) Assignment() (partitions []kafka.TopicPartition, err error) {
+	var b = c.broker
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	partitions = make([]kafka.TopicPartition, 0, len(c.assignment))
+	for _, p := range c.assignment {
+		partitions = append(partitions, p.topicPartition(kafka.OffsetInvalid))
+	}
+	return partitions, nil
+}
+
+// Commit commits the stored offsets of the assigned partitions. It returns
+// ErrNoOffset if there is no offset stored.
+func (c *Consumer) Commit() ([]kafka.TopicPartition, error) {
+	var b = c.broker
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if c.closed {
+		return nil, errClosed()
+	}
+	offsets := c.commitStored()
+	if len(offsets) == 0 {
+		return nil, kafka.NewError(confluent.ErrNoOffset, "Local: No offset stored", false)
+	}
+	return offsets, nil
+}
+
+func (c *Consumer) CommitMessage(m *kafka.Message) ([]kafka.TopicPartition, error) {
+	if m.TopicPartition.Error != nil {
+		return nil, kafka.NewError(confluent.ErrInvalidArg, "Can't commit errored message", false)
+	}
+
+	var offsets = []kafka.TopicPartition{m.TopicPartition}
+	offsets[0].Offset++
+	return c.CommitOffsets(offsets)
+}
+
+func (c *Consumer) CommitOffsets(offsets []kafka.TopicPartition) ([]kafka.TopicPartition, error) {
+	var b = c.broker
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if c.closed {
+		return nil, errClosed()
+	}
+	var g = b.groupOf(c.groupID)
+	for _, tp := range offsets {
+		g.commit(tp)
+	}
+	return offsets, nil
+}
+
+// Committed returns the committed offsets of the partitions, or
+// OffsetInvalid for the partitions without a committed offset.
+func (c *Consumer) Committed(partitions []kafka.TopicPartition, timeoutMs int) (offsets []kafka.TopicPartition, err error) {
+	var b = c.broker
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	var g = b.groupOf(c.groupID)
+	offsets = make([]kafka.TopicPartition, 0, len(partitions))
+	for _, tp := range partitions {
+		tp.Offset = kafka.OffsetInvalid
+		if tp.Topic != nil {
+			if offset, ok := g.committed[partitionKey{*tp.Topic, tp.Partition}]; ok {
+				tp.Offset = offset
+			}
+		}
+		offsets = append(offsets, tp)
+	}
+	return offsets, nil
+}
+
+// StoreOffsets stores the offsets to be committed by Commit or the auto
+// commit. It fails with ErrState if any of the partitions is not assigned.
+func (c *Consumer) StoreOffsets(offsets []kafka.TopicPartition) (storedOffsets []kafka.TopicPartition, err error) {
+	var b = c.broker
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, tp := range offsets {
+		p := c.assignedPartitionOf(tp)
+		if p == nil {
+			tp.Error = kafka.NewError(confluent.ErrState, "Local: Erroneous state", false)
+			err = tp.Error
+		} else {
+			p.stored = tp.Offset
+		}
+		storedOffsets = append(storedOffsets, tp)
+	}
+	return storedOffsets, err
+}
+
+func (c *Consumer) Pause(partitions []kafka.TopicPartition) error {
+	return c.setPaused(partitions, true)
+}
+
+func (c *Consumer) Resume(partitions []kafka.TopicPartition) error {
+	return c.setPaused(partitions, false)
+}
+
+// Seek sets the position of the assigned partition. It fails with ErrState
+// if the partition is not assigned.
+func (c *Consumer) Seek(partition kafka.TopicPartition, timeoutMs int) error {
+	var b = c.broker
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	p := c.assignedPartitionOf(partition)
+	if p == nil {
+		return kafka.NewError(confluent.ErrState, fmt.Sprintf("partition %v is not assigned", partition), false)
+	}
+	p.position = c.resolveOffset(p.topic, p.partition, partition.Offset)
+	p.eof = false
+	b.broadcast()
+	return nil
+}
+
+// GetWatermarkOffsets returns the low and high watermark of the partition.
+// The high watermark counts the messages of the pending transactions as
+// well.
+func (c *Consumer) GetWatermarkOffsets(topic string, partition int32) (low, high int64, err error) {
+	var b = c.broker
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	t, ok := b.topics[topic]
+	if !ok || partition < 0 || int(partition) >= len(t.partitions) {
+		return 0, 0, kafka.NewError(confluent.ErrUnknownTopicOrPart, fmt.Sprintf("unknown partition %d of topic %s", partition, topic), false)
+	}
+	return 0, int64(len(t.partitions[partition].entries)), nil
+}
+
+func (c *Consumer) GetMetadata(topic *string, allTopics bool, timeoutMs int) (*kafka.Metadata, error) {
+	return c.broker.getMetadata(topic, allTopics)
+}
+
+// GetConsumerGroupMetadata returns the metadata of the consumer group,
+// which the Producer of the same Broker accepts on SendOffsetsToTransaction.
+func (c *Consumer) GetConsumerGroupMetadata() (*kafka.ConsumerGroupMetadata, error) {
+	metadata, err := confluent.NewTestConsumerGroupMetadata(c.groupID)
+	if err != nil {
+		return nil, err
+	}
+
+	var b = c.broker
+	b.mutex.Lock()
+	b.metadata[metadata] = c.groupID
+	b.mutex.Unlock()
+	return metadata, nil
+}
+
+// Close commits the stored offsets if enable.auto.commit is set, and leaves
+// the consumer group.
+func (c *Consumer) Close() error {
+	var b = c.broker
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	if c.autoCommit {
+		c.commitStored()
+	}
+	c.leave()
+	c.assignment = nil
+	c.events = nil
+	c.closed = true
+	b.broadcast()
+	return nil
+}
+
+// rebalance passes the event to the RebalanceCb, and assigns or unassigns
+// the partitions unless the RebalanceCb has done it. The event is returned
+// for the application to handle if go.application.rebalance.enable is set
+// without a RebalanceCb.
+func (c *Consumer) rebalance(ev kafka.Event) kafka.Event {
+	var b = c.broker
+	b.mutex.Lock()
+	c.reassigned = false
+	rebalanceCb := c.rebalanceCb
+	b.mutex.Unlock()
+
+	if rebalanceCb != nil {
+		rebalanceCb(nil, ev)
+	} else if c.appRebalance {
+		return ev
+	}
+
+	b.mutex.Lock()
+	reassigned := c.reassigned
+	b.mutex.Unlock()
+	if !reassigned {
+		switch e := ev.(type) {
+		case confluent.AssignedPartitions:
+			c.Assign(e.Partitions)
+		case confluent.RevokedPartitions:
+			c.Unassign()
+		}
+	}
+	return nil
+}
+
+// reassign queues the rebalance events if the assignment of the group
+// changes.
+func (c *Consumer) reassign(partitions []kafka.TopicPartition) {
+	if c.generation != nil && equalPartitions(c.generation, partitions) {
+		return
+	}
+
+	if len(c.generation) > 0 {
+		c.events = append(c.events, confluent.RevokedPartitions{Partitions: c.generation})
+	}
+	if partitions == nil {
+		partitions = []kafka.TopicPartition{}
+	}
+	c.events = append(c.events, confluent.AssignedPartitions{Partitions: partitions})
+	c.generation = partitions
+}
+
+func (c *Consumer) leave() {
+	if c.group == nil {
+		return
+	}
+
+	c.group.leave(c.broker, c)
+	c.group = nil
+	c.subscription = nil
+	c.patterns = nil
+	if len(c.generation) > 0 {
+		c.events = append(c.events, confluent.RevokedPartitions{Partitions: c.generation})
+	}
+	c.generation = nil
+}
+
+func (c *Consumer) subscribes(topic string) bool {
+	for _, t := range c.subscription {
+		if t == topic {
+			return true
+		}
+	}
+	for _, pattern := range c.patterns {
+		if pattern.MatchString(topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// fetch returns the next message of the assigned partitions in turn, or
+// the PartitionEOF of a partition reaching its end.
+func (c *Consumer) fetch() kafka.Event {
+	var n = len(c.assignment)
+	for i := 0; i < n; i++ {
+		p := c.assignment[(c.next+i)%n]
+		if p.paused {
+			continue
+		}
+
+		entries := c.broker.topics[p.topic].partitions[p.partition].entries
+		for int(p.position) < len(entries) {
+			e := entries[p.position]
+			if e.txn == nil || !c.readCommitted || e.txn.state == transactionCommitted {
+				break
+			}
+			if e.txn.state == transactionPending {
+				// the last stable offset
+				entries = entries[:p.position]
+				break
+			}
+			// skip the aborted message
+			p.position++
+		}
+
+		if int(p.position) < len(entries) {
+			message := copyMessage(entries[p.position].message)
+			p.position++
+			p.eof = false
+			if c.autoOffsetStore {
+				p.stored = p.position
+			}
+			c.next = (c.next + i + 1) % n
+			return message
+		}
+		if c.partitionEOF && !p.eof {
+			p.eof = true
+			c.next = (c.next + i + 1) % n
+			return confluent.PartitionEOF(p.topicPartition(p.position))
+		}
+	}
+	return nil
+}
+
+// commitStored commits the stored offsets which have not been committed.
+func (c *Consumer) commitStored() []kafka.TopicPartition {
+	if c.group == nil {
+		return nil
+	}
+
+	var offsets []kafka.TopicPartition
+	for _, p := range c.assignment {
+		if p.stored < 0 || p.stored == p.committed {
+			continue
+		}
+		tp := p.topicPartition(p.stored)
+		c.group.commit(tp)
+		p.committed = p.stored
+		offsets = append(offsets, tp)
+	}
+	return offsets
+}
+
+func (c *Consumer) assign(tp kafka.TopicPartition) (*assignedPartition, error) {
+	if tp.Topic == nil {
+		return nil, kafka.NewError(confluent.ErrInvalidArg, "no topic specified", false)
+	}
+	t, ok := c.broker.topics[*tp.Topic]
+	if !ok || tp.Partition < 0 || int(tp.Partition) >= len(t.partitions) {
+		return nil, kafka.NewError(confluent.ErrUnknownPartition, fmt.Sprintf("unknown partition %d of topic %s", tp.Partition, *tp.Topic), false)
+	}
+
+	var p = &assignedPartition{
+		topic:     *tp.Topic,
+		partition: tp.Partition,
+		stored:    kafka.OffsetInvalid,
+		committed: kafka.OffsetInvalid,
+	}
+	p.position = c.resolveOffset(p.topic, p.partition, tp.Offset)
+	if c.group != nil {
+		if offset, ok := c.group.committed[partitionKey{p.topic, p.partition}]; ok {
+			p.committed = offset
+		}
+	}
+	return p, nil
+}
+
+// resolveOffset returns the position of the offset. The stored or invalid
+// offset is resolved to the committed offset of the consumer group, or by
+// auto.offset.reset if there is none, and so is the out of range offset.
+func (c *Consumer) resolveOffset(topic string, partition int32, offset kafka.Offset) kafka.Offset {
+	var end = kafka.Offset(len(c.broker.topics[topic].partitions[partition].entries))
+
+	if offset == confluent.OffsetStored || offset == kafka.OffsetInvalid {
+		if g, ok := c.broker.groups[c.groupID]; ok {
+			if committed, ok := g.committed[partitionKey{topic, partition}]; ok {
+				offset = committed
+			}
+		}
+	}
+	if offset >= 0 && offset <= end {
+		return offset
+	}
+
+	switch offset {
+	case confluent.OffsetBeginning:
+		return 0
+	case confluent.OffsetEnd:
+		return end
+	}
+	switch c.autoOffsetReset {
+	case "smallest", "earliest", "beginning":
+		return 0
+	}
+	return end
+}
+
+func (c *Consumer) assignedPartitionOf(tp kafka.TopicPartition) *assignedPartition {
+	if tp.Topic == nil {
+		return nil
+	}
+	for _, p := range c.assignment {
+		if p.topic == *tp.Topic && p.partition == tp.Partition {
+			return p
+		}
+	}
+	return nil
+}
+
+func (c *Consumer) setPaused(partitions []kafka.TopicPartition, paused bool) error {
+	var b = c.broker
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, tp := range partitions {
+		if p := c.assignedPartitionOf(tp); p != nil {
+			p.paused = paused
+		}
+	}
+	if !paused {
+		b.broadcast()
+	}
+	return nil
+}
+
+type assignedPartition struct {
+	topic     string
+	partition int32
+	position  kafka.Offset
+	stored    kafka.Offset
+	committed kafka.Offset
+	paused    bool
+	eof       bool
+}
+
+func (p *assignedPartition) topicPartition(offset kafka.Offset) kafka.TopicPartition {
+	topic := p.topic
+	return kafka.TopicPartition{
+		Topic:     &topic,
+		Partition: p.partition,
+		Offset:    offset,
+	}
+}
+
+func errClosed() error {
+	return kafka.NewError(confluent.ErrState, "the client has been closed", false)
+}
+
+func stringOf(conf *kafka.ConfigMap, key string, defval string) (string, error) {
+	v, err := conf.Get(key, defval)
+	if err != nil {
+		return "", err
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", kafka.NewError(confluent.ErrInvalidArg, fmt.Sprintf("%s expects string, got %T", key, v), false)
+	}
+	return s, nil
+}
+
+func boolOf(conf *kafka.ConfigMap, key string, defval bool) (bool, error) {
+	v, err := conf.Get(key, defval)
+	if err != nil {
+		return false, err
+	}
+	switch b := v.(type) {
+	case bool:
+		return b, nil
+	case string:
+		switch strings.ToLower(b) {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		}
+	}
+	return false, kafka.NewError(confluent.ErrInvalidArg, fmt.Sprintf("%s expects bool, got %v", key, v), false)
+}
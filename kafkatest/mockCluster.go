@@ -0,0 +1,153 @@
+package kafkatest
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	kafka "github.com/bcowtech/lib-kafka"
+	confluent "github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+const (
+	DEFAULT_MOCK_CLUSTER_TIMEOUT_MS = 10000
+
+	KAFKA_CONF_TEST_MOCK_NUM_BROKERS = "test.mock.num.brokers"
+)
+
+// MockCluster is the in-process mock cluster of librdkafka. Unlike the
+// Broker, it speaks the Kafka protocol over TCP, so the Consumer and the
+// Producer work against it through the real librdkafka clients:
+//
+//	cluster := kafkatest.NewMockCluster(t, 3)
+//	cluster.CreateTopic("myTopic")
+//
+//	consumer := &kafka.Consumer{
+//		ConfigMap: &kafka.ConfigMap{
+//			"bootstrap.servers": cluster.BootstrapServers(),
+//			...
+//		},
+//	}
+//
+// The mock cluster lives in a librdkafka handle owned by the MockCluster,
+// and is destroyed on Close or when the test finishes.
+type MockCluster struct {
+	handle           *confluent.Producer
+	bootstrapServers string
+
+	logs      chan confluent.LogEvent
+	closing   chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// NewMockCluster starts a mock cluster of the number of brokers, and fails
+// the test if it cannot.
+func NewMockCluster(t testing.TB, brokers int) *MockCluster {
+	t.Helper()
+
+	cluster, err := startMockCluster(t, brokers)
+	if err != nil {
+		t.Fatalf("cannot start mock cluster: %v", err)
+	}
+	t.Cleanup(cluster.Close)
+	return cluster
+}
+
+// BootstrapServers returns the addresses of the mock brokers for the
+// bootstrap.servers of the ConfigMap.
+func (c *MockCluster) BootstrapServers() string {
+	return c.bootstrapServers
+}
+
+// ConfigMap returns a ConfigMap with the bootstrap.servers of the mock
+// cluster and the specified properties.
+func (c *MockCluster) ConfigMap(properties kafka.ConfigMap) *kafka.ConfigMap {
+	var conf = kafka.ConfigMap{
+		kafka.KAFKA_CONF_BOOTSTRAP_SERVERS: c.bootstrapServers,
+	}
+	for k, v := range properties {
+		conf[k] = v
+	}
+	return &conf
+}
+
+// CreateTopic creates the topics through the auto creation of the mock
+// cluster, which creates 4 partitions for each topic.
+func (c *MockCluster) CreateTopic(topics ...string) error {
+	for _, topic := range topics {
+		topic := topic
+		metadata, err := c.handle.GetMetadata(&topic, false, DEFAULT_MOCK_CLUSTER_TIMEOUT_MS)
+		if err != nil {
+			return err
+		}
+		if t, ok := metadata.Topics[topic]; !ok {
+			return fmt.Errorf("cannot create topic %s", topic)
+		} else if t.Error.Code() != confluent.ErrNoError {
+			return t.Error
+		}
+	}
+	return nil
+}
+
+// Close destroys the mock cluster.
+func (c *MockCluster) Close() {
+	c.closeOnce.Do(func() {
+		c.handle.Close()
+		close(c.closing)
+		c.wg.Wait()
+	})
+}
+
+func startMockCluster(t testing.TB, brokers int) (*MockCluster, error) {
+	if brokers <= 0 {
+		return nil, fmt.Errorf("invalid number of brokers %d", brokers)
+	}
+
+	var c = &MockCluster{
+		logs:    make(chan confluent.LogEvent, 100),
+		closing: make(chan struct{}),
+	}
+
+	handle, err := confluent.NewProducer(&kafka.ConfigMap{
+		KAFKA_CONF_TEST_MOCK_NUM_BROKERS:        brokers,
+		kafka.KAFKA_CONF_GO_LOGS_CHANNEL_ENABLE: true,
+		kafka.KAFKA_CONF_GO_LOGS_CHANNEL:        c.logs,
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.handle = handle
+
+	c.wg.Add(1)
+	go c.forwardLogs(t)
+
+	// the mock brokers replace the bootstrap.servers of the handle
+	metadata, err := handle.GetMetadata(nil, true, DEFAULT_MOCK_CLUSTER_TIMEOUT_MS)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	var addrs = make([]string, 0, len(metadata.Brokers))
+	for _, broker := range metadata.Brokers {
+		addrs = append(addrs, fmt.Sprintf("%s:%d", broker.Host, broker.Port))
+	}
+	c.bootstrapServers = strings.Join(addrs, ",")
+	return c, nil
+}
+
+// forwardLogs writes the logs of the mock cluster to the test log until the
+// MockCluster closes.
+func (c *MockCluster) forwardLogs(t testing.TB) {
+	defer c.wg.Done()
+
+	for {
+		select {
+		case <-c.closing:
+			return
+		case e := <-c.logs:
+			t.Logf("%s", e)
+		}
+	}
+}
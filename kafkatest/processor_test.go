@@ -0,0 +1,244 @@
+package kafkatest
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	kafka "github.com/bcowtech/lib-kafka"
+)
+
+func newTestProcessor(t *testing.T, broker *Broker, transformer kafka.TransformProc, retryPolicy *kafka.RetryPolicy) *kafka.Processor {
+	producer, err := kafka.NewProducer(&kafka.ProducerOption{
+		ConfigMap:       &kafka.ConfigMap{},
+		TransactionalID: "gotest",
+		ClientProvider:  broker.NewProducer,
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	t.Cleanup(producer.Close)
+
+	return &kafka.Processor{
+		Consumer: &kafka.Consumer{
+			PollingTimeout: 10 * time.Millisecond,
+			Batch: &kafka.BatchOption{
+				MaxMessages: 2,
+				Linger:      10 * time.Millisecond,
+			},
+			ConfigMap: &kafka.ConfigMap{
+				"group.id":          "gotest",
+				"auto.offset.reset": "earliest",
+				"isolation.level":   "read_committed",
+			},
+			ClientProvider: broker.NewConsumer,
+		},
+		Producer:    producer,
+		Transformer: transformer,
+		RetryPolicy: retryPolicy,
+	}
+}
+
+func produceValues(broker *Broker, topic string, values ...string) {
+	for _, value := range values {
+		broker.Produce(&kafka.Message{
+			TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: 0},
+			Value:          []byte(value),
+		})
+	}
+}
+
+func valuesOf(messages []*kafka.Message) []string {
+	var values []string
+	for _, m := range messages {
+		values = append(values, string(m.Value))
+	}
+	return values
+}
+
+func uppercase(messages []*kafka.Message) []*kafka.Message {
+	var (
+		topic   = "output"
+		outputs []*kafka.Message
+	)
+	for _, m := range messages {
+		outputs = append(outputs, &kafka.Message{
+			TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+			Value:          []byte(strings.ToUpper(string(m.Value))),
+		})
+	}
+	return outputs
+}
+
+func waitForCommittedOffset(t *testing.T, broker *Broker, offset kafka.Offset) {
+	deadline := time.Now().Add(10 * time.Second)
+	for broker.CommittedOffset("gotest", "input", 0) != offset {
+		if time.Now().After(deadline) {
+			t.Fatalf("assert committed offset expect '%v', got '%v'", offset, broker.CommittedOffset("gotest", "input", 0))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestProcessor_AbortAndRewind(t *testing.T) {
+	broker := NewBroker()
+	broker.CreateTopic("input", 1)
+	broker.CreateTopic("output", 1)
+	produceValues(broker, "input", "a", "b", "fail", "c", "d")
+
+	var (
+		mutex    sync.Mutex
+		attempts int
+	)
+	processor := newTestProcessor(t, broker, func(ctx *kafka.BatchContext, messages []*kafka.Message) ([]*kafka.Message, error) {
+		for _, m := range messages {
+			if string(m.Value) != "fail" {
+				continue
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			attempts++
+			if attempts == 1 {
+				// the outputs produced so far are aborted
+				return uppercase(messages[:1]), fmt.Errorf("transient failure")
+			}
+		}
+		return uppercase(messages), nil
+	}, &kafka.RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: 20 * time.Millisecond,
+	})
+
+	err := processor.Subscribe([]string{"input"}, nil)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer processor.Close()
+
+	waitForCommittedOffset(t, broker, 5)
+
+	// the outputs and the offsets are committed atomically, so the outputs
+	// are neither lost nor duplicated by the rewind
+	expected := []string{"A", "B", "FAIL", "C", "D"}
+	if values := valuesOf(broker.Messages("output")); strings.Join(values, ",") != strings.Join(expected, ",") {
+		t.Errorf("assert output expect '%v', got '%v'", expected, values)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if attempts != 2 {
+		t.Errorf("assert attempts expect '%v', got '%v'", 2, attempts)
+	}
+}
+
+func TestProcessor_GiveUp(t *testing.T) {
+	broker := NewBroker()
+	broker.CreateTopic("input", 1)
+	broker.CreateTopic("output", 1)
+	produceValues(broker, "input", "a", "b", "poison", "c")
+
+	var (
+		mutex    sync.Mutex
+		attempts int
+	)
+	processor := newTestProcessor(t, broker, func(ctx *kafka.BatchContext, messages []*kafka.Message) ([]*kafka.Message, error) {
+		for _, m := range messages {
+			if string(m.Value) == "poison" {
+				mutex.Lock()
+				attempts++
+				mutex.Unlock()
+				return nil, fmt.Errorf("cannot transform poison")
+			}
+		}
+		return uppercase(messages), nil
+	}, &kafka.RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: 10 * time.Millisecond,
+	})
+
+	err := processor.Subscribe([]string{"input"}, nil)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = processor.Run(ctx)
+	if err == nil || err == context.DeadlineExceeded {
+		t.Fatalf("assert Processor.Run() expect the error of the batch, got '%v'", err)
+	}
+
+	// no offset past the failing batch is committed
+	if offset := broker.CommittedOffset("gotest", "input", 0); offset != 2 {
+		t.Errorf("assert committed offset expect '%v', got '%v'", 2, offset)
+	}
+	expected := []string{"A", "B"}
+	if values := valuesOf(broker.Messages("output")); strings.Join(values, ",") != strings.Join(expected, ",") {
+		t.Errorf("assert output expect '%v', got '%v'", expected, values)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if attempts != 3 {
+		t.Errorf("assert attempts expect '%v', got '%v'", 3, attempts)
+	}
+}
+
+func TestProcessor_PanicRewind(t *testing.T) {
+	broker := NewBroker()
+	broker.CreateTopic("input", 1)
+	broker.CreateTopic("output", 1)
+	produceValues(broker, "input", "a", "b", "boom", "c", "d")
+
+	var (
+		mutex    sync.Mutex
+		attempts int
+	)
+	processor := newTestProcessor(t, broker, func(ctx *kafka.BatchContext, messages []*kafka.Message) ([]*kafka.Message, error) {
+		for _, m := range messages {
+			if string(m.Value) != "boom" {
+				continue
+			}
+
+			mutex.Lock()
+			attempts++
+			n := attempts
+			mutex.Unlock()
+			if n == 1 {
+				panic("boom")
+			}
+		}
+		return uppercase(messages), nil
+	}, &kafka.RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: 20 * time.Millisecond,
+	})
+	processor.Consumer.PanicHandler = func(ctx *kafka.ConsumeContext, message *kafka.Message, err *kafka.PanicError) kafka.PanicDecision {
+		return kafka.PanicDecisionRetry
+	}
+
+	err := processor.Subscribe([]string{"input"}, nil)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer processor.Close()
+
+	waitForCommittedOffset(t, broker, 5)
+
+	// the batch which panicked is rewound like a failed one, and the
+	// messages polled before the rewind are skipped
+	expected := []string{"A", "B", "BOOM", "C", "D"}
+	if values := valuesOf(broker.Messages("output")); strings.Join(values, ",") != strings.Join(expected, ",") {
+		t.Errorf("assert output expect '%v', got '%v'", expected, values)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if attempts != 2 {
+		t.Errorf("assert attempts expect '%v', got '%v'", 2, attempts)
+	}
+}
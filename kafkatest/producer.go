@@ -0,0 +1,318 @@
+package kafkatest
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	kafka "github.com/bcowtech/lib-kafka"
+	confluent "github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+const (
+	DEFAULT_EVENTS_CHANNEL_SIZE = 1000
+)
+
+var _ kafka.ProducerClient = new(Producer)
+
+// Producer is the ProducerClient of the Broker. The messages are written to
+// the Broker on Produce, and their delivery reports are sent in order to the
+// delivery channel or the Events channel. It honours transactional.id and
+// go.events.channel.size.
+type Producer struct {
+	broker          *Broker
+	transactionalID string
+	events          chan kafka.Event
+
+	// the following fields are guarded by the mutex of the Broker
+	transaction *transaction
+	initialized bool
+	fenced      bool
+
+	reports []*deliveryReport
+	closed  bool
+	closing chan struct{}
+	cond    *sync.Cond
+	mutex   sync.Mutex
+	wg      sync.WaitGroup
+}
+
+// NewProducer creates a Producer of the Broker. It can be used as the
+// ClientProvider of kafka.ProducerOption.
+func (b *Broker) NewProducer(conf *kafka.ConfigMap) (kafka.ProducerClient, error) {
+	transactionalID, err := stringOf(conf, kafka.KAFKA_CONF_TRANSACTIONAL_ID, "")
+	if err != nil {
+		return nil, err
+	}
+	size, err := conf.Get("go.events.channel.size", DEFAULT_EVENTS_CHANNEL_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	eventsChannelSize, ok := size.(int)
+	if !ok {
+		return nil, kafka.NewError(confluent.ErrInvalidArg, "go.events.channel.size expects int", false)
+	}
+
+	p := &Producer{
+		broker:          b,
+		transactionalID: transactionalID,
+		events:          make(chan kafka.Event, eventsChannelSize),
+		closing:         make(chan struct{}),
+	}
+	p.cond = sync.NewCond(&p.mutex)
+
+	p.wg.Add(1)
+	go p.deliver()
+	return p, nil
+}
+
+// Produce writes the message to the Broker. The delivery report of the
+// failed write carries the error in its TopicPartition.Error.
+func (p *Producer) Produce(message *kafka.Message, deliveryChan chan kafka.Event) error {
+	var b = p.broker
+	b.mutex.Lock()
+	if p.fenced {
+		b.mutex.Unlock()
+		return errFenced()
+	}
+	if len(p.transactionalID) > 0 && p.transaction == nil {
+		b.mutex.Unlock()
+		return kafka.NewError(confluent.ErrState, "Local: Erroneous state: no transaction in progress", false)
+	}
+	tp, err := b.append(message, p.transaction)
+	b.mutex.Unlock()
+
+	report := copyMessage(message)
+	report.TopicPartition = tp
+	report.TopicPartition.Error = err
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed {
+		return errClosed()
+	}
+	p.reports = append(p.reports, &deliveryReport{
+		message:      report,
+		deliveryChan: deliveryChan,
+	})
+	p.cond.Broadcast()
+	return nil
+}
+
+func (p *Producer) Events() chan kafka.Event {
+	return p.events
+}
+
+// Flush waits for the delivery reports to be sent and the Events channel to
+// be drained, and returns the number of the outstanding events.
+func (p *Producer) Flush(timeoutMs int) int {
+	var deadline = time.Now().Add(time.Duration(timeoutMs) * time.Millisecond)
+	for {
+		remaining := p.outstanding()
+		if remaining == 0 || !time.Now().Before(deadline) {
+			return remaining
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (p *Producer) GetMetadata(topic *string, allTopics bool, timeoutMs int) (*kafka.Metadata, error) {
+	return p.broker.getMetadata(topic, allTopics)
+}
+
+// Close stops sending the delivery reports, and closes the Events channel.
+func (p *Producer) Close() {
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return
+	}
+	p.closed = true
+	close(p.closing)
+	p.cond.Broadcast()
+	p.mutex.Unlock()
+
+	p.wg.Wait()
+	close(p.events)
+
+	var b = p.broker
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if p.transaction != nil {
+		b.abortTransaction(p.transaction)
+		p.transaction = nil
+	}
+	if b.producers[p.transactionalID] == p {
+		delete(b.producers, p.transactionalID)
+	}
+}
+
+// InitTransactions registers the transactional.id, and fences the previous
+// Producer with the same transactional.id, whose pending transaction is
+// aborted.
+func (p *Producer) InitTransactions(ctx context.Context) error {
+	if len(p.transactionalID) == 0 {
+		return kafka.NewError(confluent.ErrNotConfigured, "The Transactional API requires transactional.id to be configured", true)
+	}
+
+	var b = p.broker
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if p.fenced {
+		return errFenced()
+	}
+	if previous, ok := b.producers[p.transactionalID]; ok && previous != p {
+		if previous.transaction != nil {
+			b.abortTransaction(previous.transaction)
+			previous.transaction = nil
+		}
+		previous.fenced = true
+	}
+	b.producers[p.transactionalID] = p
+	p.initialized = true
+	return nil
+}
+
+func (p *Producer) BeginTransaction() error {
+	var b = p.broker
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if err := p.checkTransactionState(false); err != nil {
+		return err
+	}
+	p.transaction = &transaction{
+		offsets: make(map[string][]kafka.TopicPartition),
+	}
+	return nil
+}
+
+// SendOffsetsToTransaction commits the offsets of the consumer group along
+// with the transaction. The metadata must come from a Consumer of the same
+// Broker.
+func (p *Producer) SendOffsetsToTransaction(ctx context.Context, offsets []kafka.TopicPartition, consumerMetadata *kafka.ConsumerGroupMetadata) error {
+	var b = p.broker
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if err := p.checkTransactionState(true); err != nil {
+		return err
+	}
+	groupID, ok := b.metadata[consumerMetadata]
+	if !ok {
+		return kafka.NewError(confluent.ErrInvalidArg, "unknown consumer group metadata", false)
+	}
+	p.transaction.offsets[groupID] = append(p.transaction.offsets[groupID], offsets...)
+	return nil
+}
+
+// CommitTransaction waits for the delivery reports of the transaction, and
+// then makes its messages and offsets visible.
+func (p *Producer) CommitTransaction(ctx context.Context) error {
+	var b = p.broker
+	b.mutex.Lock()
+	err := p.checkTransactionState(true)
+	b.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for p.outstanding() > 0 {
+		select {
+		case <-ctx.Done():
+			return kafka.NewError(confluent.ErrTimedOut, ctx.Err().Error(), false)
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if err := p.checkTransactionState(true); err != nil {
+		return err
+	}
+	b.commitTransaction(p.transaction)
+	p.transaction = nil
+	return nil
+}
+
+func (p *Producer) AbortTransaction(ctx context.Context) error {
+	var b = p.broker
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if err := p.checkTransactionState(true); err != nil {
+		return err
+	}
+	b.abortTransaction(p.transaction)
+	p.transaction = nil
+	return nil
+}
+
+func (p *Producer) checkTransactionState(inTransaction bool) error {
+	if p.fenced {
+		return errFenced()
+	}
+	if !p.initialized {
+		return kafka.NewError(confluent.ErrState, "Local: Erroneous state: transactions not initialized", false)
+	}
+	if inTransaction && p.transaction == nil {
+		return kafka.NewError(confluent.ErrState, "Local: Erroneous state: no transaction in progress", false)
+	}
+	if !inTransaction && p.transaction != nil {
+		return kafka.NewError(confluent.ErrState, "Local: Erroneous state: transaction already in progress", false)
+	}
+	return nil
+}
+
+func (p *Producer) outstanding() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return len(p.reports) + len(p.events)
+}
+
+// deliver sends the delivery reports in order until the Producer closes.
+func (p *Producer) deliver() {
+	defer p.wg.Done()
+
+	for {
+		p.mutex.Lock()
+		for len(p.reports) == 0 && !p.closed {
+			p.cond.Wait()
+		}
+		if p.closed {
+			p.mutex.Unlock()
+			return
+		}
+		report := p.reports[0]
+		p.mutex.Unlock()
+
+		var channel = report.deliveryChan
+		if channel == nil {
+			channel = p.events
+		}
+		select {
+		case channel <- report.message:
+		case <-p.closing:
+			return
+		}
+
+		p.mutex.Lock()
+		p.reports[0] = nil
+		p.reports = p.reports[1:]
+		p.mutex.Unlock()
+	}
+}
+
+type deliveryReport struct {
+	message      *kafka.Message
+	deliveryChan chan kafka.Event
+}
+
+func errFenced() error {
+	return kafka.NewError(confluent.ErrFenced, "Local: This instance has been fenced by a newer instance", true)
+}
@@ -0,0 +1,203 @@
+package kafka
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+type keyedMessage struct {
+	ctx     *ConsumeContext
+	message *Message
+}
+
+type keyWorker struct {
+	queue []keyedMessage
+}
+
+type keyPartitionState struct {
+	tracker *offsetTracker
+	ctx     *ConsumeContext
+	paused  bool
+}
+
+// keyDispatcher dispatches messages to a bounded pool of workers by the
+// hash of Message.Key. Messages with the same key are handled in order, and
+// the offset of a partition is only stored up to the highest contiguous
+// offset whose messages have all been handled.
+type keyDispatcher struct {
+	handler   MessageHandleProc
+	queueSize int
+
+	workers    []*keyWorker
+	partitions map[partitionKey]*keyPartitionState
+
+	wg     sync.WaitGroup
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	closed bool
+}
+
+func newKeyDispatcher(opt *WorkerPoolOption, handler MessageHandleProc) *keyDispatcher {
+	var (
+		workers   = opt.Workers
+		queueSize = opt.QueueSize
+	)
+	if workers <= 0 {
+		workers = 1
+	}
+	if queueSize <= 0 {
+		queueSize = DEFAULT_WORKER_POOL_QUEUE_SIZE
+	}
+
+	d := &keyDispatcher{
+		handler:    handler,
+		queueSize:  queueSize,
+		workers:    make([]*keyWorker, workers),
+		partitions: make(map[partitionKey]*keyPartitionState),
+	}
+	d.cond = sync.NewCond(&d.mutex)
+
+	d.wg.Add(workers)
+	for i := range d.workers {
+		w := &keyWorker{}
+		d.workers[i] = w
+		go d.work(w)
+	}
+	return d
+}
+
+func (d *keyDispatcher) dispatch(ctx *ConsumeContext, message *Message) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	key := newPartitionKey(message.TopicPartition)
+	state, ok := d.partitions[key]
+	if !ok {
+		state = &keyPartitionState{
+			tracker: newOffsetTracker(),
+			ctx:     ctx,
+		}
+		d.partitions[key] = state
+	}
+	state.tracker.track(message.TopicPartition.Offset)
+
+	w := d.workers[d.workerIndex(message)]
+	w.queue = append(w.queue, keyedMessage{ctx: ctx, message: message})
+	d.cond.Broadcast()
+
+	// backpressure
+	if !state.paused && state.tracker.inflight() >= d.queueSize {
+		err := ctx.Pause([]TopicPartition{message.TopicPartition})
+		if err != nil {
+			ctx.Logger().Error("cannot pause partition", "partition", message.TopicPartition, "error", err)
+			return
+		}
+		state.paused = true
+	}
+}
+
+func (d *keyDispatcher) drain(partitions []TopicPartition) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for _, tp := range partitions {
+		key := newPartitionKey(tp)
+		for {
+			state, ok := d.partitions[key]
+			if !ok {
+				break
+			}
+			if state.tracker.inflight() == 0 {
+				delete(d.partitions, key)
+				break
+			}
+			d.cond.Wait()
+		}
+	}
+}
+
+func (d *keyDispatcher) close() {
+	d.mutex.Lock()
+	for {
+		var inflight int
+		for _, state := range d.partitions {
+			inflight += state.tracker.inflight()
+		}
+		if inflight == 0 {
+			break
+		}
+		d.cond.Wait()
+	}
+	d.partitions = make(map[partitionKey]*keyPartitionState)
+	d.closed = true
+	d.cond.Broadcast()
+	d.mutex.Unlock()
+
+	d.wg.Wait()
+}
+
+func (d *keyDispatcher) workerIndex(message *Message) int {
+	h := fnv.New32a()
+	if message.Key != nil {
+		h.Write(message.Key)
+	} else {
+		// spread the messages without key by their partition
+		p := message.TopicPartition.Partition
+		h.Write([]byte{byte(p >> 24), byte(p >> 16), byte(p >> 8), byte(p)})
+	}
+	return int(h.Sum32() % uint32(len(d.workers)))
+}
+
+func (d *keyDispatcher) work(w *keyWorker) {
+	defer d.wg.Done()
+
+	for {
+		d.mutex.Lock()
+		for len(w.queue) == 0 && !d.closed {
+			d.cond.Wait()
+		}
+		if len(w.queue) == 0 {
+			d.mutex.Unlock()
+			return
+		}
+		m := w.queue[0]
+		w.queue[0] = keyedMessage{}
+		w.queue = w.queue[1:]
+		d.mutex.Unlock()
+
+		d.handler(m.ctx, m.message)
+
+		d.mutex.Lock()
+		d.complete(m.message.TopicPartition)
+		d.cond.Broadcast()
+		d.mutex.Unlock()
+	}
+}
+
+func (d *keyDispatcher) complete(tp TopicPartition) {
+	state, ok := d.partitions[newPartitionKey(tp)]
+	if !ok {
+		return
+	}
+
+	next, advanced := state.tracker.complete(tp.Offset)
+	if advanced {
+		_, err := state.ctx.StoreOffsets([]TopicPartition{{
+			Topic:     tp.Topic,
+			Partition: tp.Partition,
+			Offset:    next,
+		}})
+		if err != nil {
+			state.ctx.Logger().Error("cannot store offset", "partition", tp, "offset", next, "error", err)
+		}
+	}
+
+	if state.paused && state.tracker.inflight() < d.queueSize/2+1 {
+		err := state.ctx.Resume([]TopicPartition{tp})
+		if err != nil {
+			state.ctx.Logger().Error("cannot resume partition", "partition", tp, "error", err)
+			return
+		}
+		state.paused = false
+	}
+}
@@ -0,0 +1,189 @@
+package kafka
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+const (
+	DEFAULT_LOGS_CHANNEL_SIZE = 100
+)
+
+var (
+	_ Logger = new(stdLogger)
+	_ Logger = new(zapLogger)
+	_ Logger = nopLogger{}
+)
+
+var (
+	defaultLogger      Logger = NewStdLogger(log.New(os.Stdout, LOGGER_PREFIX, log.LstdFlags|log.Lmsgprefix))
+	defaultLoggerMutex sync.RWMutex
+)
+
+// Logger is the levelled logger with key/value pairs. *slog.Logger
+// implements Logger as is, and a zap *SugaredLogger can be adapted by
+// NewZapLogger.
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+// ZapSugaredLogger is the subset of the methods of zap *SugaredLogger used
+// by the adapter.
+type ZapSugaredLogger interface {
+	Debugw(msg string, keysAndValues ...interface{})
+	Infow(msg string, keysAndValues ...interface{})
+	Warnw(msg string, keysAndValues ...interface{})
+	Errorw(msg string, keysAndValues ...interface{})
+}
+
+// SetLogger sets the Logger used by the Consumer and the Producer which
+// have no Logger specified. The standard logger writing to stdout is
+// restored if l is nil.
+func SetLogger(l Logger) {
+	if l == nil {
+		l = NewStdLogger(log.New(os.Stdout, LOGGER_PREFIX, log.LstdFlags|log.Lmsgprefix))
+	}
+
+	defaultLoggerMutex.Lock()
+	defer defaultLoggerMutex.Unlock()
+
+	defaultLogger = l
+}
+
+// NewStdLogger writes the entries as "% Level: msg key=value ..." lines.
+func NewStdLogger(l *log.Logger) Logger {
+	return &stdLogger{l}
+}
+
+func NewZapLogger(l ZapSugaredLogger) Logger {
+	return &zapLogger{l}
+}
+
+// NopLogger discards all entries.
+func NopLogger() Logger {
+	return nopLogger{}
+}
+
+type stdLogger struct {
+	handle *log.Logger
+}
+
+func (l *stdLogger) Debug(msg string, keyvals ...interface{}) {
+	l.output("Debug", msg, keyvals)
+}
+
+func (l *stdLogger) Info(msg string, keyvals ...interface{}) {
+	l.output("Notice", msg, keyvals)
+}
+
+func (l *stdLogger) Warn(msg string, keyvals ...interface{}) {
+	l.output("Warn", msg, keyvals)
+}
+
+func (l *stdLogger) Error(msg string, keyvals ...interface{}) {
+	l.output("Error", msg, keyvals)
+}
+
+func (l *stdLogger) output(level string, msg string, keyvals []interface{}) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%% %s: %s", level, msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		if i+1 < len(keyvals) {
+			fmt.Fprintf(&buf, " %v=%v", keyvals[i], keyvals[i+1])
+		} else {
+			fmt.Fprintf(&buf, " %v", keyvals[i])
+		}
+	}
+	l.handle.Println(buf.String())
+}
+
+type zapLogger struct {
+	handle ZapSugaredLogger
+}
+
+func (l *zapLogger) Debug(msg string, keyvals ...interface{}) {
+	l.handle.Debugw(msg, keyvals...)
+}
+
+func (l *zapLogger) Info(msg string, keyvals ...interface{}) {
+	l.handle.Infow(msg, keyvals...)
+}
+
+func (l *zapLogger) Warn(msg string, keyvals ...interface{}) {
+	l.handle.Warnw(msg, keyvals...)
+}
+
+func (l *zapLogger) Error(msg string, keyvals ...interface{}) {
+	l.handle.Errorw(msg, keyvals...)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, keyvals ...interface{}) {}
+func (nopLogger) Info(msg string, keyvals ...interface{})  {}
+func (nopLogger) Warn(msg string, keyvals ...interface{})  {}
+func (nopLogger) Error(msg string, keyvals ...interface{}) {}
+
+// createLogsChannel routes the librdkafka logs into a channel owned by the
+// library if go.logs.channel.enable is set and the application does not
+// provide its own go.logs.channel. The conf must be a copy.
+func createLogsChannel(conf *ConfigMap) chan kafka.LogEvent {
+	v, _ := conf.Get(KAFKA_CONF_GO_LOGS_CHANNEL_ENABLE, false)
+	if enabled, ok := v.(bool); !ok || !enabled {
+		return nil
+	}
+	if _, ok := (*conf)[KAFKA_CONF_GO_LOGS_CHANNEL]; ok {
+		return nil
+	}
+
+	logs := make(chan kafka.LogEvent, DEFAULT_LOGS_CHANNEL_SIZE)
+	(*conf)[KAFKA_CONF_GO_LOGS_CHANNEL] = logs
+	return logs
+}
+
+// forwardLogs writes the librdkafka logs to the Logger until done is closed.
+func forwardLogs(l Logger, logs <-chan kafka.LogEvent, done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case e := <-logs:
+			writeLogEvent(l, e)
+		}
+	}
+}
+
+// writeLogEvent maps the syslog level of the librdkafka log to the Logger.
+func writeLogEvent(l Logger, e kafka.LogEvent) {
+	var keyvals = []interface{}{"name", e.Name, "tag", e.Tag}
+
+	switch {
+	case e.Level <= 3:
+		l.Error(e.Message, keyvals...)
+	case e.Level == 4:
+		l.Warn(e.Message, keyvals...)
+	case e.Level <= 6:
+		l.Info(e.Message, keyvals...)
+	default:
+		l.Debug(e.Message, keyvals...)
+	}
+}
+
+func loggerOrDefault(l Logger) Logger {
+	if l != nil {
+		return l
+	}
+
+	defaultLoggerMutex.RLock()
+	defer defaultLoggerMutex.RUnlock()
+
+	return defaultLogger
+}
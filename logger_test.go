@@ -0,0 +1,144 @@
+package kafka
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+type recordingLogger struct {
+	entries []string
+	mutex   sync.Mutex
+}
+
+func (l *recordingLogger) Debug(msg string, keyvals ...interface{}) { l.record("debug", msg) }
+func (l *recordingLogger) Info(msg string, keyvals ...interface{})  { l.record("info", msg) }
+func (l *recordingLogger) Warn(msg string, keyvals ...interface{})  { l.record("warn", msg) }
+func (l *recordingLogger) Error(msg string, keyvals ...interface{}) { l.record("error", msg) }
+
+func (l *recordingLogger) record(level, msg string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.entries = append(l.entries, level+":"+msg)
+}
+
+func (l *recordingLogger) snapshot() []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]string(nil), l.entries...)
+}
+
+type sugaredLogger struct {
+	entries []string
+}
+
+func (l *sugaredLogger) Debugw(msg string, keysAndValues ...interface{}) { l.record("debug", msg, keysAndValues) }
+func (l *sugaredLogger) Infow(msg string, keysAndValues ...interface{})  { l.record("info", msg, keysAndValues) }
+func (l *sugaredLogger) Warnw(msg string, keysAndValues ...interface{})  { l.record("warn", msg, keysAndValues) }
+func (l *sugaredLogger) Errorw(msg string, keysAndValues ...interface{}) { l.record("error", msg, keysAndValues) }
+
+func (l *sugaredLogger) record(level, msg string, keysAndValues []interface{}) {
+	l.entries = append(l.entries, fmt.Sprintf("%s:%s%v", level, msg, keysAndValues))
+}
+
+func TestStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewStdLogger(log.New(&buf, "", 0))
+
+	l.Error("cannot pause partition", "partition", "gotest[0]", "error", "failed")
+	l.Info("stop polling", "dangling")
+
+	expected := "% Error: cannot pause partition partition=gotest[0] error=failed\n" +
+		"% Notice: stop polling dangling\n"
+	if buf.String() != expected {
+		t.Errorf("assert stdLogger output expect '%v', got '%v'", expected, buf.String())
+	}
+}
+
+func TestSetLogger(t *testing.T) {
+	defer SetLogger(nil)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			SetLogger(NopLogger())
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			loggerOrDefault(nil).Debug("polling")
+		}
+	}()
+	wg.Wait()
+
+	if l := loggerOrDefault(nil); l != NopLogger() {
+		t.Errorf("assert default Logger expect '%v', got '%v'", NopLogger(), l)
+	}
+}
+
+func TestZapLogger(t *testing.T) {
+	sugared := &sugaredLogger{}
+	l := NewZapLogger(sugared)
+
+	l.Debug("a", "k", 1)
+	l.Info("b")
+	l.Warn("c")
+	l.Error("d", "k", 2)
+
+	expected := []string{"debug:a[k 1]", "info:b[]", "warn:c[]", "error:d[k 2]"}
+	if !reflect.DeepEqual(sugared.entries, expected) {
+		t.Errorf("assert zapLogger entries expect '%v', got '%v'", expected, sugared.entries)
+	}
+}
+
+func TestWriteLogEvent(t *testing.T) {
+	l := &recordingLogger{}
+	for level := 0; level <= 7; level++ {
+		writeLogEvent(l, kafka.LogEvent{Level: level, Message: fmt.Sprint(level)})
+	}
+
+	expected := []string{
+		"error:0", "error:1", "error:2", "error:3",
+		"warn:4", "info:5", "info:6", "debug:7",
+	}
+	if !reflect.DeepEqual(l.snapshot(), expected) {
+		t.Errorf("assert entries expect '%v', got '%v'", expected, l.snapshot())
+	}
+}
+
+func TestProducer_LogsChannel(t *testing.T) {
+	l := &recordingLogger{}
+
+	p, err := NewProducer(&ProducerOption{
+		ConfigMap: &ConfigMap{
+			"go.logs.channel.enable": true,
+		},
+		Logger: l,
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer p.Close()
+
+	// librdkafka warns that no bootstrap.servers is configured
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, entry := range l.snapshot() {
+			if strings.Contains(entry, "bootstrap.servers") {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("assert librdkafka logs expect '%v', got '%v'", "bootstrap.servers", l.snapshot())
+}
@@ -0,0 +1,216 @@
+package kafka
+
+import (
+	"sync"
+)
+
+const (
+	DEFAULT_WORKER_POOL_QUEUE_SIZE = 100
+)
+
+var (
+	_ messageDispatcher = new(serialDispatcher)
+	_ messageDispatcher = new(partitionDispatcher)
+	_ messageDispatcher = new(keyDispatcher)
+	_ messageDispatcher = new(batchDispatcher)
+)
+
+type messageDispatcher interface {
+	dispatch(ctx *ConsumeContext, message *Message)
+	// drain blocks until all queued messages of the specified partitions
+	// have been handled.
+	drain(partitions []TopicPartition)
+	close()
+}
+
+type partitionKey struct {
+	topic     string
+	partition int32
+}
+
+func newPartitionKey(tp TopicPartition) partitionKey {
+	var key = partitionKey{
+		partition: tp.Partition,
+	}
+	if tp.Topic != nil {
+		key.topic = *tp.Topic
+	}
+	return key
+}
+
+type serialDispatcher struct {
+	handler MessageHandleProc
+}
+
+func (d *serialDispatcher) dispatch(ctx *ConsumeContext, message *Message) {
+	d.handler(ctx, message)
+}
+
+func (d *serialDispatcher) drain(partitions []TopicPartition) {}
+
+func (d *serialDispatcher) close() {}
+
+type partitionQueue struct {
+	key      partitionKey
+	ctx      *ConsumeContext
+	messages []*Message
+
+	scheduled bool
+	paused    bool
+}
+
+// partitionDispatcher dispatches messages to a bounded pool of workers.
+// Messages of the same partition are handled one by one in order, and the
+// messages of different partitions are handled in parallel.
+type partitionDispatcher struct {
+	handler   MessageHandleProc
+	queueSize int
+
+	queues map[partitionKey]*partitionQueue
+	ready  []*partitionQueue
+
+	wg     sync.WaitGroup
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	closed bool
+}
+
+func newPartitionDispatcher(opt *WorkerPoolOption, handler MessageHandleProc) *partitionDispatcher {
+	var (
+		workers   = opt.Workers
+		queueSize = opt.QueueSize
+	)
+	if workers <= 0 {
+		workers = 1
+	}
+	if queueSize <= 0 {
+		queueSize = DEFAULT_WORKER_POOL_QUEUE_SIZE
+	}
+
+	d := &partitionDispatcher{
+		handler:   handler,
+		queueSize: queueSize,
+		queues:    make(map[partitionKey]*partitionQueue),
+	}
+	d.cond = sync.NewCond(&d.mutex)
+
+	d.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go d.work()
+	}
+	return d
+}
+
+func (d *partitionDispatcher) dispatch(ctx *ConsumeContext, message *Message) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	key := newPartitionKey(message.TopicPartition)
+	q, ok := d.queues[key]
+	if !ok {
+		q = &partitionQueue{
+			key: key,
+			ctx: ctx,
+		}
+		d.queues[key] = q
+	}
+	q.messages = append(q.messages, message)
+
+	if !q.scheduled {
+		q.scheduled = true
+		d.ready = append(d.ready, q)
+		d.cond.Broadcast()
+	}
+
+	// backpressure
+	if !q.paused && len(q.messages) >= d.queueSize {
+		err := q.ctx.Pause([]TopicPartition{message.TopicPartition})
+		if err != nil {
+			q.ctx.Logger().Error("cannot pause partition", "partition", message.TopicPartition, "error", err)
+			return
+		}
+		q.paused = true
+	}
+}
+
+func (d *partitionDispatcher) drain(partitions []TopicPartition) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for _, tp := range partitions {
+		key := newPartitionKey(tp)
+		for {
+			q, ok := d.queues[key]
+			if !ok {
+				break
+			}
+			if !q.scheduled && len(q.messages) == 0 {
+				delete(d.queues, key)
+				break
+			}
+			d.cond.Wait()
+		}
+	}
+}
+
+func (d *partitionDispatcher) close() {
+	d.mutex.Lock()
+	for len(d.queues) > 0 {
+		var partitions []TopicPartition
+		for key := range d.queues {
+			topic := key.topic
+			partitions = append(partitions, TopicPartition{Topic: &topic, Partition: key.partition})
+		}
+		d.mutex.Unlock()
+		d.drain(partitions)
+		d.mutex.Lock()
+	}
+	d.closed = true
+	d.cond.Broadcast()
+	d.mutex.Unlock()
+
+	d.wg.Wait()
+}
+
+func (d *partitionDispatcher) work() {
+	defer d.wg.Done()
+
+	for {
+		d.mutex.Lock()
+		for len(d.ready) == 0 && !d.closed {
+			d.cond.Wait()
+		}
+		if len(d.ready) == 0 {
+			d.mutex.Unlock()
+			return
+		}
+		q := d.ready[0]
+		d.ready[0] = nil
+		d.ready = d.ready[1:]
+
+		message := q.messages[0]
+		q.messages[0] = nil
+		q.messages = q.messages[1:]
+		d.mutex.Unlock()
+
+		d.handler(q.ctx, message)
+
+		d.mutex.Lock()
+		if q.paused && len(q.messages) < d.queueSize/2+1 {
+			err := q.ctx.Resume([]TopicPartition{message.TopicPartition})
+			if err != nil {
+				q.ctx.Logger().Error("cannot resume partition", "partition", message.TopicPartition, "error", err)
+			} else {
+				q.paused = false
+			}
+		}
+		if len(q.messages) > 0 {
+			// requeue the partition for the fairness between partitions
+			d.ready = append(d.ready, q)
+		} else {
+			q.scheduled = false
+		}
+		d.cond.Broadcast()
+		d.mutex.Unlock()
+	}
+}
@@ -0,0 +1,267 @@
+package kafka
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+func TestPartitionDispatcher(t *testing.T) {
+	var (
+		mutex    sync.Mutex
+		received = make(map[int32][]Offset)
+		running  int
+		maxRun   int
+	)
+
+	d := newPartitionDispatcher(&WorkerPoolOption{
+		Workers:   4,
+		QueueSize: 1000,
+	}, func(ctx *ConsumeContext, message *Message) {
+		mutex.Lock()
+		running++
+		if running > maxRun {
+			maxRun = running
+		}
+		mutex.Unlock()
+
+		time.Sleep(time.Millisecond)
+
+		mutex.Lock()
+		running--
+		p := message.TopicPartition.Partition
+		received[p] = append(received[p], message.TopicPartition.Offset)
+		mutex.Unlock()
+	})
+
+	topic := "gotest"
+	ctx := &ConsumeContext{}
+	for i := 0; i < 50; i++ {
+		for p := int32(0); p < 4; p++ {
+			d.dispatch(ctx, &Message{
+				TopicPartition: TopicPartition{Topic: &topic, Partition: p, Offset: Offset(i)},
+			})
+		}
+	}
+	d.drain([]TopicPartition{{Topic: &topic, Partition: 0}})
+
+	mutex.Lock()
+	if len(received[0]) != 50 {
+		t.Errorf("assert drained partition 0 expect '%v' messages, got '%v'", 50, len(received[0]))
+	}
+	mutex.Unlock()
+
+	d.close()
+
+	for p := int32(0); p < 4; p++ {
+		offsets := received[p]
+		if len(offsets) != 50 {
+			t.Errorf("assert partition %d expect '%v' messages, got '%v'", p, 50, len(offsets))
+		}
+		for i, offset := range offsets {
+			if offset != Offset(i) {
+				t.Fatalf("assert partition %d message #%d expect offset '%v', got '%v'", p, i, i, offset)
+			}
+		}
+	}
+	if maxRun < 2 {
+		t.Errorf("assert partitions are handled in parallel, got max concurrency '%v'", maxRun)
+	}
+	if maxRun > 4 {
+		t.Errorf("assert max concurrency expect at most '%v', got '%v'", 4, maxRun)
+	}
+}
+
+func TestKeyDispatcher(t *testing.T) {
+	consumer, err := kafka.NewConsumer(&ConfigMap{
+		"group.id":                 "gotest",
+		"enable.auto.offset.store": false,
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer consumer.Close()
+
+	var (
+		mutex    sync.Mutex
+		received = make(map[string][]Offset)
+	)
+
+	d := newKeyDispatcher(&WorkerPoolOption{
+		Workers:   4,
+		QueueSize: 1000,
+		Ordering:  OrderByKey,
+	}, func(ctx *ConsumeContext, message *Message) {
+		time.Sleep(time.Millisecond)
+
+		mutex.Lock()
+		key := string(message.Key)
+		received[key] = append(received[key], message.TopicPartition.Offset)
+		mutex.Unlock()
+	})
+
+	topic := "gotest"
+	ctx := NewConsumeContext(context.Background(), consumer, consumer)
+	keys := []string{"a", "b", "c", "d", "e", "f"}
+	for i := 0; i < 60; i++ {
+		d.dispatch(ctx, &Message{
+			TopicPartition: TopicPartition{Topic: &topic, Partition: 0, Offset: Offset(i)},
+			Key:            []byte(keys[i%len(keys)]),
+		})
+	}
+	d.drain([]TopicPartition{{Topic: &topic, Partition: 0}})
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	for i, key := range keys {
+		offsets := received[key]
+		if len(offsets) != 10 {
+			t.Errorf("assert key %s expect '%v' messages, got '%v'", key, 10, len(offsets))
+		}
+		for j, offset := range offsets {
+			expected := Offset(j*len(keys) + i)
+			if offset != expected {
+				t.Fatalf("assert key %s message #%d expect offset '%v', got '%v'", key, j, expected, offset)
+			}
+		}
+	}
+	if len(d.partitions) != 0 {
+		t.Errorf("assert drained partitions expect '%v', got '%v'", 0, len(d.partitions))
+	}
+
+	d.close()
+}
+
+func TestBatchDispatcher(t *testing.T) {
+	var (
+		mutex   sync.Mutex
+		batches [][]Offset
+		offsets [][]TopicPartition
+	)
+
+	d := newBatchDispatcher(&BatchOption{
+		MaxMessages: 3,
+		MaxBytes:    10,
+		Linger:      50 * time.Millisecond,
+	}, func(ctx *BatchContext, messages []*Message) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		var batch []Offset
+		for _, m := range messages {
+			batch = append(batch, m.TopicPartition.Offset)
+		}
+		batches = append(batches, batch)
+		offsets = append(offsets, ctx.Offsets())
+	})
+
+	var (
+		topic = "gotest"
+		ctx   = &ConsumeContext{}
+	)
+	dispatch := func(partition int32, offset Offset, value string) {
+		d.dispatch(ctx, &Message{
+			TopicPartition: TopicPartition{Topic: &topic, Partition: partition, Offset: offset},
+			Value:          []byte(value),
+		})
+	}
+
+	// flush by MaxMessages
+	dispatch(0, 0, "a")
+	dispatch(0, 1, "b")
+	dispatch(0, 2, "c")
+	// flush by MaxBytes
+	dispatch(1, 0, "0123456789")
+	// flush by drain
+	dispatch(2, 0, "a")
+	d.drain([]TopicPartition{{Topic: &topic, Partition: 2}})
+	// flush by Linger
+	dispatch(3, 5, "a")
+	time.Sleep(150 * time.Millisecond)
+	// flush by close
+	dispatch(4, 9, "a")
+	d.close()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	expected := [][]Offset{{0, 1, 2}, {0}, {0}, {5}, {9}}
+	if !reflect.DeepEqual(batches, expected) {
+		t.Fatalf("assert batches expect '%v', got '%v'", expected, batches)
+	}
+	if offsets[0][0].Partition != 0 || offsets[0][0].Offset != 3 {
+		t.Errorf("assert BatchContext.Offsets() expect '%v', got '%v'", "gotest[0]@3", offsets[0][0])
+	}
+	if offsets[3][0].Partition != 3 || offsets[3][0].Offset != 6 {
+		t.Errorf("assert BatchContext.Offsets() expect '%v', got '%v'", "gotest[3]@6", offsets[3][0])
+	}
+}
+
+func TestBatchDispatcher_SlowHandler(t *testing.T) {
+	var (
+		lingering = make(chan struct{})
+		release   = make(chan struct{})
+		mutex     sync.Mutex
+		batches   [][]Offset
+	)
+
+	d := newBatchDispatcher(&BatchOption{
+		MaxMessages: 2,
+		Linger:      10 * time.Millisecond,
+	}, func(ctx *BatchContext, messages []*Message) {
+		if tp := messages[0].TopicPartition; tp.Partition == 0 && tp.Offset == 0 {
+			close(lingering)
+			<-release
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		var batch []Offset
+		for _, m := range messages {
+			batch = append(batch, m.TopicPartition.Offset)
+		}
+		batches = append(batches, batch)
+	})
+
+	var (
+		topic = "gotest"
+		ctx   = &ConsumeContext{}
+	)
+	dispatch := func(partition int32, offset Offset) {
+		d.dispatch(ctx, &Message{
+			TopicPartition: TopicPartition{Topic: &topic, Partition: partition, Offset: offset},
+		})
+	}
+
+	// the handler of the lingering batch blocks
+	dispatch(0, 0)
+	<-lingering
+
+	dispatched := make(chan struct{})
+	go func() {
+		defer close(dispatched)
+		dispatch(1, 0)
+		dispatch(0, 1)
+	}()
+	select {
+	case <-dispatched:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected dispatch() not to be blocked by the handler")
+	}
+
+	close(release)
+	d.close()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	// the lingering batch is delivered before the batches flushed later
+	if len(batches) != 3 || !reflect.DeepEqual(batches[0], []Offset{0}) {
+		t.Errorf("assert batches expect '%v' followed by 2 batches, got '%v'", []Offset{0}, batches)
+	}
+}
@@ -0,0 +1,272 @@
+package kafka
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
+)
+
+const (
+	METRICS_CONTENT_TYPE = string(expfmt.FmtText)
+)
+
+var (
+	_ http.Handler         = new(Metrics)
+	_ prometheus.Collector = new(Metrics)
+
+	// DefaultHandlerDurationBuckets are the upper bounds in seconds of the
+	// buckets of the handler latency histogram.
+	DefaultHandlerDurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+)
+
+// Metrics collects the metrics of the Consumers and the Producers sharing
+// it. It is a prometheus.Collector, so it can be registered with a
+// Prometheus registry, e.g. prometheus.MustRegister(metrics), or be served
+// as a scrape endpoint on its own.
+//
+// The collected metrics are
+//
+//	<namespace>_messages_consumed_total{topic,partition}
+//	<namespace>_consumer_lag{topic,partition}
+//	<namespace>_handler_duration_seconds{topic}
+//	<namespace>_handler_retries_total{topic}
+//	<namespace>_dead_letters_total{topic}
+//	<namespace>_messages_produced_total{topic}
+//	<namespace>_delivery_failures_total{topic,code}
+//	<namespace>_delivery_retries_total{topic}
+//	<namespace>_errors_total{code}
+//
+// The following metrics are fed by the librdkafka statistics if
+// statistics.interval.ms is set, and the consumer lag is taken from the
+// statistics as well.
+//
+//	<namespace>_queue_messages{client}
+//	<namespace>_broker_rtt_seconds{broker}
+type Metrics struct {
+	messagesConsumed *prometheus.CounterVec
+	consumerLag      *prometheus.GaugeVec
+	handlerDuration  *prometheus.HistogramVec
+	handlerRetries   *prometheus.CounterVec
+	deadLetters      *prometheus.CounterVec
+	messagesProduced *prometheus.CounterVec
+	deliveryFailures *prometheus.CounterVec
+	deliveryRetries  *prometheus.CounterVec
+	errors           *prometheus.CounterVec
+	queueMessages    *prometheus.GaugeVec
+	brokerRtt        *prometheus.GaugeVec
+
+	// registry gathers the metrics for WriteTo and ServeHTTP
+	registry *prometheus.Registry
+}
+
+func NewMetrics(namespace string) *Metrics {
+	m := &Metrics{
+		messagesConsumed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_consumed_total",
+			Help:      "The number of consumed messages.",
+		}, []string{"topic", "partition"}),
+		consumerLag: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "consumer_lag",
+			Help:      "The number of messages behind the high watermark.",
+		}, []string{"topic", "partition"}),
+		handlerDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "handler_duration_seconds",
+			Help:      "The time taken to handle a message or a batch.",
+			Buckets:   DefaultHandlerDurationBuckets,
+		}, []string{"topic"}),
+		handlerRetries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "handler_retries_total",
+			Help:      "The number of retries of the failed messages.",
+		}, []string{"topic"}),
+		deadLetters: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "dead_letters_total",
+			Help:      "The number of messages sent to the dead-letter topics.",
+		}, []string{"topic"}),
+		messagesProduced: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_produced_total",
+			Help:      "The number of delivered messages.",
+		}, []string{"topic"}),
+		deliveryFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "delivery_failures_total",
+			Help:      "The number of messages which cannot be delivered.",
+		}, []string{"topic", "code"}),
+		deliveryRetries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "delivery_retries_total",
+			Help:      "The number of retries of the failed deliveries.",
+		}, []string{"topic"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "errors_total",
+			Help:      "The number of client errors.",
+		}, []string{"code"}),
+		queueMessages: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "queue_messages",
+			Help:      "The number of messages in the producer queues.",
+		}, []string{"client"}),
+		brokerRtt: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "broker_rtt_seconds",
+			Help:      "The average round-trip time to the broker.",
+		}, []string{"broker"}),
+		registry: prometheus.NewRegistry(),
+	}
+	m.registry.MustRegister(m.collectors()...)
+	return m
+}
+
+// Describe sends the descriptors of the metrics. It implements
+// prometheus.Collector.
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range m.collectors() {
+		c.Describe(ch)
+	}
+}
+
+// Collect sends the current value of every series. It implements
+// prometheus.Collector.
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range m.collectors() {
+		c.Collect(ch)
+	}
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	families, err := m.registry.Gather()
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		buf     bytes.Buffer
+		encoder = expfmt.NewEncoder(&buf, expfmt.FmtText)
+	)
+	for _, family := range families {
+		if err := encoder.Encode(family); err != nil {
+			return 0, err
+		}
+	}
+	return buf.WriteTo(w)
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+func (m *Metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.messagesConsumed,
+		m.consumerLag,
+		m.handlerDuration,
+		m.handlerRetries,
+		m.deadLetters,
+		m.messagesProduced,
+		m.deliveryFailures,
+		m.deliveryRetries,
+		m.errors,
+		m.queueMessages,
+		m.brokerRtt,
+	}
+}
+
+// The following methods are nil-safe, so the Consumer and the Producer
+// record the metrics without checking whether Metrics is specified.
+
+func (m *Metrics) observeConsumed(tp TopicPartition) {
+	if m == nil {
+		return
+	}
+	m.messagesConsumed.WithLabelValues(stringOf(tp.Topic), strconv.Itoa(int(tp.Partition))).Inc()
+}
+
+func (m *Metrics) observeLag(tp TopicPartition, lag int64) {
+	if m == nil {
+		return
+	}
+	if lag < 0 {
+		lag = 0
+	}
+	m.consumerLag.WithLabelValues(stringOf(tp.Topic), strconv.Itoa(int(tp.Partition))).Set(float64(lag))
+}
+
+// deleteLag removes the lag series of the partitions, so the revoked
+// partitions are not reported with their last lag.
+func (m *Metrics) deleteLag(partitions []TopicPartition) {
+	if m == nil {
+		return
+	}
+	for _, tp := range partitions {
+		m.consumerLag.DeleteLabelValues(stringOf(tp.Topic), strconv.Itoa(int(tp.Partition)))
+	}
+}
+
+func (m *Metrics) observeHandlerDuration(tp TopicPartition, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.handlerDuration.WithLabelValues(stringOf(tp.Topic)).Observe(duration.Seconds())
+}
+
+func (m *Metrics) observeHandlerRetry(tp TopicPartition) {
+	if m == nil {
+		return
+	}
+	m.handlerRetries.WithLabelValues(stringOf(tp.Topic)).Inc()
+}
+
+func (m *Metrics) observeDeadLetter(tp TopicPartition) {
+	if m == nil {
+		return
+	}
+	m.deadLetters.WithLabelValues(stringOf(tp.Topic)).Inc()
+}
+
+func (m *Metrics) observeDelivery(tp TopicPartition, err error) {
+	if m == nil {
+		return
+	}
+	if err != nil {
+		m.deliveryFailures.WithLabelValues(stringOf(tp.Topic), errorCodeOf(err).String()).Inc()
+		return
+	}
+	m.messagesProduced.WithLabelValues(stringOf(tp.Topic)).Inc()
+}
+
+func (m *Metrics) observeDeliveryRetry(tp TopicPartition) {
+	if m == nil {
+		return
+	}
+	m.deliveryRetries.WithLabelValues(stringOf(tp.Topic)).Inc()
+}
+
+func (m *Metrics) observeError(err Error) {
+	if m == nil {
+		return
+	}
+	m.errors.WithLabelValues(err.Code().String()).Inc()
+}
+
+func errorCodeOf(err error) ErrorCode {
+	switch e := err.(type) {
+	case Error:
+		return e.Code()
+	case *Error:
+		return e.Code()
+	}
+	return ErrUnknown
+}
@@ -0,0 +1,167 @@
+package kafka
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics_Collect(t *testing.T) {
+	m := NewMetrics("kafka")
+
+	topic := "gotest"
+	tp := TopicPartition{Topic: &topic, Partition: 1, Offset: 10}
+
+	m.observeConsumed(tp)
+	m.observeConsumed(tp)
+	m.observeLag(tp, 5)
+	m.observeHandlerDuration(tp, 20*time.Millisecond)
+	m.observeHandlerRetry(tp)
+	m.observeDeadLetter(tp)
+	m.observeDelivery(tp, nil)
+	m.observeDelivery(tp, NewError(ErrMsgTimedOut, "timed out", false))
+	m.observeError(NewError(ErrTransport, "transport", false))
+
+	// the Metrics can be registered with a Prometheus registry
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(m); err != nil {
+		t.Fatalf("assert Register() expect '%v', got '%v'", nil, err)
+	}
+
+	expected := `
+# HELP kafka_consumer_lag The number of messages behind the high watermark.
+# TYPE kafka_consumer_lag gauge
+kafka_consumer_lag{partition="1",topic="gotest"} 5
+# HELP kafka_dead_letters_total The number of messages sent to the dead-letter topics.
+# TYPE kafka_dead_letters_total counter
+kafka_dead_letters_total{topic="gotest"} 1
+# HELP kafka_delivery_failures_total The number of messages which cannot be delivered.
+# TYPE kafka_delivery_failures_total counter
+kafka_delivery_failures_total{code="` + ErrMsgTimedOut.String() + `",topic="gotest"} 1
+# HELP kafka_errors_total The number of client errors.
+# TYPE kafka_errors_total counter
+kafka_errors_total{code="` + ErrTransport.String() + `"} 1
+# HELP kafka_handler_duration_seconds The time taken to handle a message or a batch.
+# TYPE kafka_handler_duration_seconds histogram
+kafka_handler_duration_seconds_bucket{topic="gotest",le="0.005"} 0
+kafka_handler_duration_seconds_bucket{topic="gotest",le="0.01"} 0
+kafka_handler_duration_seconds_bucket{topic="gotest",le="0.025"} 1
+kafka_handler_duration_seconds_bucket{topic="gotest",le="0.05"} 1
+kafka_handler_duration_seconds_bucket{topic="gotest",le="0.1"} 1
+kafka_handler_duration_seconds_bucket{topic="gotest",le="0.25"} 1
+kafka_handler_duration_seconds_bucket{topic="gotest",le="0.5"} 1
+kafka_handler_duration_seconds_bucket{topic="gotest",le="1"} 1
+kafka_handler_duration_seconds_bucket{topic="gotest",le="2.5"} 1
+kafka_handler_duration_seconds_bucket{topic="gotest",le="5"} 1
+kafka_handler_duration_seconds_bucket{topic="gotest",le="10"} 1
+kafka_handler_duration_seconds_bucket{topic="gotest",le="+Inf"} 1
+kafka_handler_duration_seconds_sum{topic="gotest"} 0.02
+kafka_handler_duration_seconds_count{topic="gotest"} 1
+# HELP kafka_handler_retries_total The number of retries of the failed messages.
+# TYPE kafka_handler_retries_total counter
+kafka_handler_retries_total{topic="gotest"} 1
+# HELP kafka_messages_consumed_total The number of consumed messages.
+# TYPE kafka_messages_consumed_total counter
+kafka_messages_consumed_total{partition="1",topic="gotest"} 2
+# HELP kafka_messages_produced_total The number of delivered messages.
+# TYPE kafka_messages_produced_total counter
+kafka_messages_produced_total{topic="gotest"} 1
+`
+	// the empty families, e.g. kafka_delivery_retries_total, are not exposed
+	err := testutil.GatherAndCompare(registry, strings.NewReader(expected))
+	if err != nil {
+		t.Errorf("assert GatherAndCompare() expect '%v', got '%v'", nil, err)
+	}
+}
+
+func TestMetrics_DeleteLag(t *testing.T) {
+	m := NewMetrics("kafka")
+
+	topic := "gotest"
+	revoked := TopicPartition{Topic: &topic, Partition: 0}
+	assigned := TopicPartition{Topic: &topic, Partition: 1}
+	m.observeLag(revoked, 5)
+	m.observeLag(assigned, 3)
+
+	m.deleteLag([]TopicPartition{revoked})
+	if n := testutil.CollectAndCount(m.consumerLag); n != 1 {
+		t.Errorf("assert consumer_lag series expect '%v', got '%v'", 1, n)
+	}
+	if v := testutil.ToFloat64(m.consumerLag.WithLabelValues(topic, "1")); v != 3 {
+		t.Errorf("assert consumer_lag of partition 1 expect '%v', got '%v'", 3, v)
+	}
+}
+
+func TestMetrics_WriteTo(t *testing.T) {
+	m := NewMetrics("kafka")
+
+	topic := "gotest"
+	m.observeConsumed(TopicPartition{Topic: &topic, Partition: 1})
+
+	var buf bytes.Buffer
+	_, err := m.WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	for _, expected := range []string{
+		"# TYPE kafka_messages_consumed_total counter\n",
+		`kafka_messages_consumed_total{partition="1",topic="gotest"} 1` + "\n",
+	} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("assert Metrics.WriteTo() expect '%s', got '%s'", expected, buf.String())
+		}
+	}
+}
+
+func TestMetrics_EscapeLabelValue(t *testing.T) {
+	m := NewMetrics("")
+
+	topic := "a\"b\\c\nd"
+	m.observeDeadLetter(TopicPartition{Topic: &topic})
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	expected := `dead_letters_total{topic="a\"b\\c\nd"} 1`
+	if !strings.Contains(rec.Body.String(), expected) {
+		t.Errorf("assert Metrics.ServeHTTP() expect '%s', got '%s'", expected, rec.Body.String())
+	}
+	if rec.Header().Get("Content-Type") != METRICS_CONTENT_TYPE {
+		t.Errorf("assert Content-Type expect '%v', got '%v'", METRICS_CONTENT_TYPE, rec.Header().Get("Content-Type"))
+	}
+}
+
+func TestProducer_Metrics(t *testing.T) {
+	m := NewMetrics("kafka")
+
+	p, err := NewProducer(&ProducerOption{
+		ConfigMap: &ConfigMap{
+			"socket.timeout.ms":  10,
+			"message.timeout.ms": 10,
+		},
+		Metrics: m,
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer p.Close()
+
+	topic := "gotest"
+	p.WriteAndWait(context.Background(), &Message{
+		TopicPartition: TopicPartition{Topic: &topic, Partition: 0},
+	})
+
+	var buf bytes.Buffer
+	m.WriteTo(&buf)
+	expected := `kafka_delivery_failures_total{code="` + ErrMsgTimedOut.String() + `",topic="gotest"} 1`
+	if !strings.Contains(buf.String(), expected) {
+		t.Errorf("assert Metrics.WriteTo() expect '%s', got '%s'", expected, buf.String())
+	}
+}
@@ -0,0 +1,147 @@
+package kafka
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Middleware decorates a MessageHandleProc with cross-cutting behaviour.
+type Middleware func(next MessageHandleProc) MessageHandleProc
+
+// Chain composes the middlewares into one; the first middleware is the
+// outermost, e.g. Chain(mw1, mw2)(handler) runs mw1, mw2 and then handler.
+func Chain(middlewares ...Middleware) Middleware {
+	return func(next MessageHandleProc) MessageHandleProc {
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			next = middlewares[i](next)
+		}
+		return next
+	}
+}
+
+// LoggingMiddleware logs the coordinates of every message and the time
+// taken to handle it.
+func LoggingMiddleware() Middleware {
+	return func(next MessageHandleProc) MessageHandleProc {
+		return func(ctx *ConsumeContext, message *Message) {
+			start := time.Now()
+			next(ctx, message)
+			ctx.Logger().Info("message handled", "partition", message.TopicPartition, "elapsed", time.Since(start))
+		}
+	}
+}
+
+// RecoverMiddleware recovers the panic of the handler, logs it with the
+// stack trace and forwards the message through
+// ConsumeContext.ForwardUnhandledMessage.
+func RecoverMiddleware() Middleware {
+	return func(next MessageHandleProc) MessageHandleProc {
+		return func(ctx *ConsumeContext, message *Message) {
+			defer func() {
+				if r := recover(); r != nil {
+					ctx.Logger().Error("panic on handling message", "partition", message.TopicPartition, "panic", r, "stack", string(debug.Stack()))
+					ctx.ForwardUnhandledMessage(message)
+				}
+			}()
+			next(ctx, message)
+		}
+	}
+}
+
+// TimeoutMiddleware bounds the context of ConsumeContext with the timeout.
+// The handler should watch ConsumeContext.Context() to give up in time.
+func TimeoutMiddleware(timeout time.Duration) Middleware {
+	return func(next MessageHandleProc) MessageHandleProc {
+		return func(ctx *ConsumeContext, message *Message) {
+			timeoutCtx, cancel := context.WithTimeout(ctx.Context(), timeout)
+			defer cancel()
+
+			next(ctx.withContext(timeoutCtx), message)
+		}
+	}
+}
+
+// DedupMiddleware skips the messages whose id has been handled among the
+// latest capacity messages, e.g. the messages redelivered after a
+// rebalance. The id is recorded only after the handler returns without
+// panicking, so the retries of a failed message are not skipped. The id of
+// a message is its coordinates if idOf is nil.
+func DedupMiddleware(capacity int, idOf func(message *Message) string) Middleware {
+	if idOf == nil {
+		idOf = func(message *Message) string {
+			tp := message.TopicPartition
+			return fmt.Sprintf("%s[%d]@%d", stringOf(tp.Topic), tp.Partition, tp.Offset)
+		}
+	}
+	seen := newRecentSet(capacity)
+
+	return func(next MessageHandleProc) MessageHandleProc {
+		return func(ctx *ConsumeContext, message *Message) {
+			id := idOf(message)
+			if seen.contains(id) {
+				return
+			}
+			next(ctx, message)
+			seen.add(id)
+		}
+	}
+}
+
+// recentSet keeps the latest capacity ids.
+type recentSet struct {
+	capacity int
+	ids      map[string]*list.Element
+	order    *list.List
+	mutex    sync.Mutex
+}
+
+func newRecentSet(capacity int) *recentSet {
+	return &recentSet{
+		capacity: capacity,
+		ids:      make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// contains reports whether the id has been added, and marks it as the
+// latest one if so.
+func (s *recentSet) contains(id string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if e, ok := s.ids[id]; ok {
+		s.order.MoveToFront(e)
+		return true
+	}
+	return false
+}
+
+// add returns false if the id has been added.
+func (s *recentSet) add(id string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if e, ok := s.ids[id]; ok {
+		s.order.MoveToFront(e)
+		return false
+	}
+
+	s.ids[id] = s.order.PushFront(id)
+	for s.order.Len() > s.capacity {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.ids, oldest.Value.(string))
+	}
+	return true
+}
+
+func stringOf(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
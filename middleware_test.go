@@ -0,0 +1,112 @@
+package kafka
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestChain(t *testing.T) {
+	var calls []string
+
+	middlewareOf := func(name string) Middleware {
+		return func(next MessageHandleProc) MessageHandleProc {
+			return func(ctx *ConsumeContext, message *Message) {
+				calls = append(calls, name+">")
+				next(ctx, message)
+				calls = append(calls, "<"+name)
+			}
+		}
+	}
+
+	handler := Chain(middlewareOf("mw1"), middlewareOf("mw2"))(func(ctx *ConsumeContext, message *Message) {
+		calls = append(calls, "handler")
+	})
+	handler(&ConsumeContext{}, &Message{})
+
+	expected := []string{"mw1>", "mw2>", "handler", "<mw2", "<mw1"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("assert calls expect '%v', got '%v'", expected, calls)
+	}
+}
+
+func TestRecoverMiddleware(t *testing.T) {
+	var unhandled int
+
+	handler := RecoverMiddleware()(func(ctx *ConsumeContext, message *Message) {
+		panic("boom")
+	})
+	handler(&ConsumeContext{
+		unhandledMessageHandler: func(ctx *ConsumeContext, message *Message) {
+			unhandled++
+		},
+	}, &Message{})
+
+	if unhandled != 1 {
+		t.Errorf("assert unhandled messages expect '%v', got '%v'", 1, unhandled)
+	}
+}
+
+func TestTimeoutMiddleware(t *testing.T) {
+	var hasDeadline bool
+
+	handler := TimeoutMiddleware(time.Second)(func(ctx *ConsumeContext, message *Message) {
+		_, hasDeadline = ctx.Context().Deadline()
+	})
+	handler(&ConsumeContext{}, &Message{})
+
+	if !hasDeadline {
+		t.Error("Expected the context to have a deadline")
+	}
+}
+
+func TestDedupMiddleware(t *testing.T) {
+	var handled []Offset
+
+	handler := DedupMiddleware(2, nil)(func(ctx *ConsumeContext, message *Message) {
+		handled = append(handled, message.TopicPartition.Offset)
+	})
+
+	topic := "gotest"
+	for _, offset := range []Offset{1, 2, 2, 3, 1} {
+		handler(&ConsumeContext{}, &Message{
+			TopicPartition: TopicPartition{Topic: &topic, Partition: 0, Offset: offset},
+		})
+	}
+
+	// offset 1 is evicted by offset 3
+	expected := []Offset{1, 2, 3, 1}
+	if !reflect.DeepEqual(handled, expected) {
+		t.Errorf("assert handled offsets expect '%v', got '%v'", expected, handled)
+	}
+}
+
+func TestDedupMiddleware_Retry(t *testing.T) {
+	var attempts int
+
+	handler := DedupMiddleware(2, nil)(func(ctx *ConsumeContext, message *Message) {
+		attempts++
+		if attempts == 1 {
+			panic("transient failure")
+		}
+	})
+
+	topic := "gotest"
+	message := &Message{
+		TopicPartition: TopicPartition{Topic: &topic, Partition: 0, Offset: 1},
+	}
+	func() {
+		defer func() {
+			recover()
+		}()
+		handler(&ConsumeContext{}, message)
+	}()
+
+	// the retry of the panicked message is handled, and its redelivery is
+	// skipped
+	handler(&ConsumeContext{}, message)
+	handler(&ConsumeContext{}, message)
+	if attempts != 2 {
+		t.Errorf("assert attempts expect '%v', got '%v'", 2, attempts)
+	}
+}
@@ -0,0 +1,65 @@
+package kafka
+
+import (
+	"sort"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+// offsetTracker tracks the messages of a partition which may complete out
+// of order, and reports the highest contiguous offset whose messages have
+// all completed.
+type offsetTracker struct {
+	pending   []Offset
+	completed map[Offset]int
+	committed Offset
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{
+		completed: make(map[Offset]int),
+		committed: kafka.OffsetInvalid,
+	}
+}
+
+// track registers an offset which is in flight. The offsets are tracked in
+// ascending order unless the partition is rewound, e.g. by a seek, in which
+// case the offsets delivered again are tracked along with the ones still in
+// flight.
+func (t *offsetTracker) track(offset Offset) {
+	i := sort.Search(len(t.pending), func(i int) bool {
+		return t.pending[i] > offset
+	})
+	t.pending = append(t.pending, 0)
+	copy(t.pending[i+1:], t.pending[i:])
+	t.pending[i] = offset
+}
+
+// complete marks the offset as completed, and returns the next offset to
+// commit if the contiguous completed range advances. The next offset never
+// goes below the one reported before, so the rewound offsets do not move
+// the committed offset backwards.
+func (t *offsetTracker) complete(offset Offset) (next Offset, advanced bool) {
+	t.completed[offset]++
+
+	for len(t.pending) > 0 {
+		head := t.pending[0]
+		if t.completed[head] == 0 {
+			break
+		}
+		t.completed[head]--
+		if t.completed[head] == 0 {
+			delete(t.completed, head)
+		}
+		t.pending = t.pending[1:]
+		if head+1 > t.committed {
+			t.committed = head + 1
+			advanced = true
+		}
+	}
+	return t.committed, advanced
+}
+
+func (t *offsetTracker) inflight() int {
+	return len(t.pending)
+}
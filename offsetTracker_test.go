@@ -0,0 +1,75 @@
+package kafka
+
+import "testing"
+
+func TestOffsetTracker(t *testing.T) {
+	tracker := newOffsetTracker()
+	for _, offset := range []Offset{10, 11, 12, 13, 14} {
+		tracker.track(offset)
+	}
+
+	cases := []struct {
+		complete         Offset
+		expectedNext     Offset
+		expectedAdvanced bool
+	}{
+		{12, OffsetInvalid, false},
+		{11, OffsetInvalid, false},
+		{10, 13, true},
+		{14, 13, false},
+		{13, 15, true},
+	}
+
+	for _, c := range cases {
+		next, advanced := tracker.complete(c.complete)
+		if advanced != c.expectedAdvanced {
+			t.Errorf("assert complete(%d) advanced expect '%v', got '%v'", c.complete, c.expectedAdvanced, advanced)
+		}
+		if advanced && next != c.expectedNext {
+			t.Errorf("assert complete(%d) next expect '%v', got '%v'", c.complete, c.expectedNext, next)
+		}
+	}
+
+	if tracker.inflight() != 0 {
+		t.Errorf("assert inflight expect '%v', got '%v'", 0, tracker.inflight())
+	}
+}
+
+func TestOffsetTracker_Rewind(t *testing.T) {
+	tracker := newOffsetTracker()
+	for _, offset := range []Offset{10, 11, 12} {
+		tracker.track(offset)
+	}
+	tracker.complete(10)
+	tracker.complete(11)
+
+	// the partition is rewound to 10 while 12 is in flight
+	for _, offset := range []Offset{10, 11, 12} {
+		tracker.track(offset)
+	}
+
+	cases := []struct {
+		complete         Offset
+		expectedNext     Offset
+		expectedAdvanced bool
+	}{
+		{10, 12, false},
+		{11, 12, false},
+		{12, 13, true},
+		{12, 13, false},
+	}
+
+	for _, c := range cases {
+		next, advanced := tracker.complete(c.complete)
+		if advanced != c.expectedAdvanced {
+			t.Errorf("assert complete(%d) advanced expect '%v', got '%v'", c.complete, c.expectedAdvanced, advanced)
+		}
+		if next != c.expectedNext {
+			t.Errorf("assert complete(%d) next expect '%v', got '%v'", c.complete, c.expectedNext, next)
+		}
+	}
+
+	if tracker.inflight() != 0 {
+		t.Errorf("assert inflight expect '%v', got '%v'", 0, tracker.inflight())
+	}
+}
@@ -0,0 +1,141 @@
+package kafka
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+const (
+	// PanicDecisionSkip drops the message as if it has been handled.
+	PanicDecisionSkip PanicDecision = iota
+	// PanicDecisionRetry retries the message with the RetryPolicy, or
+	// rewinds the partition to the first message of a batch.
+	PanicDecisionRetry
+	// PanicDecisionDeadLetter gives up the message right away, and sends it
+	// to the retry topics or the DeadLetter topic if they are specified.
+	PanicDecisionDeadLetter
+	// PanicDecisionStopConsumer stops the underlying consumer of the
+	// message's partition, skips its final commit, and makes Run return the
+	// PanicError. The other underlying consumers keep running until the
+	// Consumer is closed. The auto commit still commits the offsets stored
+	// before, which include the offset of the message itself unless
+	// enable.auto.offset.store is disabled, so the message is consumed again
+	// only if its offset is stored once it is handled.
+	PanicDecisionStopConsumer
+)
+
+var errConsumeLoopStopped = fmt.Errorf("the underlying consumer has been stopped")
+
+type PanicDecision int
+
+func (d PanicDecision) String() string {
+	switch d {
+	case PanicDecisionSkip:
+		return "Skip"
+	case PanicDecisionRetry:
+		return "Retry"
+	case PanicDecisionDeadLetter:
+		return "DeadLetter"
+	case PanicDecisionStopConsumer:
+		return "StopConsumer"
+	}
+	return "Unknown"
+}
+
+// PanicError is the panic recovered from a handler.
+type PanicError struct {
+	TopicPartition TopicPartition
+	Value          interface{}
+	Stack          []byte
+}
+
+func newPanicError(message *Message, value interface{}) *PanicError {
+	return &PanicError{
+		TopicPartition: message.TopicPartition,
+		Value:          value,
+		Stack:          debug.Stack(),
+	}
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic on handling %s: %v", e.TopicPartition, e.Value)
+}
+
+// decidePanic reports the panic to the PanicHandler, and stops polling the
+// partition of the message and reports the panic to Run if the Consumer is
+// going to be stopped.
+func (c *Consumer) decidePanic(ctx *ConsumeContext, message *Message, err *PanicError) PanicDecision {
+	var decision = PanicDecisionStopConsumer
+	if c.PanicHandler != nil {
+		decision = c.PanicHandler(ctx, message, err)
+	} else {
+		ctx.Logger().Error("panic on handling message", "partition", err.TopicPartition, "panic", err.Value, "stack", string(err.Stack))
+	}
+
+	if decision == PanicDecisionStopConsumer {
+		ctx.stopConsumeLoop()
+		c.reportFatalError(err)
+	}
+	return decision
+}
+
+// recoverMessagePanic converts the panic of handling the message into the
+// error to apply to the message. It must be deferred directly.
+func (c *Consumer) recoverMessagePanic(ctx *ConsumeContext, message *Message, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	panicErr := newPanicError(message, r)
+	switch c.decidePanic(ctx, message, panicErr) {
+	case PanicDecisionSkip:
+		*err = nil
+	case PanicDecisionRetry:
+		*err = panicErr
+	case PanicDecisionDeadLetter:
+		*err = Permanent(panicErr)
+	default:
+		*err = errConsumeLoopStopped
+	}
+}
+
+// recoverBatchPanic applies the decision on the panic of handling the batch.
+// It must be deferred directly.
+func (c *Consumer) recoverBatchPanic(ctx *BatchContext, messages []*Message) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	c.handleBatchPanic(ctx, messages, r, func(*PanicError) {
+		err := ctx.Seek(messages[0].TopicPartition, DEFAULT_PROCESSOR_SEEK_TIMEOUT_MS)
+		if err != nil {
+			ctx.Logger().Error("cannot rewind partition", "partition", messages[0].TopicPartition, "error", err)
+		}
+	})
+}
+
+// handleBatchPanic applies the decision on the recovered panic of handling
+// the batch, and calls rewind to retry the batch.
+func (c *Consumer) handleBatchPanic(ctx *BatchContext, messages []*Message, r interface{}, rewind func(err *PanicError)) {
+	panicErr := newPanicError(messages[0], r)
+	switch c.decidePanic(ctx.ConsumeContext, messages[0], panicErr) {
+	case PanicDecisionSkip:
+		c.storeOffset(ctx.ConsumeContext, messages[len(messages)-1])
+	case PanicDecisionRetry:
+		rewind(panicErr)
+	case PanicDecisionDeadLetter:
+		for _, message := range messages {
+			c.giveUpMessage(ctx.ConsumeContext, message, panicErr, 1)
+		}
+	}
+}
+
+// recoverLoopPanic keeps the panic raised by polling from crashing the
+// process. The deferred cleanup of the consumeLoop has run at this point.
+func (c *Consumer) recoverLoopPanic() {
+	if r := recover(); r != nil {
+		c.logger().Error("panic on polling", "panic", r, "stack", string(debug.Stack()))
+	}
+}
@@ -0,0 +1,97 @@
+package kafka
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConsumer_PanicHandler(t *testing.T) {
+	cases := []struct {
+		decision          PanicDecision
+		expectedCalls     int
+		expectedUnhandled int
+		expectedStopped   bool
+	}{
+		{PanicDecisionSkip, 1, 0, false},
+		{PanicDecisionRetry, 3, 1, false},
+		{PanicDecisionDeadLetter, 1, 1, false},
+		{PanicDecisionStopConsumer, 1, 0, true},
+	}
+
+	topic := "gotest"
+	for _, tc := range cases {
+		var (
+			calls     int
+			unhandled int
+			stopped   bool
+			reported  *PanicError
+		)
+
+		c := &Consumer{
+			RetryPolicy: &RetryPolicy{
+				MaxAttempts:    3,
+				InitialBackoff: time.Millisecond,
+			},
+			MessageHandler: func(ctx *ConsumeContext, message *Message) {
+				calls++
+				panic("boom")
+			},
+			PanicHandler: func(ctx *ConsumeContext, message *Message, err *PanicError) PanicDecision {
+				reported = err
+				return tc.decision
+			},
+		}
+		ctx := &ConsumeContext{
+			unhandledMessageHandler: func(ctx *ConsumeContext, message *Message) {
+				unhandled++
+			},
+			stop: func() {
+				stopped = true
+			},
+		}
+
+		c.handleMessage(ctx, &Message{
+			TopicPartition: TopicPartition{Topic: &topic, Partition: 1, Offset: 5},
+		}, true)
+
+		if calls != tc.expectedCalls {
+			t.Errorf("assert %v handler calls expect '%v', got '%v'", tc.decision, tc.expectedCalls, calls)
+		}
+		if unhandled != tc.expectedUnhandled {
+			t.Errorf("assert %v unhandled messages expect '%v', got '%v'", tc.decision, tc.expectedUnhandled, unhandled)
+		}
+		if stopped != tc.expectedStopped {
+			t.Errorf("assert %v stopped expect '%v', got '%v'", tc.decision, tc.expectedStopped, stopped)
+		}
+		if reported == nil || reported.Value != "boom" || reported.TopicPartition.Offset != 5 || len(reported.Stack) == 0 {
+			t.Errorf("assert %v PanicError expect '%v', got '%+v'", tc.decision, "boom", reported)
+		}
+	}
+}
+
+func TestConsumer_BatchPanicHandler(t *testing.T) {
+	var stopped bool
+
+	c := &Consumer{
+		BatchHandler: func(ctx *BatchContext, messages []*Message) {
+			panic("boom")
+		},
+	}
+
+	topic := "gotest"
+	messages := []*Message{
+		{TopicPartition: TopicPartition{Topic: &topic, Partition: 0, Offset: 1}},
+	}
+	c.processBatch(&BatchContext{
+		ConsumeContext: &ConsumeContext{
+			stop: func() {
+				stopped = true
+			},
+		},
+		messages: messages,
+	}, messages)
+
+	if !stopped {
+		t.Error("Expected the underlying consumer to be stopped without PanicHandler")
+	}
+}
@@ -0,0 +1,61 @@
+package kafka
+
+import "sync"
+
+// partitionWaitGroup waits for the goroutines working on partitions.
+type partitionWaitGroup struct {
+	counts map[partitionKey]int
+	mutex  sync.Mutex
+	cond   *sync.Cond
+}
+
+func newPartitionWaitGroup() *partitionWaitGroup {
+	g := &partitionWaitGroup{
+		counts: make(map[partitionKey]int),
+	}
+	g.cond = sync.NewCond(&g.mutex)
+	return g
+}
+
+func (g *partitionWaitGroup) goRun(tp TopicPartition, fn func()) {
+	key := newPartitionKey(tp)
+
+	g.mutex.Lock()
+	g.counts[key]++
+	g.mutex.Unlock()
+
+	go func() {
+		defer func() {
+			g.mutex.Lock()
+			g.counts[key]--
+			if g.counts[key] == 0 {
+				delete(g.counts, key)
+			}
+			g.cond.Broadcast()
+			g.mutex.Unlock()
+		}()
+
+		fn()
+	}()
+}
+
+func (g *partitionWaitGroup) wait(partitions []TopicPartition) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	for _, tp := range partitions {
+		key := newPartitionKey(tp)
+		for g.counts[key] > 0 {
+			g.cond.Wait()
+		}
+	}
+}
+
+func (g *partitionWaitGroup) waitAll() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	for len(g.counts) > 0 {
+		g.cond.Wait()
+	}
+}
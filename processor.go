@@ -0,0 +1,256 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_PROCESSOR_SEEK_TIMEOUT_MS = 10000
+	DEFAULT_PROCESSOR_MAX_ATTEMPTS    = 10
+)
+
+var defaultProcessorRetryPolicy = &RetryPolicy{
+	MaxAttempts: DEFAULT_PROCESSOR_MAX_ATTEMPTS,
+}
+
+// Processor consumes the messages in batches, transforms them with the
+// Transformer, and produces the results through the transactional Producer.
+// The produced messages and the consumed offsets of each batch are committed
+// in one transaction. If the transaction fails, it is aborted, the partition
+// is paused for the backoff of the RetryPolicy, and then rewound to the first
+// message of the batch, so the batch is consumed again. The messages of the
+// partition polled before the rewind are skipped.
+type Processor struct {
+	// Consumer is subscribed by the Processor, and its BatchHandler is
+	// replaced. The Consumer commits no offsets on its own.
+	Consumer    *Consumer
+	Producer    *Producer
+	Transformer TransformProc
+	// RetryPolicy bounds the attempts and the backoff of a failing batch.
+	// Once the attempts are exhausted, or the error is Permanent, the
+	// partition stays paused and the Consumer stops with the error. It is
+	// DEFAULT_PROCESSOR_MAX_ATTEMPTS attempts with the default backoff if
+	// nil.
+	RetryPolicy *RetryPolicy
+
+	partitions map[partitionKey]*processorPartition
+	mutex      sync.Mutex
+}
+
+// processorPartition is the state of a partition whose batch has failed.
+type processorPartition struct {
+	attempts int
+	// rewinding is set until the partition is read again from the offset
+	rewinding bool
+	offset    Offset
+}
+
+func (p *Processor) Subscribe(topics []string, rebalanceCb RebalanceCb) error {
+	if p.Producer == nil || !p.Producer.transactional {
+		return fmt.Errorf("the Processor requires a transactional Producer")
+	}
+	if p.Transformer == nil {
+		return fmt.Errorf("the Processor requires a Transformer")
+	}
+
+	p.partitions = make(map[partitionKey]*processorPartition)
+	p.Consumer.BatchHandler = p.processBatch
+	p.Consumer.transactional = true
+	return p.Consumer.Subscribe(topics, rebalanceCb)
+}
+
+func (p *Processor) Run(ctx context.Context) error {
+	return p.Consumer.Run(ctx)
+}
+
+func (p *Processor) Close() {
+	p.Consumer.Close()
+}
+
+func (p *Processor) processBatch(ctx *BatchContext, messages []*Message) {
+	// the transactions of a Producer cannot be interleaved
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	messages = p.skipRewound(messages)
+	if len(messages) == 0 {
+		return
+	}
+	ctx = &BatchContext{
+		ConsumeContext: ctx.ConsumeContext,
+		messages:       messages,
+	}
+
+	var first = messages[0].TopicPartition
+	defer func() {
+		// the transaction has been aborted, so the batch which panicked is
+		// rewound like a failed one
+		if r := recover(); r != nil {
+			p.Consumer.handleBatchPanic(ctx, messages, r, func(err *PanicError) {
+				p.retryBatch(ctx, first, err)
+			})
+		}
+	}()
+
+	err := p.executeTransaction(ctx, messages)
+	if err == nil {
+		delete(p.partitions, newPartitionKey(first))
+		return
+	}
+	ctx.Logger().Error("cannot process batch", "partition", first, "error", err)
+	p.retryBatch(ctx, first, err)
+}
+
+// retryBatch rewinds the partition to the failed batch, or stalls it once
+// the attempts are exhausted.
+func (p *Processor) retryBatch(ctx *BatchContext, first TopicPartition, err error) {
+	var key = newPartitionKey(first)
+
+	state, ok := p.partitions[key]
+	if !ok {
+		state = &processorPartition{}
+		p.partitions[key] = state
+	}
+	state.attempts++
+	// skip the following messages until the partition is read again from
+	// the failed batch
+	state.rewinding = true
+	state.offset = first.Offset
+
+	if txnErr, ok := err.(*TransactionError); ok && txnErr.IsFatal() {
+		p.stall(ctx, first, err)
+		return
+	}
+	if !p.retryPolicy().shouldRetry(err, state.attempts) {
+		ctx.Logger().Error("give up batch", "partition", first, "attempts", state.attempts, "error", err)
+		p.stall(ctx, first, err)
+		return
+	}
+	p.rewind(ctx, first, p.retryPolicy().backoff(state.attempts))
+}
+
+func (p *Processor) executeTransaction(ctx *BatchContext, messages []*Message) error {
+	var producer = p.Producer
+
+	err := producer.BeginTransaction()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// abort the transaction before the panic is recovered by the Consumer
+		if r := recover(); r != nil {
+			if abortErr := p.abortTransaction(); abortErr != nil {
+				ctx.Logger().Error("cannot abort the transaction", "error", abortErr)
+			}
+			panic(r)
+		}
+	}()
+
+	outputs, err := p.Transformer(ctx, messages)
+	if err != nil {
+		if abortErr := p.abortTransaction(); abortErr != nil {
+			return abortErr
+		}
+		return err
+	}
+
+	for _, message := range outputs {
+		err = producer.produce(message, &deliveryEnvelope{})
+		if err != nil {
+			if abortErr := p.abortTransaction(); abortErr != nil {
+				return abortErr
+			}
+			return err
+		}
+	}
+
+	metadata, err := ctx.GetConsumerGroupMetadata()
+	if err != nil {
+		if abortErr := p.abortTransaction(); abortErr != nil {
+			return abortErr
+		}
+		return err
+	}
+
+	err = producer.SendOffsetsToTransaction(ctx.Context(), ctx.Offsets(), metadata)
+	if err != nil {
+		return err
+	}
+	return producer.CommitTransaction(ctx.Context())
+}
+
+func (p *Processor) abortTransaction() error {
+	return p.Producer.abortTransactionWithTimeout()
+}
+
+// rewind pauses the partition, and seeks it back to the first message of
+// the failed batch after the backoff. The rewind is abandoned if the
+// partition is revoked in the meantime.
+func (p *Processor) rewind(ctx *BatchContext, first TopicPartition, backoff time.Duration) {
+	var (
+		c          = p.Consumer
+		partitions = []TopicPartition{{Topic: first.Topic, Partition: first.Partition}}
+	)
+	if err := ctx.Pause(partitions); err != nil {
+		ctx.Logger().Error("cannot pause partition", "partition", first, "error", err)
+	}
+
+	c.retries.goRun(first, func() {
+		defer ctx.Resume(partitions)
+
+		if !c.sleep(ctx.ConsumeContext, backoff) {
+			p.mutex.Lock()
+			delete(p.partitions, newPartitionKey(first))
+			p.mutex.Unlock()
+			return
+		}
+
+		err := ctx.Seek(first, DEFAULT_PROCESSOR_SEEK_TIMEOUT_MS)
+		if err != nil {
+			// the partition keeps skipping the messages
+			ctx.Logger().Error("cannot rewind partition", "partition", first, "error", err)
+			c.reportFatalError(err)
+		}
+	})
+}
+
+// stall pauses the partition of the batch which cannot be processed, and
+// stops the Consumer, so no offset past the batch is committed.
+func (p *Processor) stall(ctx *BatchContext, first TopicPartition, err error) {
+	var partitions = []TopicPartition{{Topic: first.Topic, Partition: first.Partition}}
+	if pauseErr := ctx.Pause(partitions); pauseErr != nil {
+		ctx.Logger().Error("cannot pause partition", "partition", first, "error", pauseErr)
+	}
+	p.Consumer.reportFatalError(err)
+}
+
+// skipRewound drops the messages of a rewinding partition which were polled
+// before the rewind, until the partition is read again from the offset of
+// the failed batch.
+func (p *Processor) skipRewound(messages []*Message) []*Message {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	state, ok := p.partitions[newPartitionKey(messages[0].TopicPartition)]
+	if !ok || !state.rewinding {
+		return messages
+	}
+	for i, m := range messages {
+		if m.TopicPartition.Offset == state.offset {
+			state.rewinding = false
+			return messages[i:]
+		}
+	}
+	return nil
+}
+
+func (p *Processor) retryPolicy() *RetryPolicy {
+	if p.RetryPolicy != nil {
+		return p.RetryPolicy
+	}
+	return defaultProcessorRetryPolicy
+}
@@ -0,0 +1,55 @@
+package kafka
+
+import (
+	"testing"
+)
+
+func TestProcessor_WithoutTransactionalProducer(t *testing.T) {
+	p, err := NewProducer(&ProducerOption{
+		ConfigMap: &ConfigMap{
+			"socket.timeout.ms":  10,
+			"message.timeout.ms": 10,
+		},
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer p.Close()
+
+	processor := &Processor{
+		Consumer: &Consumer{
+			ConfigMap: &ConfigMap{
+				"group.id": "gotest",
+			},
+		},
+		Producer: p,
+		Transformer: func(ctx *BatchContext, messages []*Message) ([]*Message, error) {
+			return messages, nil
+		},
+	}
+	err = processor.Subscribe([]string{"gotest"}, nil)
+	if err == nil {
+		t.Fatal("Expected Processor.Subscribe() to fail without transactional Producer")
+	}
+}
+
+func TestConsumer_CreateTransactionalConfigMap(t *testing.T) {
+	c := &Consumer{
+		ConfigMap: &ConfigMap{
+			"group.id":           "gotest",
+			"enable.auto.commit": true,
+		},
+		transactional: true,
+	}
+
+	conf := c.createConfigMap()
+	for _, key := range []string{KAFKA_CONF_ENABLE_AUTO_COMMIT, KAFKA_CONF_ENABLE_AUTO_OFFSET_STORE} {
+		v, _ := conf.Get(key, nil)
+		if v != false {
+			t.Errorf("assert ConfigMap[%s] expect '%v', got '%v'", key, false, v)
+		}
+	}
+	if v := (*c.ConfigMap)[KAFKA_CONF_ENABLE_AUTO_COMMIT]; v != true {
+		t.Errorf("assert Consumer.ConfigMap[%s] expect '%v', got '%v'", KAFKA_CONF_ENABLE_AUTO_COMMIT, true, v)
+	}
+}
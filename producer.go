@@ -1,45 +1,121 @@
 package kafka
 
 import (
+	"context"
 	"fmt"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/bcowtech/lib-kafka/internal"
 	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"go.opentelemetry.io/otel/trace"
 )
 
+const (
+	DEFAULT_FLUSH_INTERVAL_MS    = 100
+	DEFAULT_FLUSH_RETRY_INTERVAL = 10 * time.Millisecond
+
+	DEFAULT_TRANSACTION_TIMEOUT = 30 * time.Second
+	DEFAULT_CLOSE_FLUSH_TIMEOUT = 5 * time.Second
+)
+
+var errProducerClosed = kafka.NewError(kafka.ErrDestroy, "the Producer has been closed", false)
+
 type Producer struct {
-	handle *kafka.Producer
+	handle ProducerClient
+
+	errorPolicyExecutor  *errorPolicyExecutor
+	deliveryRetry        *RetryPolicy
+	deliveryErrorHandler DeliveryErrorHandleProc
+	interceptors         producerInterceptors
+	log                  Logger
+	metrics              *Metrics
+	statsHandler         StatsHandleProc
+	tracer               trace.Tracer
+	flushTimeoutMs       int
+	pingTimeout          time.Duration
+	transactional        bool
+	transactionTimeout   time.Duration
+	clientProvider       ProducerClientProvider
+	conf                 *ConfigMap
+
+	closing    chan struct{}
+	closed     bool
+	retrying   int32
+	retryMutex sync.Mutex
+	wg         sync.WaitGroup
+	mutex      sync.Mutex
+	disposed   bool
 
-	errorHandler   ErrorHandleProc
-	flushTimeoutMs int
-	pingTimeout    time.Duration
+	pending      map[*deliveryEnvelope]struct{}
+	pendingMutex sync.Mutex
 
-	wg       sync.WaitGroup
-	mutex    sync.Mutex
-	disposed bool
+	failure      error
+	failureMutex sync.RWMutex
 }
 
 func NewProducer(opt *ProducerOption) (*Producer, error) {
 	instance := &Producer{
-		errorHandler:   opt.ErrorHandler,
-		flushTimeoutMs: int(opt.FlushTimeout / time.Millisecond),
-		pingTimeout:    opt.PingTimeout,
+		errorPolicyExecutor: &errorPolicyExecutor{
+			policy:            opt.ErrorPolicy,
+			errorHandler:      opt.ErrorHandler,
+			fatalErrorHandler: opt.FatalErrorHandler,
+			logger:            opt.Logger,
+		},
+		deliveryRetry:        opt.DeliveryRetry,
+		deliveryErrorHandler: opt.DeliveryErrorHandler,
+		interceptors:         opt.Interceptors,
+		log:                  opt.Logger,
+		metrics:              opt.Metrics,
+		statsHandler:         opt.StatsHandler,
+		tracer:               opt.Tracer,
+		flushTimeoutMs:       int(opt.FlushTimeout / time.Millisecond),
+		pingTimeout:          opt.PingTimeout,
+		transactional:        len(opt.TransactionalID) > 0,
+		transactionTimeout:   opt.TransactionTimeout,
+		clientProvider:       opt.ClientProvider,
+		closing:              make(chan struct{}),
+		pending:              make(map[*deliveryEnvelope]struct{}),
 	}
+	if instance.transactionTimeout <= 0 {
+		instance.transactionTimeout = DEFAULT_TRANSACTION_TIMEOUT
+	}
+
+	var conf = copyConfigMap(opt.ConfigMap)
+	if instance.transactional {
+		(*conf)[KAFKA_CONF_TRANSACTIONAL_ID] = opt.TransactionalID
+		instance.deliveryRetry = nil
+	}
+	var logs = createLogsChannel(conf)
 
 	var err error
-	err = instance.init(opt.ConfigMap)
+	err = instance.init(conf)
 	if err != nil {
 		return nil, err
 	}
+	if logs != nil {
+		go forwardLogs(instance.logger(), logs, instance.closing)
+	}
 	instance.initEventLoop()
+
+	if instance.transactional {
+		err = instance.initTransactions()
+		if err != nil {
+			instance.Close()
+			return nil, err
+		}
+	}
 	return instance, nil
 }
 
+// Handle returns the underlying *kafka.Producer, or nil if the underlying
+// producer is created by ProducerOption.ClientProvider and is not one.
+//
+// Deprecated: depend on MessageWriter, or use the methods of Producer,
+// instead.
 func (p *Producer) Handle() *kafka.Producer {
-	return p.handle
+	producer, _ := p.handle.(*kafka.Producer)
+	return producer
 }
 
 func (p *Producer) Write(topic string, key, value []byte) error {
@@ -68,80 +144,304 @@ func (p *Producer) WriteMessageWithTimeout(message *Message, deliveryChan chan E
 	return p.writeMessageWithTimeout(message, deliveryChan, int(timeout/time.Millisecond))
 }
 
-func (p *Producer) Close() {
+// WriteMessageContext writes the message like WriteMessage, and injects the
+// trace context carried by ctx into the traceparent and tracestate headers.
+// If the Tracer is specified, the injected trace context is the one of a new
+// producer span.
+func (p *Producer) WriteMessageContext(ctx context.Context, message *Message, deliveryChan chan Event) (err error) {
+	if p.tracer != nil {
+		var span trace.Span
+		ctx, span = p.tracer.Start(ctx, spanNameOf(message, "publish"),
+			trace.WithSpanKind(trace.SpanKindProducer),
+			trace.WithAttributes(messagingAttributes(message, "publish")...))
+		defer func() {
+			endSpan(span, err)
+		}()
+	}
+
+	InjectTraceContext(ctx, message)
+	return p.WriteMessage(message, deliveryChan)
+}
+
+// WriteAsync enqueues the message without flushing, so the messages are
+// batched by librdkafka according to linger.ms and batch.size. The returned
+// channel receives the final DeliveryResult of the message.
+func (p *Producer) WriteAsync(message *Message) <-chan DeliveryResult {
+	var result = make(chan DeliveryResult, 1)
+
+	err := p.produce(message, &deliveryEnvelope{
+		result: result,
+	})
+	if err != nil {
+		result <- DeliveryResult{
+			Message:        message,
+			TopicPartition: message.TopicPartition,
+			Err:            err,
+		}
+	}
+	return result
+}
+
+// WriteAndWait blocks until the delivery report of the message arrives, and
+// returns the TopicPartition with the assigned partition and offset. A
+// failed delivery is returned as *DeliveryError. If ctx is done before the
+// report arrives, ctx.Err() is returned and the message might still be
+// delivered.
+func (p *Producer) WriteAndWait(ctx context.Context, message *Message) (TopicPartition, error) {
+	var result = make(chan DeliveryResult, 1)
+
+	err := p.produce(message, &deliveryEnvelope{
+		result: result,
+	})
+	if err != nil {
+		return message.TopicPartition, err
+	}
+
+	select {
+	case <-ctx.Done():
+		return message.TopicPartition, ctx.Err()
+	case r := <-result:
+		if r.Err != nil {
+			return r.TopicPartition, &DeliveryError{
+				TopicPartition: r.TopicPartition,
+				Err:            r.Err,
+			}
+		}
+		return r.TopicPartition, nil
+	}
+}
+
+// Flush waits for all the enqueued messages, including the ones waiting
+// to be retried, to be delivered. It returns ctx.Err() if ctx is done
+// before, or an ErrDestroy error if the Producer is closed before.
+func (p *Producer) Flush(ctx context.Context) error {
+	if err := p.acquire(); err != nil {
+		return err
+	}
+	defer p.wg.Done()
+
+	return p.flush(ctx)
+}
+
+func (p *Producer) flush(ctx context.Context) error {
+	var ticker = time.NewTicker(DEFAULT_FLUSH_RETRY_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		remaining := p.handle.Flush(DEFAULT_FLUSH_INTERVAL_MS)
+		if remaining == 0 && atomic.LoadInt32(&p.retrying) == 0 {
+			return nil
+		}
+
+		if remaining == 0 {
+			// the queue is empty while the retries wait for their backoff,
+			// and Flush returns at once
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-p.closing:
+				return errProducerClosed
+			case <-ticker.C:
+			}
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-p.closing:
+			return errProducerClosed
+		default:
+		}
+	}
+}
+
+// Err returns the fatal error which stopped the Producer, or nil if the
+// Producer is running. The writes of a stopped Producer fail with the error,
+// while the messages already enqueued are still reported. The Producer must
+// be closed and created again to recover.
+func (p *Producer) Err() error {
+	p.failureMutex.RLock()
+	defer p.failureMutex.RUnlock()
+
+	return p.failure
+}
+
+// HealthCheck requests the cluster metadata, verifies the topics exist, and
+// reports the reachability of every broker.
+func (p *Producer) HealthCheck(ctx context.Context, topics ...string) (*HealthReport, error) {
+	p.mutex.Lock()
 	if p.disposed {
-		return
+		p.mutex.Unlock()
+		return nil, fmt.Errorf("the Producer has been disposed")
 	}
+	// Close waits for the check before closing the handle
+	p.wg.Add(1)
+	defer p.wg.Done()
 
+	var (
+		h    = p.handle
+		conf = p.conf
+	)
+	p.mutex.Unlock()
+
+	return checkHealth(ctx, h, conf, topics)
+}
+
+// Close waits for the enqueued messages to be delivered within the
+// FlushTimeout, or DEFAULT_CLOSE_FLUSH_TIMEOUT if it is not specified, and
+// then closes the underlying producer. The messages still pending are
+// reported with an ErrDestroy error.
+func (p *Producer) Close() {
 	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.disposed {
+		return
+	}
 	defer func() {
 		p.disposed = true
-		p.mutex.Unlock()
 	}()
 
-	p.handle.Close()
+	var timeout = DEFAULT_CLOSE_FLUSH_TIMEOUT
+	if p.flushTimeoutMs > 0 {
+		timeout = time.Duration(p.flushTimeoutMs) * time.Millisecond
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	p.flush(ctx)
+	cancel()
+
+	p.retryMutex.Lock()
+	p.closed = true
+	close(p.closing)
+	p.retryMutex.Unlock()
+
 	p.wg.Wait()
+	p.handle.Close()
+
+	// the delivery reports of the messages left in the queue are lost on
+	// closing the underlying producer
+	p.failPending()
 }
 
 func (p *Producer) writeMessageWithTimeout(message *Message, deliveryChan chan Event, timeoutMs int) error {
+	if err := p.acquire(); err != nil {
+		return err
+	}
+	defer p.wg.Done()
+
+	err := p.enqueue(message, &deliveryEnvelope{
+		deliveryChan: deliveryChan,
+	})
+	if err != nil {
+		return err
+	}
+	// Wait for message deliveries before shutting down
+	p.handle.Flush(timeoutMs)
+	return nil
+}
+
+func (p *Producer) produce(message *Message, envelope *deliveryEnvelope) error {
+	if err := p.acquire(); err != nil {
+		return err
+	}
+	defer p.wg.Done()
+
+	return p.enqueue(message, envelope)
+}
+
+// acquire keeps Close from closing the underlying producer until p.wg.Done
+// is called. It fails if the Producer has been disposed.
+func (p *Producer) acquire() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
 	if p.disposed {
 		return fmt.Errorf("the Producer has been disposed")
 	}
-
 	p.wg.Add(1)
-	defer p.wg.Done()
+	return nil
+}
+
+func (p *Producer) enqueue(message *Message, envelope *deliveryEnvelope) error {
+	if err := p.Err(); err != nil {
+		return err
+	}
 
 	var (
 		h = p.handle
 	)
-	// Wait for message deliveries before shutting down
-	err := h.Produce(message, deliveryChan)
+	p.interceptors.onSend(message)
+
+	// route the delivery report through the event loop to retry the
+	// retriable delivery failures
+	envelope.opaque = message.Opaque
+	envelope.attempts = 1
+	envelope.message = message
+	message.Opaque = envelope
+	p.track(envelope)
+
+	err := h.Produce(message, nil)
 	if err != nil {
+		p.untrack(envelope)
+		message.Opaque = envelope.opaque
+		p.interceptors.onAcknowledgement(message, err)
 		return err
 	}
-	h.Flush(timeoutMs)
 	return nil
 }
 
+func (p *Producer) isRetriableDeliveryError(err error) bool {
+	switch e := err.(type) {
+	case kafka.Error:
+		return p.isRetriableError(e)
+	case *kafka.Error:
+		return p.isRetriableError(*e)
+	}
+	return false
+}
+
+// isRetriableError reports whether the delivery is worth retrying. The
+// delivery reports never set IsRetriable(), so the transient codes are
+// listed explicitly.
 func (p *Producer) isRetriableError(err kafka.Error) bool {
 	if err.IsRetriable() {
-		return false
+		return true
 	}
 
 	switch err.Code() {
-	case kafka.ErrNotEnoughReplicas,
+	case kafka.ErrMsgTimedOut,
+		kafka.ErrRequestTimedOut,
+		kafka.ErrNotLeaderForPartition,
+		kafka.ErrLeaderNotAvailable,
+		kafka.ErrNotEnoughReplicas,
 		kafka.ErrNotEnoughReplicasAfterAppend:
 		return true
 	}
 	return false
 }
 
-func (p *Producer) handleError(err kafka.Error) (disposed bool) {
-	if p.errorHandler != nil {
-		return p.errorHandler(err)
-	}
-	return false
+func (p *Producer) logger() Logger {
+	return loggerOrDefault(p.log)
+}
+
+func (p *Producer) handleError(err kafka.Error) ErrorDecision {
+	p.metrics.observeError(err)
+	return p.errorPolicyExecutor.execute(err)
 }
 
 func (p *Producer) init(conf *ConfigMap) error {
-	{
-		// ping address
-		v, _ := conf.Get(KAFKA_CONF_BOOTSTRAP_SERVERS, nil)
-		if v != nil {
-			bootstrapServers := v.(string)
-			addrs := strings.Split(bootstrapServers, ",")
-			err := internal.Ping(addrs, p.pingTimeout)
-			if err != nil {
-				return err
-			}
-		}
+	producer, err := createProducerClient(p.clientProvider, conf)
+	if err != nil {
+		return err
 	}
-
-	producer, err := kafka.NewProducer(conf)
+	err = startupHealthCheck(producer, conf, nil, p.pingTimeout)
 	if err != nil {
+		producer.Close()
 		return err
 	}
 	p.handle = producer
+	p.conf = conf
 	return nil
 }
 
@@ -150,74 +450,208 @@ func (p *Producer) initEventLoop() {
 		h = p.handle
 	)
 
-	// Delivery report handler for produced messages
+	// Delivery report handler for produced messages. The loop keeps draining
+	// the events after the Producer fails, until the handle is closed, so
+	// the pending deliveries are still reported.
 	go func() {
 		for ev := range h.Events() {
-			for {
-				switch e := ev.(type) {
-				case kafka.Error:
-					switch e.Code() {
-					case kafka.ErrUnknownTopic, kafka.ErrUnknownTopicOrPart:
-						if !p.handleError(e) {
-							logger.Fatalf("%% Error: (%#v) %+v: %v\n", e.Code(), e.Code(), e)
-						}
-
-					/* NOTE: https://github.com/edenhill/librdkafka/issues/64
-					Currently the only error codes signaled through the error_cb are:
-					- RD_KAFKA_RESP_ERR__ALL_BROKERS_DOWN - all brokers are down
-					- RD_KAFKA_RESP_ERR__FAIL - generic low level errors (socket failures because of lacking ipv4/ipv6 support)
-					- RD_KAFKA_RESP_ERR__RESOLVE - failure to resolve the broker address
-					- RD_KAFKA_RESP_ERR__CRIT_SYS_RESOURCE - failed to create new thread
-					- RD_KAFKA_RESP_ERR__FS - various file errors in the consumer offset management code
-					- RD_KAFKA_RESP_ERR__TRANSPORT - failed to connect to single broker, or connection error for single broker
-					- RD_KAFKA_RESP_ERR__BAD_MSG - received malformed packet from broker (version mismatch?)
-					I guess you could treat all but .._TRANSPORT as fatal.
-					*/
-					case kafka.ErrTransport:
-						if !p.handleError(e) {
-							logger.Printf(" %% Error: (%#v) %+v: %v\n", e.Code(), e.Code(), e)
-						}
-
-					case kafka.ErrAllBrokersDown,
-						kafka.ErrFail,
-						kafka.ErrResolve,
-						kafka.ErrCritSysResource,
-						kafka.ErrFs,
-						kafka.ErrBadMsg:
-						logger.Fatalf("%% Error: (%#v) %+v: %v\n", e.Code(), e.Code(), e)
-
-					default:
-						if !p.handleError(e) {
-							logger.Printf("%% Error: (%#v) %+v: %v\n", e.Code(), e.Code(), e)
-						}
-						return
-					}
-				case *kafka.Message:
-					if e.TopicPartition.Error != nil {
-						if err, ok := e.TopicPartition.Error.(*kafka.Error); ok {
-							ev = *err
-							if p.isRetriableError(*err) {
-								// TODO implement retry
-								break
-							}
-							continue
-						} else if err, ok := e.TopicPartition.Error.(kafka.Error); ok {
-							ev = err
-							if p.isRetriableError(err) {
-								// TODO implement retry
-								break
-							}
-							continue
-						}
-						logger.Printf("%% Error: (%s) (%T): %[2]v\n",
-							e.TopicPartition,
-							e.TopicPartition.Error)
-					}
-				default:
-					logger.Printf("%% Notice: Ignored %v\n", e)
+			switch e := ev.(type) {
+			case kafka.Error:
+				// the Producer has no consumer to stop, and librdkafka
+				// recovers from the other errors on its own, so only a fatal
+				// error stops the writes
+				p.handleError(e)
+				if e.IsFatal() {
+					p.fail(e)
 				}
-				break
+			case *kafka.Message:
+				p.handleDeliveryReport(e)
+			case *kafka.Stats:
+				handleStats(e, p.statsHandler, p.metrics, p.logger())
+			default:
+				p.logger().Debug("ignored event", "event", e)
 			}
 		}
 	}()
 }
+
+// fail stops the Producer accepting the writes on the fatal error. The first
+// error is kept.
+func (p *Producer) fail(err error) {
+	p.failureMutex.Lock()
+	defer p.failureMutex.Unlock()
+
+	if p.failure == nil {
+		p.failure = err
+		p.logger().Error("the Producer is stopped", "error", err)
+	}
+}
+
+func (p *Producer) handleDeliveryReport(message *kafka.Message) {
+	envelope, ok := message.Opaque.(*deliveryEnvelope)
+	if !ok {
+		// the message is not produced through the Producer
+		if message.TopicPartition.Error != nil {
+			p.logger().Error("cannot deliver message", "partition", message.TopicPartition, "error", message.TopicPartition.Error)
+		}
+		return
+	}
+	message.Opaque = envelope.opaque
+
+	if err := message.TopicPartition.Error; err != nil {
+		if p.Err() == nil && p.deliveryRetry.shouldRetryWith(err, envelope.attempts, p.isRetriableDeliveryError) {
+			p.retryDelivery(message, envelope)
+			return
+		}
+	}
+	p.completeDelivery(message, envelope)
+}
+
+func (p *Producer) retryDelivery(message *kafka.Message, envelope *deliveryEnvelope) {
+	var backoff = p.deliveryRetry.backoff(envelope.attempts)
+
+	p.retryMutex.Lock()
+	if p.closed {
+		p.retryMutex.Unlock()
+		p.completeDelivery(message, envelope)
+		return
+	}
+	p.wg.Add(1)
+	atomic.AddInt32(&p.retrying, 1)
+	p.retryMutex.Unlock()
+	p.metrics.observeDeliveryRetry(message.TopicPartition)
+
+	go func() {
+		defer p.wg.Done()
+		defer atomic.AddInt32(&p.retrying, -1)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-p.closing:
+			timer.Stop()
+			p.completeDelivery(message, envelope)
+			return
+		case <-timer.C:
+		}
+
+		envelope.attempts++
+		envelope.message = message
+		message.TopicPartition.Error = nil
+		message.Opaque = envelope
+		err := p.handle.Produce(message, nil)
+		if err != nil {
+			message.Opaque = envelope.opaque
+			message.TopicPartition.Error = err
+			p.completeDelivery(message, envelope)
+		}
+	}()
+}
+
+// track registers the envelope of the enqueued message until its delivery
+// is completed.
+func (p *Producer) track(envelope *deliveryEnvelope) {
+	p.pendingMutex.Lock()
+	defer p.pendingMutex.Unlock()
+
+	p.pending[envelope] = struct{}{}
+}
+
+// untrack removes the envelope, and returns false if it has been completed
+// already.
+func (p *Producer) untrack(envelope *deliveryEnvelope) bool {
+	p.pendingMutex.Lock()
+	defer p.pendingMutex.Unlock()
+
+	if _, ok := p.pending[envelope]; !ok {
+		return false
+	}
+	delete(p.pending, envelope)
+	return true
+}
+
+// failPending completes the deliveries which are still pending with
+// errProducerClosed.
+func (p *Producer) failPending() {
+	p.pendingMutex.Lock()
+	var pending = p.pending
+	p.pending = make(map[*deliveryEnvelope]struct{})
+	p.pendingMutex.Unlock()
+
+	for envelope := range pending {
+		message := envelope.message
+		message.Opaque = envelope.opaque
+		message.TopicPartition.Error = errProducerClosed
+		p.reportDelivery(message, envelope)
+	}
+}
+
+// completeDelivery reports the final delivery result once, unless the
+// delivery has been failed by Close.
+func (p *Producer) completeDelivery(message *kafka.Message, envelope *deliveryEnvelope) {
+	if !p.untrack(envelope) {
+		return
+	}
+	p.reportDelivery(message, envelope)
+}
+
+// reportDelivery reports the delivery result to the channel specified on
+// writing, or the DeliveryErrorHandler if the delivery failed.
+func (p *Producer) reportDelivery(message *kafka.Message, envelope *deliveryEnvelope) {
+	p.interceptors.onAcknowledgement(message, message.TopicPartition.Error)
+	p.metrics.observeDelivery(message.TopicPartition, message.TopicPartition.Error)
+
+	if envelope.result != nil {
+		envelope.result <- DeliveryResult{
+			Message:        message,
+			TopicPartition: message.TopicPartition,
+			Err:            message.TopicPartition.Error,
+		}
+		return
+	}
+	if envelope.deliveryChan != nil {
+		envelope.deliveryChan <- message
+		return
+	}
+
+	if err := message.TopicPartition.Error; err != nil {
+		if p.deliveryErrorHandler != nil {
+			p.deliveryErrorHandler(message, err)
+			return
+		}
+		p.logger().Error("cannot deliver message", "partition", message.TopicPartition, "attempts", envelope.attempts, "error", message.TopicPartition.Error)
+	}
+}
+
+type deliveryEnvelope struct {
+	message      *kafka.Message
+	opaque       interface{}
+	deliveryChan chan Event
+	result       chan DeliveryResult
+	attempts     int
+}
+
+// DeliveryError is the error of a message which cannot be delivered.
+type DeliveryError struct {
+	TopicPartition TopicPartition
+	Err            error
+}
+
+func (e *DeliveryError) Error() string {
+	return fmt.Sprintf("cannot deliver message to %s: %v", e.TopicPartition, e.Err)
+}
+
+func (e *DeliveryError) Unwrap() error {
+	return e.Err
+}
+
+// Code returns the ErrorCode of the delivery failure, or ErrUnknown if the
+// failure is not a kafka.Error.
+func (e *DeliveryError) Code() ErrorCode {
+	return errorCodeOf(e.Err)
+}
+
+type DeliveryResult struct {
+	Message        *Message
+	TopicPartition TopicPartition
+	Err            error
+}
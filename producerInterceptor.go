@@ -0,0 +1,24 @@
+package kafka
+
+// ProducerInterceptor observes or mutates the messages written through the
+// Producer. OnSend is called before a message is enqueued, and
+// OnAcknowledgement is called with the final delivery result, or the error
+// if the message cannot be enqueued.
+type ProducerInterceptor interface {
+	OnSend(message *Message)
+	OnAcknowledgement(message *Message, err error)
+}
+
+type producerInterceptors []ProducerInterceptor
+
+func (interceptors producerInterceptors) onSend(message *Message) {
+	for _, interceptor := range interceptors {
+		interceptor.OnSend(message)
+	}
+}
+
+func (interceptors producerInterceptors) onAcknowledgement(message *Message, err error) {
+	for _, interceptor := range interceptors {
+		interceptor.OnAcknowledgement(message, err)
+	}
+}
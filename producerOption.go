@@ -1,10 +1,59 @@
 package kafka
 
-import "time"
+import (
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
 
 type ProducerOption struct {
+	// FlushTimeout bounds the flush of WriteMessage, and the flush of Close
+	// before the pending messages are failed.
 	FlushTimeout time.Duration
+	// PingTimeout bounds the health check which NewProducer runs if the
+	// bootstrap.servers is specified. It is DEFAULT_HEALTH_CHECK_TIMEOUT
+	// if zero.
 	PingTimeout  time.Duration
 	ConfigMap    *ConfigMap
 	ErrorHandler ErrorHandleProc
+	// ErrorPolicy decides on the client errors. ErrorDecisionStopConsumer is
+	// reported like ErrorDecisionRetry, since the Producer keeps running
+	// through the transient errors; only a fatal error stops the writes, see
+	// Producer.Err.
+	ErrorPolicy ErrorPolicy
+	// FatalErrorHandler receives the errors escalated by the ErrorPolicy.
+	FatalErrorHandler FatalErrorHandleProc
+	// DeliveryRetry re-produces the messages whose delivery fails with a
+	// retriable error. The errors ErrMsgTimedOut, ErrRequestTimedOut,
+	// ErrNotLeaderForPartition, ErrLeaderNotAvailable, ErrNotEnoughReplicas
+	// and ErrNotEnoughReplicasAfterAppend are retried unless Retriable is
+	// specified.
+	DeliveryRetry        *RetryPolicy
+	DeliveryErrorHandler DeliveryErrorHandleProc
+	// Interceptors are called in order on every message written through the
+	// Producer.
+	Interceptors []ProducerInterceptor
+	// Logger is used instead of the Logger set by SetLogger. The librdkafka
+	// logs are written to it as well if go.logs.channel.enable is set.
+	Logger Logger
+	// TransactionalID enables the transactional mode, and sets the
+	// transactional.id of the ConfigMap. The DeliveryRetry is ignored in the
+	// transactional mode, since librdkafka retries the deliveries of an
+	// idempotent producer on its own.
+	TransactionalID string
+	// TransactionTimeout bounds InitTransactions on creation, the retries of
+	// SendOffsetsToTransaction and CommitTransaction, and the automatic
+	// AbortTransaction of a failed transaction.
+	TransactionTimeout time.Duration
+	// Metrics records the delivered messages, the delivery failures and
+	// retries, and the client errors.
+	Metrics *Metrics
+	// StatsHandler receives the librdkafka statistics if
+	// statistics.interval.ms is set.
+	StatsHandler StatsHandleProc
+	// Tracer starts a producer span around every WriteMessageContext.
+	Tracer trace.Tracer
+	// ClientProvider creates the underlying producer instead of
+	// kafka.NewProducer.
+	ClientProvider ProducerClientProvider
 }
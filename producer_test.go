@@ -1,8 +1,12 @@
 package kafka
 
 import (
+	"context"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
 )
 
 func TestProduce_DryTest(t *testing.T) {
@@ -81,3 +85,459 @@ func TestProduce_DryTest(t *testing.T) {
 
 	p.Close()
 }
+
+func TestProduce_DeliveryRetry(t *testing.T) {
+	var (
+		retriableCalls int32
+		failures       = make(chan error, 1)
+	)
+
+	p, err := NewProducer(&ProducerOption{
+		FlushTimeout: 10 * time.Millisecond,
+		ConfigMap: &ConfigMap{
+			"socket.timeout.ms":  10,
+			"message.timeout.ms": 10,
+		},
+		DeliveryRetry: &RetryPolicy{
+			MaxAttempts:    3,
+			InitialBackoff: 10 * time.Millisecond,
+			Retriable: func(err error) bool {
+				atomic.AddInt32(&retriableCalls, 1)
+				return err.(Error).Code() == ErrMsgTimedOut
+			},
+		},
+		DeliveryErrorHandler: func(message *Message, err error) {
+			failures <- err
+		},
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer p.Close()
+
+	topic := "gotest"
+	err = p.WriteMessage(&Message{TopicPartition: TopicPartition{Topic: &topic, Partition: 0},
+		Value: []byte("retry")}, nil)
+	if err != nil {
+		t.Fatalf("Produce failed: %s", err)
+	}
+
+	select {
+	case err := <-failures:
+		if err.(Error).Code() != ErrMsgTimedOut {
+			t.Errorf("assert delivery error expect '%v', got '%v'", ErrMsgTimedOut, err)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("Expected the delivery to fail")
+	}
+
+	if n := atomic.LoadInt32(&retriableCalls); n != 2 {
+		t.Errorf("assert retried deliveries expect '%v', got '%v'", 2, n)
+	}
+}
+
+func TestProducer_IsRetriableError(t *testing.T) {
+	p := &Producer{}
+
+	// the delivery report of librdkafka carries the error code only
+	handle, err := kafka.NewProducer(&ConfigMap{
+		"socket.timeout.ms":  10,
+		"message.timeout.ms": 10,
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer handle.Close()
+
+	topic := "gotest"
+	deliveryChan := make(chan Event, 1)
+	err = handle.Produce(&Message{
+		TopicPartition: TopicPartition{Topic: &topic, Partition: 0},
+	}, deliveryChan)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	report := (<-deliveryChan).(*Message)
+
+	cases := []struct {
+		err      error
+		expected bool
+	}{
+		{report.TopicPartition.Error, true},
+		{NewError(ErrNotLeaderForPartition, "", false), true},
+		{NewError(ErrNotEnoughReplicas, "", false), true},
+		{NewError(ErrNotEnoughReplicasAfterAppend, "", false), true},
+		{NewError(ErrMsgSizeTooLarge, "", false), false},
+	}
+	for _, c := range cases {
+		if retriable := p.isRetriableDeliveryError(c.err); retriable != c.expected {
+			t.Errorf("assert isRetriableDeliveryError(%v) expect '%v', got '%v'", c.err, c.expected, retriable)
+		}
+	}
+}
+
+func TestProducer_WriteAsync(t *testing.T) {
+	p, err := NewProducer(&ProducerOption{
+		ConfigMap: &ConfigMap{
+			"socket.timeout.ms":  10,
+			"message.timeout.ms": 10,
+			"linger.ms":          5,
+		},
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	topic := "gotest"
+	var results []<-chan DeliveryResult
+	for _, word := range []string{"Welcome", "to", "the", "Confluent", "Kafka", "Golang", "client"} {
+		results = append(results, p.WriteAsync(&Message{
+			TopicPartition: TopicPartition{Topic: &topic, Partition: 0},
+			Value:          []byte(word),
+			Opaque:         word,
+		}))
+	}
+
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		err = p.Flush(ctx)
+		cancel()
+		if err != context.DeadlineExceeded {
+			t.Errorf("assert Producer.Flush() expect '%v', got '%v'", context.DeadlineExceeded, err)
+		}
+	}
+
+	for _, result := range results {
+		select {
+		case r := <-result:
+			if r.Err == nil {
+				t.Errorf("Expected error for message %v", r.Message)
+			}
+			if r.Message.Opaque != string(r.Message.Value) {
+				t.Errorf("assert Message.Opaque expect '%s', got '%v'", r.Message.Value, r.Message.Opaque)
+			}
+		case <-time.After(30 * time.Second):
+			t.Fatal("Expected the delivery result")
+		}
+	}
+
+	err = p.Flush(context.Background())
+	if err != nil {
+		t.Errorf("assert Producer.Flush() expect '%v', got '%v'", nil, err)
+	}
+	p.Close()
+
+	r := <-p.WriteAsync(&Message{TopicPartition: TopicPartition{Topic: &topic, Partition: 0}})
+	if r.Err == nil {
+		t.Error("Expected WriteAsync() to fail after Close()")
+	}
+}
+
+func TestProducer_WriteAndWait(t *testing.T) {
+	p, err := NewProducer(&ProducerOption{
+		ConfigMap: &ConfigMap{
+			"socket.timeout.ms":  10,
+			"message.timeout.ms": 10,
+		},
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer p.Close()
+
+	topic := "gotest"
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		_, err = p.WriteAndWait(ctx, &Message{
+			TopicPartition: TopicPartition{Topic: &topic, Partition: 0},
+			Value:          []byte("Welcome"),
+		})
+		cancel()
+
+		deliveryErr, ok := err.(*DeliveryError)
+		if !ok {
+			t.Fatalf("assert Producer.WriteAndWait() expect '*DeliveryError', got '%T'", err)
+		}
+		if deliveryErr.Code() != ErrMsgTimedOut {
+			t.Errorf("assert DeliveryError.Code() expect '%v', got '%v'", ErrMsgTimedOut, deliveryErr.Code())
+		}
+		if *deliveryErr.TopicPartition.Topic != topic {
+			t.Errorf("assert DeliveryError.TopicPartition.Topic expect '%v', got '%v'", topic, *deliveryErr.TopicPartition.Topic)
+		}
+	}
+
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		_, err = p.WriteAndWait(ctx, &Message{
+			TopicPartition: TopicPartition{Topic: &topic, Partition: 0},
+			Value:          []byte("Kafka"),
+		})
+		cancel()
+		if err != context.DeadlineExceeded {
+			t.Errorf("assert Producer.WriteAndWait() expect '%v', got '%v'", context.DeadlineExceeded, err)
+		}
+	}
+	p.Flush(context.Background())
+}
+
+type countingInterceptor struct {
+	sent         int
+	acknowledged int
+	failed       int
+}
+
+func (i *countingInterceptor) OnSend(message *Message) {
+	i.sent++
+	message.Headers = append(message.Headers, Header{Key: "intercepted", Value: []byte("true")})
+}
+
+func (i *countingInterceptor) OnAcknowledgement(message *Message, err error) {
+	i.acknowledged++
+	if err != nil {
+		i.failed++
+	}
+}
+
+func TestProducer_Interceptors(t *testing.T) {
+	interceptor := &countingInterceptor{}
+
+	p, err := NewProducer(&ProducerOption{
+		ConfigMap: &ConfigMap{
+			"socket.timeout.ms":  10,
+			"message.timeout.ms": 10,
+		},
+		Interceptors: []ProducerInterceptor{interceptor},
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer p.Close()
+
+	topic := "gotest"
+	message := &Message{
+		TopicPartition: TopicPartition{Topic: &topic, Partition: 0},
+		Value:          []byte("Welcome"),
+	}
+	p.WriteAndWait(context.Background(), message)
+
+	if interceptor.sent != 1 {
+		t.Errorf("assert OnSend() calls expect '%v', got '%v'", 1, interceptor.sent)
+	}
+	if interceptor.acknowledged != 1 || interceptor.failed != 1 {
+		t.Errorf("assert OnAcknowledgement() calls expect '%v' failed, got '%v' of '%v'", 1, interceptor.failed, interceptor.acknowledged)
+	}
+	if len(message.Headers) != 1 || message.Headers[0].Key != "intercepted" {
+		t.Errorf("assert Message.Headers expect '%v', got '%v'", "intercepted", message.Headers)
+	}
+}
+
+// eventInjectingProducer forwards the events of the underlying producer, and
+// lets the test inject the client errors.
+type eventInjectingProducer struct {
+	ProducerClient
+	events chan Event
+}
+
+func (p *eventInjectingProducer) Events() chan Event {
+	return p.events
+}
+
+func TestProducer_FatalError(t *testing.T) {
+	var (
+		client *eventInjectingProducer
+		fatal  = make(chan Error, 1)
+	)
+
+	p, err := NewProducer(&ProducerOption{
+		ConfigMap: &ConfigMap{
+			"socket.timeout.ms":  10,
+			"message.timeout.ms": 10,
+		},
+		FatalErrorHandler: func(err Error) {
+			fatal <- err
+		},
+		ClientProvider: func(conf *ConfigMap) (ProducerClient, error) {
+			producer, err := createProducerClient(nil, conf)
+			if err != nil {
+				return nil, err
+			}
+			client = &eventInjectingProducer{
+				ProducerClient: producer,
+				events:         make(chan Event),
+			}
+			go func() {
+				for ev := range producer.Events() {
+					client.events <- ev
+				}
+				close(client.events)
+			}()
+			return client, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer p.Close()
+
+	topic := "gotest"
+	pending := p.WriteAsync(&Message{
+		TopicPartition: TopicPartition{Topic: &topic, Partition: 0},
+		Value:          []byte("pending"),
+	})
+
+	// the transient error is escalated without stopping the writes
+	client.events <- NewError(ErrAllBrokersDown, "all brokers are down", false)
+	select {
+	case err := <-fatal:
+		if err.Code() != ErrAllBrokersDown {
+			t.Errorf("assert FatalErrorHandler expect '%v', got '%v'", ErrAllBrokersDown, err.Code())
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Expected the FatalErrorHandler to be called")
+	}
+	if p.Err() != nil {
+		t.Errorf("assert Producer.Err() expect '%v', got '%v'", nil, p.Err())
+	}
+
+	client.events <- NewError(ErrFatal, "fatal idempotent producer error", true)
+	select {
+	case err := <-fatal:
+		if !err.IsFatal() {
+			t.Errorf("assert FatalErrorHandler expect fatal error, got '%v'", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Expected the FatalErrorHandler to be called")
+	}
+
+	// the delivery report of the message enqueued before still arrives
+	select {
+	case r := <-pending:
+		if r.Err == nil {
+			t.Errorf("Expected error for message %v", r.Message)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("Expected the delivery result")
+	}
+
+	if e, ok := p.Err().(Error); !ok || !e.IsFatal() {
+		t.Errorf("assert Producer.Err() expect fatal error, got '%v'", p.Err())
+	}
+	_, err = p.WriteAndWait(context.Background(), &Message{
+		TopicPartition: TopicPartition{Topic: &topic, Partition: 0},
+	})
+	if err != p.Err() {
+		t.Errorf("assert Producer.WriteAndWait() expect '%v', got '%v'", p.Err(), err)
+	}
+}
+
+type flushCountingProducer struct {
+	ProducerClient
+	flushes int32
+}
+
+func (p *flushCountingProducer) Flush(timeoutMs int) int {
+	atomic.AddInt32(&p.flushes, 1)
+	return 0
+}
+
+func TestProducer_FlushWaitsForRetries(t *testing.T) {
+	var client = &flushCountingProducer{}
+	p := &Producer{
+		handle:   client,
+		retrying: 1,
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		atomic.AddInt32(&p.retrying, -1)
+	}()
+
+	err := p.Flush(context.Background())
+	if err != nil {
+		t.Errorf("assert Producer.Flush() expect '%v', got '%v'", nil, err)
+	}
+	// Flush polls the retries by DEFAULT_FLUSH_RETRY_INTERVAL instead of
+	// spinning
+	if n := atomic.LoadInt32(&client.flushes); n > 50 {
+		t.Errorf("assert Flush calls expect at most '%v', got '%v'", 50, n)
+	}
+}
+
+func TestProducer_CloseWhileFlushing(t *testing.T) {
+	p, err := NewProducer(&ProducerOption{
+		FlushTimeout: 100 * time.Millisecond,
+		ConfigMap: &ConfigMap{
+			"socket.timeout.ms":  10,
+			"message.timeout.ms": 60000,
+		},
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// the message stays enqueued without brokers
+	topic := "gotest"
+	p.WriteAsync(&Message{
+		TopicPartition: TopicPartition{Topic: &topic, Partition: 0},
+		Value:          []byte("Welcome"),
+	})
+
+	var flushed = make(chan error, 1)
+	go func() {
+		flushed <- p.Flush(context.Background())
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	var closed = make(chan struct{})
+	go func() {
+		p.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Expected Producer.Close() to return while flushing")
+	}
+
+	if err := <-flushed; err != errProducerClosed {
+		t.Errorf("assert Producer.Flush() expect '%v', got '%v'", errProducerClosed, err)
+	}
+	if err := p.Flush(context.Background()); err == nil {
+		t.Error("Expected Producer.Flush() of the closed Producer to fail")
+	}
+}
+
+func TestProducer_ClosePendingDelivery(t *testing.T) {
+	p, err := NewProducer(&ProducerOption{
+		FlushTimeout: 100 * time.Millisecond,
+		ConfigMap: &ConfigMap{
+			"socket.timeout.ms":  10,
+			"message.timeout.ms": 60000,
+		},
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	topic := "gotest"
+	var written = make(chan error, 1)
+	go func() {
+		_, err := p.WriteAndWait(context.Background(), &Message{
+			TopicPartition: TopicPartition{Topic: &topic, Partition: 0},
+			Value:          []byte("Welcome"),
+		})
+		written <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	p.Close()
+
+	select {
+	case err := <-written:
+		deliveryErr, ok := err.(*DeliveryError)
+		if !ok || deliveryErr.Code() != ErrDestroy {
+			t.Errorf("assert Producer.WriteAndWait() expect '%v', got '%v'", ErrDestroy, err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Expected Producer.WriteAndWait() to return after Producer.Close()")
+	}
+}
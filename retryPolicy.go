@@ -0,0 +1,117 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+)
+
+const (
+	DEFAULT_RETRY_INITIAL_BACKOFF = 100 * time.Millisecond
+	DEFAULT_RETRY_MAX_BACKOFF     = 30 * time.Second
+	DEFAULT_RETRY_MULTIPLIER      = 2.0
+)
+
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts including the first one.
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	// Jitter randomizes each backoff by up to the specified fraction of it,
+	// e.g. 0.2 spreads a 1s backoff between 0.8s and 1.2s.
+	Jitter float64
+	// Retriable classifies whether the error can be retried. All errors but
+	// the ones wrapped by Permanent() are retried if it is nil.
+	Retriable func(err error) bool
+}
+
+func (p *RetryPolicy) shouldRetry(err error, attempt int) bool {
+	return p.shouldRetryWith(err, attempt, nil)
+}
+
+// shouldRetryWith classifies the error by the specified retriable func if
+// the RetryPolicy has no Retriable.
+func (p *RetryPolicy) shouldRetryWith(err error, attempt int, retriable func(err error) bool) bool {
+	if p == nil || attempt >= p.MaxAttempts {
+		return false
+	}
+
+	var permanent *PermanentError
+	if errors.As(err, &permanent) {
+		return false
+	}
+	if p.Retriable != nil {
+		return p.Retriable(err)
+	}
+	if retriable != nil {
+		return retriable(err)
+	}
+	return true
+}
+
+// backoff returns the duration to wait before the next attempt, where
+// attempt is the number of attempts already made.
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	var (
+		initialBackoff = p.InitialBackoff
+		maxBackoff     = p.MaxBackoff
+		multiplier     = p.Multiplier
+	)
+	if initialBackoff <= 0 {
+		initialBackoff = DEFAULT_RETRY_INITIAL_BACKOFF
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = DEFAULT_RETRY_MAX_BACKOFF
+	}
+	if multiplier < 1 {
+		multiplier = DEFAULT_RETRY_MULTIPLIER
+	}
+
+	backoff := float64(initialBackoff) * math.Pow(multiplier, float64(attempt-1))
+	if backoff > float64(maxBackoff) {
+		backoff = float64(maxBackoff)
+	}
+	if p.Jitter > 0 {
+		backoff += backoff * p.Jitter * (2*rand.Float64() - 1)
+	}
+	if backoff < 0 {
+		backoff = 0
+	}
+	return time.Duration(backoff)
+}
+
+// sleepContext waits for the duration, and returns false if ctx is done
+// before.
+func sleepContext(ctx context.Context, duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	select {
+	case <-ctx.Done():
+		timer.Stop()
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// PermanentError marks an error which must not be retried.
+type PermanentError struct {
+	Err error
+}
+
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
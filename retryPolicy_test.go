@@ -0,0 +1,147 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	p := &RetryPolicy{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     1 * time.Second,
+		Multiplier:     2,
+	}
+
+	cases := []struct {
+		attempt  int
+		expected time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, 1 * time.Second},
+		{10, 1 * time.Second},
+	}
+	for _, c := range cases {
+		backoff := p.backoff(c.attempt)
+		if backoff != c.expected {
+			t.Errorf("assert backoff(%d) expect '%v', got '%v'", c.attempt, c.expected, backoff)
+		}
+	}
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		backoff := p.backoff(2)
+		if backoff < 100*time.Millisecond || backoff > 300*time.Millisecond {
+			t.Fatalf("assert backoff(2) with jitter expect within [100ms, 300ms], got '%v'", backoff)
+		}
+	}
+}
+
+func TestRetryPolicy_ShouldRetry(t *testing.T) {
+	var (
+		errTransient = fmt.Errorf("transient")
+		errFatal     = fmt.Errorf("fatal")
+	)
+
+	p := &RetryPolicy{
+		MaxAttempts: 3,
+		Retriable: func(err error) bool {
+			return err != errFatal
+		},
+	}
+
+	if !p.shouldRetry(errTransient, 1) {
+		t.Errorf("assert shouldRetry() on attempt 1 expect '%v'", true)
+	}
+	if p.shouldRetry(errTransient, 3) {
+		t.Errorf("assert shouldRetry() on attempt 3 expect '%v'", false)
+	}
+	if p.shouldRetry(errFatal, 1) {
+		t.Errorf("assert shouldRetry() on classified error expect '%v'", false)
+	}
+	if p.shouldRetry(fmt.Errorf("wrapped: %w", Permanent(errTransient)), 1) {
+		t.Errorf("assert shouldRetry() on permanent error expect '%v'", false)
+	}
+
+	var nilPolicy *RetryPolicy
+	if nilPolicy.shouldRetry(errTransient, 1) {
+		t.Errorf("assert shouldRetry() without RetryPolicy expect '%v'", false)
+	}
+}
+
+func TestConsumer_ProcessMessageWithRetry(t *testing.T) {
+	handle, err := kafka.NewConsumer(&ConfigMap{
+		"group.id": "gotest",
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer handle.Close()
+
+	var (
+		attempts  int
+		unhandled int
+	)
+
+	c := &Consumer{
+		MessageProcessor: func(ctx *ConsumeContext, message *Message) error {
+			attempts++
+			if string(message.Value) == "poison" || attempts < 3 {
+				return fmt.Errorf("attempt %d failed", attempts)
+			}
+			return nil
+		},
+		UnhandledMessageHandler: func(ctx *ConsumeContext, message *Message) {
+			unhandled++
+		},
+		RetryPolicy: &RetryPolicy{
+			MaxAttempts:    3,
+			InitialBackoff: time.Millisecond,
+		},
+	}
+	c.init()
+	defer c.cancel()
+
+	var (
+		topic = "gotest"
+		ctx   = &ConsumeContext{
+			unhandledMessageHandler: c.UnhandledMessageHandler,
+			committer:               handle,
+			controller:              handle,
+			context:                 context.Background(),
+		}
+	)
+
+	// retry in background
+	c.processMessage(ctx, &Message{
+		TopicPartition: TopicPartition{Topic: &topic, Partition: 0},
+		Value:          []byte("ok"),
+	})
+	c.retries.waitAll()
+	if attempts != 3 {
+		t.Errorf("assert attempts expect '%v', got '%v'", 3, attempts)
+	}
+	if unhandled != 0 {
+		t.Errorf("assert unhandled messages expect '%v', got '%v'", 0, unhandled)
+	}
+
+	// retry in the worker
+	attempts = 0
+	c.WorkerPool = &WorkerPoolOption{}
+	c.processMessage(ctx, &Message{
+		TopicPartition: TopicPartition{Topic: &topic, Partition: 0},
+		Value:          []byte("poison"),
+	})
+	if attempts != 3 {
+		t.Errorf("assert attempts expect '%v', got '%v'", 3, attempts)
+	}
+	if unhandled != 1 {
+		t.Errorf("assert unhandled messages expect '%v', got '%v'", 1, unhandled)
+	}
+}
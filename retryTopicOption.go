@@ -0,0 +1,192 @@
+package kafka
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+const (
+	RETRY_TOPIC_INFIX = ".retry."
+
+	RETRY_TOPIC_HEADER_ORIGINAL_TOPIC     = "x-retry-original-topic"
+	RETRY_TOPIC_HEADER_ORIGINAL_PARTITION = "x-retry-original-partition"
+	RETRY_TOPIC_HEADER_ORIGINAL_OFFSET    = "x-retry-original-offset"
+	RETRY_TOPIC_HEADER_TIER               = "x-retry-tier"
+	RETRY_TOPIC_HEADER_ATTEMPTS           = "x-retry-attempts"
+	RETRY_TOPIC_HEADER_ERROR              = "x-retry-error"
+	RETRY_TOPIC_HEADER_DUE                = "x-retry-due"
+)
+
+// RetryTopicOption sends the messages which the MessageProcessor keeps
+// failing on to the retry topics "<topic>.retry.<tier>" instead of pausing
+// their partitions. The Consumer subscribes the retry topics as well, and
+// handles a message from a retry topic once the delay of its tier elapses.
+// The messages which fail on the last tier are sent to the DeadLetter topic
+// if it is specified. The regex pattern subscriptions are not supported.
+type RetryTopicOption struct {
+	// Tiers are the delays of the retry topics, e.g. the first tier
+	// "<topic>.retry.1" uses Tiers[0].
+	Tiers    []time.Duration
+	Producer MessageWriter
+	// RetryBackoff is the duration to wait before resending a message which
+	// cannot be delivered to the retry topic.
+	RetryBackoff time.Duration
+}
+
+// RetryAttempts returns the number of attempts made on the message before
+// it was sent to the retry topic.
+func RetryAttempts(message *Message) int {
+	return retryAttemptsOf(message)
+}
+
+// OriginalTopicPartition returns the coordinates of the message in the
+// topic it was consumed from at first.
+func OriginalTopicPartition(message *Message) TopicPartition {
+	var tp = message.TopicPartition
+
+	if v, ok := lookupHeader(message, RETRY_TOPIC_HEADER_ORIGINAL_TOPIC); ok {
+		topic := string(v)
+		tp.Topic = &topic
+		if v, ok := lookupHeader(message, RETRY_TOPIC_HEADER_ORIGINAL_PARTITION); ok {
+			if partition, err := strconv.ParseInt(string(v), 10, 32); err == nil {
+				tp.Partition = int32(partition)
+			}
+		}
+		if v, ok := lookupHeader(message, RETRY_TOPIC_HEADER_ORIGINAL_OFFSET); ok {
+			if offset, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+				tp.Offset = Offset(offset)
+			}
+		}
+	}
+	return tp
+}
+
+// validateTopics rejects the regex pattern subscriptions. A pattern such as
+// "^orders\..*" matches the retry topics of the topics it matches as well,
+// and librdkafka's regex cannot exclude them, so the retried messages would
+// be consumed by the pattern subscription without their delay.
+func (opt *RetryTopicOption) validateTopics(topics []string) error {
+	for _, topic := range topics {
+		if isTopicPattern(topic) {
+			return fmt.Errorf("the pattern subscription %s is not supported with the RetryTopics", topic)
+		}
+	}
+	return nil
+}
+
+func (opt *RetryTopicOption) expandTopics(topics []string) []string {
+	var expanded = make([]string, 0, len(topics)*(len(opt.Tiers)+1))
+	for _, topic := range topics {
+		expanded = append(expanded, topic)
+		for tier := 1; tier <= len(opt.Tiers); tier++ {
+			expanded = append(expanded, retryTopicOf(topic, tier))
+		}
+	}
+	return expanded
+}
+
+// delayOf returns the remaining time before the message from a retry topic
+// is due.
+func (opt *RetryTopicOption) delayOf(message *Message) time.Duration {
+	if opt == nil {
+		return 0
+	}
+
+	v, ok := lookupHeader(message, RETRY_TOPIC_HEADER_DUE)
+	if !ok {
+		return 0
+	}
+	due, err := strconv.ParseInt(string(v), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return time.Until(time.Unix(0, due*int64(time.Millisecond)))
+}
+
+// createMessage returns the message to send to the next retry tier, or nil
+// if the message has been through all tiers.
+func (opt *RetryTopicOption) createMessage(message *Message, err error, attempts int) *Message {
+	var tier = 1
+	if v, ok := lookupHeader(message, RETRY_TOPIC_HEADER_TIER); ok {
+		current, _ := strconv.Atoi(string(v))
+		tier = current + 1
+	}
+	if tier > len(opt.Tiers) {
+		return nil
+	}
+
+	var (
+		original = OriginalTopicPartition(message)
+		topic    = retryTopicOf(*original.Topic, tier)
+		due      = time.Now().Add(opt.Tiers[tier-1])
+	)
+
+	headers := make([]kafka.Header, 0, len(message.Headers)+7)
+	for _, h := range message.Headers {
+		if !isRetryTopicHeader(h.Key) {
+			headers = append(headers, h)
+		}
+	}
+	headers = append(headers,
+		kafka.Header{Key: RETRY_TOPIC_HEADER_ORIGINAL_TOPIC, Value: []byte(*original.Topic)},
+		kafka.Header{Key: RETRY_TOPIC_HEADER_ORIGINAL_PARTITION, Value: []byte(strconv.Itoa(int(original.Partition)))},
+		kafka.Header{Key: RETRY_TOPIC_HEADER_ORIGINAL_OFFSET, Value: []byte(strconv.FormatInt(int64(original.Offset), 10))},
+		kafka.Header{Key: RETRY_TOPIC_HEADER_TIER, Value: []byte(strconv.Itoa(tier))},
+		kafka.Header{Key: RETRY_TOPIC_HEADER_ATTEMPTS, Value: []byte(strconv.Itoa(attempts))},
+		kafka.Header{Key: RETRY_TOPIC_HEADER_ERROR, Value: []byte(fmt.Sprintf("%v", err))},
+		kafka.Header{Key: RETRY_TOPIC_HEADER_DUE, Value: []byte(strconv.FormatInt(due.UnixNano()/int64(time.Millisecond), 10))},
+	)
+
+	return &Message{
+		TopicPartition: TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+		Key:            message.Key,
+		Value:          message.Value,
+		Headers:        headers,
+	}
+}
+
+func retryTopicOf(topic string, tier int) string {
+	return topic + RETRY_TOPIC_INFIX + strconv.Itoa(tier)
+}
+
+// isTopicPattern reports whether the topic is a regex pattern, which
+// librdkafka recognizes by the leading "^".
+func isTopicPattern(topic string) bool {
+	return strings.HasPrefix(topic, "^")
+}
+
+func retryAttemptsOf(message *Message) int {
+	if v, ok := lookupHeader(message, RETRY_TOPIC_HEADER_ATTEMPTS); ok {
+		attempts, _ := strconv.Atoi(string(v))
+		return attempts
+	}
+	return 0
+}
+
+func isRetryTopicHeader(key string) bool {
+	switch key {
+	case RETRY_TOPIC_HEADER_ORIGINAL_TOPIC,
+		RETRY_TOPIC_HEADER_ORIGINAL_PARTITION,
+		RETRY_TOPIC_HEADER_ORIGINAL_OFFSET,
+		RETRY_TOPIC_HEADER_TIER,
+		RETRY_TOPIC_HEADER_ATTEMPTS,
+		RETRY_TOPIC_HEADER_ERROR,
+		RETRY_TOPIC_HEADER_DUE:
+		return true
+	}
+	return false
+}
+
+func lookupHeader(message *Message, key string) ([]byte, bool) {
+	// the last header wins if the key is duplicated
+	for i := len(message.Headers) - 1; i >= 0; i-- {
+		if message.Headers[i].Key == key {
+			return message.Headers[i].Value, true
+		}
+	}
+	return nil, false
+}
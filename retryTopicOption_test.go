@@ -0,0 +1,152 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRetryTopicOption_ExpandTopics(t *testing.T) {
+	opt := &RetryTopicOption{
+		Tiers: []time.Duration{time.Second, time.Minute},
+	}
+
+	topics := opt.expandTopics([]string{"orders", "payments"})
+	expected := []string{
+		"orders", "orders.retry.1", "orders.retry.2",
+		"payments", "payments.retry.1", "payments.retry.2",
+	}
+	if !reflect.DeepEqual(topics, expected) {
+		t.Errorf("assert expandTopics() expect '%v', got '%v'", expected, topics)
+	}
+
+}
+
+func TestRetryTopicOption_ValidateTopics(t *testing.T) {
+	opt := &RetryTopicOption{
+		Tiers: []time.Duration{time.Second},
+	}
+
+	if err := opt.validateTopics([]string{"orders", "payments"}); err != nil {
+		t.Errorf("assert validateTopics() expect '%v', got '%v'", nil, err)
+	}
+	// the pattern matches its own retry topics, e.g. orders.x.retry.1
+	if err := opt.validateTopics([]string{"orders", `^orders\..*`}); err == nil {
+		t.Error("Expected validateTopics() to reject the pattern subscription")
+	}
+}
+
+func TestRetryTopicOption_CreateMessage(t *testing.T) {
+	opt := &RetryTopicOption{
+		Tiers: []time.Duration{time.Second, time.Minute},
+	}
+
+	var (
+		topic   = "orders"
+		message = &Message{
+			TopicPartition: TopicPartition{Topic: &topic, Partition: 2, Offset: 7},
+			Key:            []byte("key"),
+			Value:          []byte("value"),
+		}
+	)
+
+	// tier 1
+	retry := opt.createMessage(message, fmt.Errorf("failed"), 3)
+	if retry == nil {
+		t.Fatal("Expected createMessage() to return the message of tier 1")
+	}
+	if *retry.TopicPartition.Topic != "orders.retry.1" {
+		t.Errorf("assert retry topic expect '%v', got '%v'", "orders.retry.1", *retry.TopicPartition.Topic)
+	}
+	if attempts := RetryAttempts(retry); attempts != 3 {
+		t.Errorf("assert RetryAttempts() expect '%v', got '%v'", 3, attempts)
+	}
+	if delay := opt.delayOf(retry); delay <= 0 || delay > time.Second {
+		t.Errorf("assert delayOf() expect within (0, 1s], got '%v'", delay)
+	}
+
+	// tier 2, consumed from the retry topic
+	retryTopic := *retry.TopicPartition.Topic
+	retry.TopicPartition = TopicPartition{Topic: &retryTopic, Partition: 0, Offset: 100}
+	retry = opt.createMessage(retry, fmt.Errorf("failed again"), 4)
+	if retry == nil {
+		t.Fatal("Expected createMessage() to return the message of tier 2")
+	}
+	if *retry.TopicPartition.Topic != "orders.retry.2" {
+		t.Errorf("assert retry topic expect '%v', got '%v'", "orders.retry.2", *retry.TopicPartition.Topic)
+	}
+
+	original := OriginalTopicPartition(retry)
+	if *original.Topic != "orders" || original.Partition != 2 || original.Offset != 7 {
+		t.Errorf("assert OriginalTopicPartition() expect '%v', got '%v'", message.TopicPartition, original)
+	}
+
+	var count = make(map[string]int)
+	for _, h := range retry.Headers {
+		count[h.Key]++
+	}
+	for k, n := range count {
+		if n != 1 {
+			t.Errorf("assert header %s expect once, got '%v'", k, n)
+		}
+	}
+
+	// all tiers are exhausted
+	retryTopic = *retry.TopicPartition.Topic
+	retry.TopicPartition = TopicPartition{Topic: &retryTopic, Partition: 0, Offset: 200}
+	if opt.createMessage(retry, fmt.Errorf("failed"), 5) != nil {
+		t.Error("Expected createMessage() to return nil after the last tier")
+	}
+
+	// the dead-letter message records the original coordinates
+	deadLetter := (&DeadLetterOption{}).createMessage(retry, fmt.Errorf("failed"), 5)
+	if *deadLetter.TopicPartition.Topic != "orders.dlq" {
+		t.Errorf("assert dead-letter topic expect '%v', got '%v'", "orders.dlq", *deadLetter.TopicPartition.Topic)
+	}
+	if v, _ := lookupHeader(deadLetter, DEAD_LETTER_HEADER_SOURCE_OFFSET); string(v) != "7" {
+		t.Errorf("assert header %s expect '%v', got '%s'", DEAD_LETTER_HEADER_SOURCE_OFFSET, "7", v)
+	}
+}
+
+func TestConsumer_HandleRetryTopicMessageWhenDue(t *testing.T) {
+	var handledAt time.Time
+
+	c := &Consumer{
+		MessageProcessor: func(ctx *ConsumeContext, message *Message) error {
+			handledAt = time.Now()
+			return nil
+		},
+		WorkerPool: &WorkerPoolOption{},
+		RetryTopics: &RetryTopicOption{
+			Tiers: []time.Duration{100 * time.Millisecond},
+		},
+	}
+
+	topic := "orders"
+	retry := c.RetryTopics.createMessage(&Message{
+		TopicPartition: TopicPartition{Topic: &topic},
+	}, fmt.Errorf("failed"), 1)
+
+	committer := &storingCommitter{}
+	start := time.Now()
+	c.processMessage(NewConsumeContext(context.Background(), committer, nil), retry)
+	if handledAt.Sub(start) < 90*time.Millisecond {
+		t.Errorf("assert message handled after its due time, got '%v'", handledAt.Sub(start))
+	}
+	if len(committer.stored) != 1 {
+		t.Errorf("assert stored offsets expect '%v', got '%v'", 1, len(committer.stored))
+	}
+}
+
+// storingCommitter records the stored offsets.
+type storingCommitter struct {
+	OffsetCommitter
+	stored []TopicPartition
+}
+
+func (c *storingCommitter) StoreOffsets(offsets []TopicPartition) ([]TopicPartition, error) {
+	c.stored = append(c.stored, offsets...)
+	return offsets, nil
+}
@@ -0,0 +1,88 @@
+package kafka
+
+import (
+	"bytes"
+	"regexp"
+)
+
+var _ MessageHandleProc = new(Router).Handle
+
+// Router dispatches the messages to the handlers registered by topic, topic
+// pattern, header value or key prefix. The routes are matched in the order
+// they are registered, and the messages matching no route are forwarded
+// through ConsumeContext.ForwardUnhandledMessage. The messages from a retry
+// topic are routed by their original topic.
+//
+// The Router must be set up before it is used, e.g.
+//
+//	router := new(kafka.Router).
+//	  Topic("orders", handleOrder).
+//	  KeyPrefix("vip-", handleVip)
+//	consumer := &kafka.Consumer{MessageHandler: router.Handle}
+type Router struct {
+	routes []route
+}
+
+type route struct {
+	match   func(topic string, message *Message) bool
+	handler MessageHandleProc
+}
+
+// Topic routes the messages of the topic.
+func (r *Router) Topic(topic string, handler MessageHandleProc) *Router {
+	return r.add(func(t string, message *Message) bool {
+		return t == topic
+	}, handler)
+}
+
+// TopicPattern routes the messages whose topic matches the regex pattern.
+// It panics if the pattern cannot be compiled.
+func (r *Router) TopicPattern(pattern string, handler MessageHandleProc) *Router {
+	re := regexp.MustCompile(pattern)
+	return r.add(func(t string, message *Message) bool {
+		return re.MatchString(t)
+	}, handler)
+}
+
+// Header routes the messages which have the header with the value.
+func (r *Router) Header(key, value string, handler MessageHandleProc) *Router {
+	return r.add(func(t string, message *Message) bool {
+		v, ok := lookupHeader(message, key)
+		return ok && string(v) == value
+	}, handler)
+}
+
+// KeyPrefix routes the messages whose key begins with the prefix.
+func (r *Router) KeyPrefix(prefix string, handler MessageHandleProc) *Router {
+	return r.add(func(t string, message *Message) bool {
+		return bytes.HasPrefix(message.Key, []byte(prefix))
+	}, handler)
+}
+
+// Handle dispatches the message to the handler of the first matched route.
+func (r *Router) Handle(ctx *ConsumeContext, message *Message) {
+	var topic string
+	if original := OriginalTopicPartition(message); original.Topic != nil {
+		topic = *original.Topic
+	}
+
+	for _, route := range r.routes {
+		if route.match(topic, message) {
+			route.handler(ctx, message)
+			return
+		}
+	}
+	ctx.ForwardUnhandledMessage(message)
+}
+
+func (r *Router) add(match func(topic string, message *Message) bool, handler MessageHandleProc) *Router {
+	if handler == nil {
+		panic("the handler of the route cannot be nil")
+	}
+
+	r.routes = append(r.routes, route{
+		match:   match,
+		handler: handler,
+	})
+	return r
+}
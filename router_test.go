@@ -0,0 +1,53 @@
+package kafka
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRouter(t *testing.T) {
+	var handled []string
+
+	handlerOf := func(name string) MessageHandleProc {
+		return func(ctx *ConsumeContext, message *Message) {
+			handled = append(handled, name)
+		}
+	}
+
+	router := new(Router).
+		Topic("orders", handlerOf("topic")).
+		TopicPattern(`^payments\..*`, handlerOf("pattern")).
+		Header("type", "audit", handlerOf("header")).
+		KeyPrefix("vip-", handlerOf("key"))
+
+	ctx := &ConsumeContext{
+		unhandledMessageHandler: handlerOf("unhandled"),
+	}
+
+	var (
+		orders      = "orders"
+		ordersRetry = "orders.retry.1"
+		payments    = "payments.eu"
+		events      = "events"
+	)
+	for _, message := range []*Message{
+		{TopicPartition: TopicPartition{Topic: &orders}},
+		{
+			TopicPartition: TopicPartition{Topic: &ordersRetry},
+			Headers:        []Header{{Key: RETRY_TOPIC_HEADER_ORIGINAL_TOPIC, Value: []byte(orders)}},
+		},
+		{TopicPartition: TopicPartition{Topic: &payments}},
+		{TopicPartition: TopicPartition{Topic: &events}, Headers: []Header{{Key: "type", Value: []byte("audit")}}},
+		{TopicPartition: TopicPartition{Topic: &events}, Key: []byte("vip-1")},
+		{TopicPartition: TopicPartition{Topic: &events}, Key: []byte("1")},
+		// the first matched route wins
+		{TopicPartition: TopicPartition{Topic: &orders}, Key: []byte("vip-2")},
+	} {
+		router.Handle(ctx, message)
+	}
+
+	expected := []string{"topic", "topic", "pattern", "header", "key", "unhandled", "topic"}
+	if !reflect.DeepEqual(handled, expected) {
+		t.Errorf("assert handled expect '%v', got '%v'", expected, handled)
+	}
+}
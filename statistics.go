@@ -0,0 +1,200 @@
+package kafka
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+// Statistics is the librdkafka statistics emitted every
+// statistics.interval.ms. See STATISTICS.md of librdkafka for the meaning
+// of the fields.
+type Statistics struct {
+	Name             string                       `json:"name"`
+	ClientID         string                       `json:"client_id"`
+	Type             string                       `json:"type"`
+	Ts               int64                        `json:"ts"`
+	Time             int64                        `json:"time"`
+	ReplyQueue       int64                        `json:"replyq"`
+	MsgCount         int64                        `json:"msg_cnt"`
+	MsgSize          int64                        `json:"msg_size"`
+	MsgMax           int64                        `json:"msg_max"`
+	MsgSizeMax       int64                        `json:"msg_size_max"`
+	Tx               int64                        `json:"tx"`
+	TxBytes          int64                        `json:"tx_bytes"`
+	Rx               int64                        `json:"rx"`
+	RxBytes          int64                        `json:"rx_bytes"`
+	TxMsgs           int64                        `json:"txmsgs"`
+	TxMsgBytes       int64                        `json:"txmsg_bytes"`
+	RxMsgs           int64                        `json:"rxmsgs"`
+	RxMsgBytes       int64                        `json:"rxmsg_bytes"`
+	MetadataCacheCnt int64                        `json:"metadata_cache_cnt"`
+	Brokers          map[string]*BrokerStatistics `json:"brokers"`
+	Topics           map[string]*TopicStatistics  `json:"topics"`
+	ConsumerGroup    *ConsumerGroupStatistics     `json:"cgrp"`
+	EOS              *ExactlyOnceStatistics       `json:"eos"`
+}
+
+type BrokerStatistics struct {
+	Name           string                                     `json:"name"`
+	NodeID         int32                                      `json:"nodeid"`
+	NodeName       string                                     `json:"nodename"`
+	Source         string                                     `json:"source"`
+	State          string                                     `json:"state"`
+	StateAge       int64                                      `json:"stateage"`
+	OutbufCnt      int64                                      `json:"outbuf_cnt"`
+	OutbufMsgCnt   int64                                      `json:"outbuf_msg_cnt"`
+	WaitrespCnt    int64                                      `json:"waitresp_cnt"`
+	WaitrespMsgCnt int64                                      `json:"waitresp_msg_cnt"`
+	Tx             int64                                      `json:"tx"`
+	TxBytes        int64                                      `json:"txbytes"`
+	TxErrs         int64                                      `json:"txerrs"`
+	TxRetries      int64                                      `json:"txretries"`
+	ReqTimeouts    int64                                      `json:"req_timeouts"`
+	Rx             int64                                      `json:"rx"`
+	RxBytes        int64                                      `json:"rxbytes"`
+	RxErrs         int64                                      `json:"rxerrs"`
+	Connects       int64                                      `json:"connects"`
+	Disconnects    int64                                      `json:"disconnects"`
+	IntLatency     *WindowStatistics                          `json:"int_latency"`
+	OutbufLatency  *WindowStatistics                          `json:"outbuf_latency"`
+	Rtt            *WindowStatistics                          `json:"rtt"`
+	Throttle       *WindowStatistics                          `json:"throttle"`
+	Toppars        map[string]*BrokerTopicPartitionStatistics `json:"toppars"`
+}
+
+type BrokerTopicPartitionStatistics struct {
+	Topic     string `json:"topic"`
+	Partition int32  `json:"partition"`
+}
+
+// WindowStatistics is the rolling window statistics in microseconds.
+type WindowStatistics struct {
+	Min        int64 `json:"min"`
+	Max        int64 `json:"max"`
+	Avg        int64 `json:"avg"`
+	Sum        int64 `json:"sum"`
+	Cnt        int64 `json:"cnt"`
+	Stddev     int64 `json:"stddev"`
+	P50        int64 `json:"p50"`
+	P75        int64 `json:"p75"`
+	P90        int64 `json:"p90"`
+	P95        int64 `json:"p95"`
+	P99        int64 `json:"p99"`
+	P99_99     int64 `json:"p99_99"`
+	OutOfRange int64 `json:"outofrange"`
+}
+
+type TopicStatistics struct {
+	Topic       string                          `json:"topic"`
+	MetadataAge int64                           `json:"metadata_age"`
+	BatchSize   *WindowStatistics               `json:"batchsize"`
+	BatchCnt    *WindowStatistics               `json:"batchcnt"`
+	Partitions  map[string]*PartitionStatistics `json:"partitions"`
+}
+
+type PartitionStatistics struct {
+	Partition         int32  `json:"partition"`
+	Broker            int32  `json:"broker"`
+	Leader            int32  `json:"leader"`
+	Desired           bool   `json:"desired"`
+	Unknown           bool   `json:"unknown"`
+	MsgqCnt           int64  `json:"msgq_cnt"`
+	MsgqBytes         int64  `json:"msgq_bytes"`
+	XmitMsgqCnt       int64  `json:"xmit_msgq_cnt"`
+	XmitMsgqBytes     int64  `json:"xmit_msgq_bytes"`
+	FetchqCnt         int64  `json:"fetchq_cnt"`
+	FetchqSize        int64  `json:"fetchq_size"`
+	FetchState        string `json:"fetch_state"`
+	QueryOffset       int64  `json:"query_offset"`
+	NextOffset        int64  `json:"next_offset"`
+	AppOffset         int64  `json:"app_offset"`
+	StoredOffset      int64  `json:"stored_offset"`
+	CommittedOffset   int64  `json:"committed_offset"`
+	EOFOffset         int64  `json:"eof_offset"`
+	LoOffset          int64  `json:"lo_offset"`
+	HiOffset          int64  `json:"hi_offset"`
+	LsOffset          int64  `json:"ls_offset"`
+	ConsumerLag       int64  `json:"consumer_lag"`
+	ConsumerLagStored int64  `json:"consumer_lag_stored"`
+	TxMsgs            int64  `json:"txmsgs"`
+	TxBytes           int64  `json:"txbytes"`
+	RxMsgs            int64  `json:"rxmsgs"`
+	RxBytes           int64  `json:"rxbytes"`
+	Msgs              int64  `json:"msgs"`
+	RxVerDrops        int64  `json:"rx_ver_drops"`
+	MsgsInflight      int64  `json:"msgs_inflight"`
+}
+
+type ConsumerGroupStatistics struct {
+	State           string `json:"state"`
+	StateAge        int64  `json:"stateage"`
+	JoinState       string `json:"join_state"`
+	RebalanceAge    int64  `json:"rebalance_age"`
+	RebalanceCnt    int64  `json:"rebalance_cnt"`
+	RebalanceReason string `json:"rebalance_reason"`
+	AssignmentSize  int64  `json:"assignment_size"`
+}
+
+type ExactlyOnceStatistics struct {
+	IdempState    string `json:"idemp_state"`
+	IdempStateAge int64  `json:"idemp_stateage"`
+	TxnState      string `json:"txn_state"`
+	TxnStateAge   int64  `json:"txn_stateage"`
+	TxnMayEnq     bool   `json:"txn_may_enq"`
+	ProducerID    int64  `json:"producer_id"`
+	ProducerEpoch int64  `json:"producer_epoch"`
+	EpochCnt      int64  `json:"epoch_cnt"`
+}
+
+func ParseStatistics(data string) (*Statistics, error) {
+	var stats Statistics
+	err := json.Unmarshal([]byte(data), &stats)
+	if err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// handleStats parses the *kafka.Stats event, feeds the Metrics and passes
+// the Statistics to the StatsHandler.
+func handleStats(e *kafka.Stats, handler StatsHandleProc, metrics *Metrics, logger Logger) {
+	if handler == nil && metrics == nil {
+		return
+	}
+
+	stats, err := ParseStatistics(e.String())
+	if err != nil {
+		logger.Error("cannot parse statistics", "error", err)
+		return
+	}
+	metrics.observeStatistics(stats)
+	if handler != nil {
+		handler(stats)
+	}
+}
+
+func (m *Metrics) observeStatistics(stats *Statistics) {
+	if m == nil {
+		return
+	}
+
+	m.queueMessages.WithLabelValues(stats.Name).Set(float64(stats.MsgCount))
+	for _, broker := range stats.Brokers {
+		if broker.NodeID < 0 || broker.Rtt == nil {
+			// bootstrap servers which are not resolved to a node yet
+			continue
+		}
+		m.brokerRtt.WithLabelValues(broker.Name).Set(float64(broker.Rtt.Avg) / 1e6)
+	}
+	for _, topic := range stats.Topics {
+		for _, partition := range topic.Partitions {
+			if partition.Partition < 0 || partition.ConsumerLag < 0 {
+				// the internal UA partition, or the lag is unknown
+				continue
+			}
+			m.consumerLag.WithLabelValues(topic.Topic, strconv.Itoa(int(partition.Partition))).Set(float64(partition.ConsumerLag))
+		}
+	}
+}
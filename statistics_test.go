@@ -0,0 +1,116 @@
+package kafka
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testStatistics = `{
+  "name": "rdkafka#consumer-1", "client_id": "rdkafka", "type": "consumer",
+  "ts": 5016483227792, "time": 1527060869, "replyq": 0, "msg_cnt": 3, "msg_size": 12,
+  "brokers": {
+    "localhost:9092/2": {
+      "name": "localhost:9092/2", "nodeid": 2, "state": "UP",
+      "rtt": {"min": 100, "max": 3000, "avg": 2000, "p99": 2900, "cnt": 10}
+    },
+    "localhost:9092/bootstrap": {
+      "name": "localhost:9092/bootstrap", "nodeid": -1, "state": "UP",
+      "rtt": {"avg": 500}
+    }
+  },
+  "topics": {
+    "gotest": {
+      "topic": "gotest", "metadata_age": 9060,
+      "partitions": {
+        "0": {"partition": 0, "leader": 2, "fetch_state": "active", "hi_offset": 100, "committed_offset": 90, "consumer_lag": 10},
+        "-1": {"partition": -1, "leader": -1, "consumer_lag": -1}
+      }
+    }
+  },
+  "cgrp": {"state": "up", "join_state": "steady", "rebalance_cnt": 1, "assignment_size": 1}
+}`
+
+func TestParseStatistics(t *testing.T) {
+	stats, err := ParseStatistics(testStatistics)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if stats.Type != "consumer" {
+		t.Errorf("assert Statistics.Type expect '%v', got '%v'", "consumer", stats.Type)
+	}
+	if rtt := stats.Brokers["localhost:9092/2"].Rtt.Avg; rtt != 2000 {
+		t.Errorf("assert BrokerStatistics.Rtt.Avg expect '%v', got '%v'", 2000, rtt)
+	}
+	if lag := stats.Topics["gotest"].Partitions["0"].ConsumerLag; lag != 10 {
+		t.Errorf("assert PartitionStatistics.ConsumerLag expect '%v', got '%v'", 10, lag)
+	}
+	if stats.ConsumerGroup == nil || stats.ConsumerGroup.RebalanceCnt != 1 {
+		t.Errorf("assert ConsumerGroupStatistics.RebalanceCnt expect '%v', got '%+v'", 1, stats.ConsumerGroup)
+	}
+
+	_, err = ParseStatistics("{")
+	if err == nil {
+		t.Error("Expected ParseStatistics() to fail")
+	}
+}
+
+func TestMetrics_ObserveStatistics(t *testing.T) {
+	stats, err := ParseStatistics(testStatistics)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	m := NewMetrics("kafka")
+	m.observeStatistics(stats)
+
+	var buf bytes.Buffer
+	m.WriteTo(&buf)
+	output := buf.String()
+
+	for _, expected := range []string{
+		`kafka_queue_messages{client="rdkafka#consumer-1"} 3` + "\n",
+		`kafka_broker_rtt_seconds{broker="localhost:9092/2"} 0.002` + "\n",
+		`kafka_consumer_lag{partition="0",topic="gotest"} 10` + "\n",
+	} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("assert Metrics.WriteTo() expect '%s', got '%s'", expected, output)
+		}
+	}
+	for _, unexpected := range []string{"bootstrap", `partition="-1"`} {
+		if strings.Contains(output, unexpected) {
+			t.Errorf("assert Metrics.WriteTo() expect no '%s', got '%s'", unexpected, output)
+		}
+	}
+}
+
+func TestProducer_StatsHandler(t *testing.T) {
+	var received = make(chan *Statistics, 1)
+
+	p, err := NewProducer(&ProducerOption{
+		ConfigMap: &ConfigMap{
+			"statistics.interval.ms": 50,
+		},
+		StatsHandler: func(stats *Statistics) {
+			select {
+			case received <- stats:
+			default:
+			}
+		},
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer p.Close()
+
+	select {
+	case stats := <-received:
+		if stats.Type != "producer" {
+			t.Errorf("assert Statistics.Type expect '%v', got '%v'", "producer", stats.Type)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the statistics")
+	}
+}
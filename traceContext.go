@@ -0,0 +1,81 @@
+package kafka
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	TRACE_HEADER_TRACEPARENT = "traceparent"
+	TRACE_HEADER_TRACESTATE  = "tracestate"
+)
+
+var (
+	_ propagation.TextMapCarrier = messageCarrier{}
+
+	traceContextPropagator = propagation.TraceContext{}
+)
+
+// InjectTraceContext writes the OpenTelemetry span context carried by ctx
+// into the traceparent and tracestate headers of the message, replacing the
+// existing ones.
+func InjectTraceContext(ctx context.Context, message *Message) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return
+	}
+
+	carrier := messageCarrier{message}
+	carrier.remove(TRACE_HEADER_TRACEPARENT)
+	carrier.remove(TRACE_HEADER_TRACESTATE)
+	traceContextPropagator.Inject(ctx, carrier)
+}
+
+// ExtractTraceContext returns a copy of ctx carrying the remote span context
+// read from the headers of the message. ctx is returned as is if the
+// message carries no valid traceparent.
+func ExtractTraceContext(ctx context.Context, message *Message) context.Context {
+	return traceContextPropagator.Extract(ctx, messageCarrier{message})
+}
+
+// messageCarrier adapts the headers of a message to
+// propagation.TextMapCarrier.
+type messageCarrier struct {
+	message *Message
+}
+
+// Get returns the value of the last header of the key.
+func (c messageCarrier) Get(key string) string {
+	v, _ := lookupHeader(c.message, key)
+	return string(v)
+}
+
+// Set replaces the headers of the key with the value.
+func (c messageCarrier) Set(key, value string) {
+	c.remove(key)
+	c.message.Headers = append(c.message.Headers, Header{Key: key, Value: []byte(value)})
+}
+
+func (c messageCarrier) Keys() []string {
+	keys := make([]string, 0, len(c.message.Headers))
+	for _, h := range c.message.Headers {
+		keys = append(keys, h.Key)
+	}
+	return keys
+}
+
+func (c messageCarrier) remove(key string) {
+	if _, ok := lookupHeader(c.message, key); !ok {
+		return
+	}
+
+	// the headers might be shared with another message, so they are copied
+	headers := make([]Header, 0, len(c.message.Headers))
+	for _, h := range c.message.Headers {
+		if h.Key != key {
+			headers = append(headers, h)
+		}
+	}
+	c.message.Headers = headers
+}
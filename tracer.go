@@ -0,0 +1,51 @@
+package kafka
+
+import (
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The messaging semantic conventions of OpenTelemetry.
+const (
+	TRACE_ATTR_MESSAGING_SYSTEM           = "messaging.system"
+	TRACE_ATTR_MESSAGING_DESTINATION_NAME = "messaging.destination.name"
+	TRACE_ATTR_MESSAGING_OPERATION        = "messaging.operation"
+	TRACE_ATTR_MESSAGING_KAFKA_PARTITION  = "messaging.kafka.destination.partition"
+	TRACE_ATTR_MESSAGING_KAFKA_OFFSET     = "messaging.kafka.message.offset"
+	TRACE_ATTR_MESSAGING_KAFKA_KEY        = "messaging.kafka.message.key"
+	TRACE_ATTR_MESSAGING_KAFKA_GROUP      = "messaging.kafka.consumer.group"
+
+	TRACE_MESSAGING_SYSTEM_KAFKA = "kafka"
+)
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func messagingAttributes(message *Message, operation string) []attribute.KeyValue {
+	tp := message.TopicPartition
+	attributes := []attribute.KeyValue{
+		attribute.String(TRACE_ATTR_MESSAGING_SYSTEM, TRACE_MESSAGING_SYSTEM_KAFKA),
+		attribute.String(TRACE_ATTR_MESSAGING_DESTINATION_NAME, stringOf(tp.Topic)),
+		attribute.String(TRACE_ATTR_MESSAGING_OPERATION, operation),
+	}
+	if tp.Partition >= 0 {
+		attributes = append(attributes, attribute.Int64(TRACE_ATTR_MESSAGING_KAFKA_PARTITION, int64(tp.Partition)))
+	}
+	if tp.Offset >= 0 {
+		attributes = append(attributes, attribute.Int64(TRACE_ATTR_MESSAGING_KAFKA_OFFSET, int64(tp.Offset)))
+	}
+	if len(message.Key) > 0 {
+		attributes = append(attributes, attribute.String(TRACE_ATTR_MESSAGING_KAFKA_KEY, string(message.Key)))
+	}
+	return attributes
+}
+
+func spanNameOf(message *Message, operation string) string {
+	return stringOf(message.TopicPartition.Topic) + " " + operation
+}
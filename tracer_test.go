@@ -0,0 +1,192 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const testTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func newTestTracer() (trace.Tracer, *tracetest.InMemoryExporter) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	return provider.Tracer("gotest"), exporter
+}
+
+func remoteSpanContextOf(traceparent, tracestate string) trace.SpanContext {
+	message := &Message{
+		Headers: []Header{
+			{Key: TRACE_HEADER_TRACEPARENT, Value: []byte(traceparent)},
+			{Key: TRACE_HEADER_TRACESTATE, Value: []byte(tracestate)},
+		},
+	}
+	return trace.SpanContextFromContext(ExtractTraceContext(context.Background(), message))
+}
+
+func TestTraceContextPropagation(t *testing.T) {
+	sc := remoteSpanContextOf(testTraceparent, "vendor=value")
+	if !sc.IsValid() || !sc.IsSampled() || !sc.IsRemote() {
+		t.Fatalf("assert extracted SpanContext expect valid, sampled and remote, got '%+v'", sc)
+	}
+
+	message := &Message{
+		Headers: []Header{
+			{Key: "other", Value: []byte("kept")},
+			{Key: TRACE_HEADER_TRACEPARENT, Value: []byte("stale")},
+			{Key: TRACE_HEADER_TRACESTATE, Value: []byte("stale=value")},
+		},
+	}
+	InjectTraceContext(trace.ContextWithRemoteSpanContext(context.Background(), sc), message)
+
+	if len(message.Headers) != 3 {
+		t.Fatalf("assert Message.Headers expect '%v' headers, got '%v'", 3, message.Headers)
+	}
+	if v, _ := lookupHeader(message, TRACE_HEADER_TRACEPARENT); string(v) != testTraceparent {
+		t.Errorf("assert traceparent header expect '%v', got '%v'", testTraceparent, string(v))
+	}
+
+	extracted := trace.SpanContextFromContext(ExtractTraceContext(context.Background(), message))
+	if !extracted.Equal(sc) {
+		t.Errorf("assert extracted SpanContext expect '%+v', got '%+v'", sc, extracted)
+	}
+
+	// the last header wins if the key is duplicated
+	message.Headers = append(message.Headers, Header{Key: TRACE_HEADER_TRACEPARENT, Value: []byte("invalid")})
+	if extracted := trace.SpanContextFromContext(ExtractTraceContext(context.Background(), message)); extracted.IsValid() {
+		t.Errorf("assert SpanContext of invalid traceparent expect invalid, got '%+v'", extracted)
+	}
+
+	// no trace context to inject
+	message = &Message{}
+	InjectTraceContext(context.Background(), message)
+	if len(message.Headers) != 0 {
+		t.Errorf("assert Message.Headers expect empty, got '%v'", message.Headers)
+	}
+}
+
+func TestConsumer_Tracer(t *testing.T) {
+	tracer, exporter := newTestTracer()
+
+	var handlerSpanContext trace.SpanContext
+	c := &Consumer{
+		ConfigMap: &ConfigMap{
+			"group.id": "gotest",
+		},
+		Tracer: tracer,
+		MessageProcessor: func(ctx *ConsumeContext, message *Message) error {
+			handlerSpanContext = trace.SpanContextFromContext(ctx.Context())
+			return Permanent(fmt.Errorf("failed"))
+		},
+		UnhandledMessageHandler: func(ctx *ConsumeContext, message *Message) {},
+	}
+
+	topic := "gotest"
+	parent := remoteSpanContextOf(testTraceparent, "")
+	message := &Message{
+		TopicPartition: TopicPartition{Topic: &topic, Partition: 2, Offset: 42},
+		Headers:        []Header{{Key: TRACE_HEADER_TRACEPARENT, Value: []byte(testTraceparent)}},
+	}
+	c.handleMessage(&ConsumeContext{unhandledMessageHandler: c.UnhandledMessageHandler}, message, true)
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("assert exported spans expect '%v', got '%v'", 1, len(spans))
+	}
+	span := spans[0]
+
+	if span.Name != "gotest process" || span.SpanKind != trace.SpanKindConsumer {
+		t.Errorf("assert span expect '%v' of '%v', got '%v' of '%v'", "gotest process", trace.SpanKindConsumer, span.Name, span.SpanKind)
+	}
+	if !span.Parent.Equal(parent) {
+		t.Errorf("assert span parent expect '%+v', got '%+v'", parent, span.Parent)
+	}
+	if !handlerSpanContext.Equal(span.SpanContext) {
+		t.Errorf("assert handler SpanContext expect '%+v', got '%+v'", span.SpanContext, handlerSpanContext)
+	}
+	if span.Status.Code != codes.Error {
+		t.Errorf("assert span status expect '%v', got '%v'", codes.Error, span.Status.Code)
+	}
+
+	expectedAttributes := map[string]interface{}{
+		TRACE_ATTR_MESSAGING_SYSTEM:           "kafka",
+		TRACE_ATTR_MESSAGING_DESTINATION_NAME: "gotest",
+		TRACE_ATTR_MESSAGING_OPERATION:        "process",
+		TRACE_ATTR_MESSAGING_KAFKA_PARTITION:  int64(2),
+		TRACE_ATTR_MESSAGING_KAFKA_OFFSET:     int64(42),
+		TRACE_ATTR_MESSAGING_KAFKA_GROUP:      "gotest",
+	}
+	attributes := make(map[string]interface{})
+	for _, kv := range span.Attributes {
+		attributes[string(kv.Key)] = kv.Value.AsInterface()
+	}
+	for key, expected := range expectedAttributes {
+		if v := attributes[key]; v != expected {
+			t.Errorf("assert span attribute %s expect '%v', got '%v'", key, expected, v)
+		}
+	}
+}
+
+func TestProducer_WriteMessageContext(t *testing.T) {
+	tracer, exporter := newTestTracer()
+
+	p, err := NewProducer(&ProducerOption{
+		ConfigMap: &ConfigMap{
+			"socket.timeout.ms":  10,
+			"message.timeout.ms": 10,
+		},
+		FlushTimeout: 10,
+		Tracer:       tracer,
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer p.Close()
+
+	parent := remoteSpanContextOf(testTraceparent, "")
+	ctx := trace.ContextWithRemoteSpanContext(context.Background(), parent)
+
+	topic := "gotest"
+	message := &Message{
+		TopicPartition: TopicPartition{Topic: &topic, Partition: PartitionAny},
+	}
+	err = p.WriteMessageContext(ctx, message, nil)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("assert exported spans expect '%v', got '%v'", 1, len(spans))
+	}
+	if spans[0].SpanKind != trace.SpanKindProducer || !spans[0].Parent.Equal(parent) {
+		t.Errorf("assert producer span expect child of '%+v', got '%+v'", parent, spans[0])
+	}
+
+	injected := trace.SpanContextFromContext(ExtractTraceContext(context.Background(), message))
+	if injected.SpanID() != spans[0].SpanContext.SpanID() {
+		t.Errorf("assert injected span expect '%v', got '%v'", spans[0].SpanContext.SpanID(), injected.SpanID())
+	}
+}
+
+func TestInjectTraceContext_ApplicationSpan(t *testing.T) {
+	tracer, _ := newTestTracer()
+
+	// the span started by the application, not by the Consumer or the
+	// Producer
+	ctx, span := tracer.Start(context.Background(), "request")
+	defer span.End()
+
+	message := &Message{}
+	InjectTraceContext(ctx, message)
+
+	injected := trace.SpanContextFromContext(ExtractTraceContext(context.Background(), message))
+	if injected.TraceID() != span.SpanContext().TraceID() || injected.SpanID() != span.SpanContext().SpanID() {
+		t.Errorf("assert injected span expect '%+v', got '%+v'", span.SpanContext(), injected)
+	}
+}
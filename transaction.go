@@ -0,0 +1,195 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+const (
+	DEFAULT_TRANSACTION_RETRY_BACKOFF     = 100 * time.Millisecond
+	DEFAULT_TRANSACTION_MAX_RETRY_BACKOFF = 1 * time.Second
+)
+
+// transactionRetryPolicy paces the retries of the retriable transactional
+// operations, which are bounded by the context instead of the attempts.
+var transactionRetryPolicy = &RetryPolicy{
+	InitialBackoff: DEFAULT_TRANSACTION_RETRY_BACKOFF,
+	MaxBackoff:     DEFAULT_TRANSACTION_MAX_RETRY_BACKOFF,
+}
+
+// BeginTransaction starts a new transaction. The Producer must be created
+// with ProducerOption.TransactionalID.
+func (p *Producer) BeginTransaction() error {
+	if err := p.checkTransactional(); err != nil {
+		return err
+	}
+	err := p.handle.BeginTransaction()
+	if err != nil {
+		return newTransactionError(err, false)
+	}
+	return nil
+}
+
+// SendOffsetsToTransaction adds the consumed offsets to the current
+// transaction, so they are committed along with the produced messages. The
+// transaction is aborted automatically if the error requires.
+func (p *Producer) SendOffsetsToTransaction(ctx context.Context, offsets []TopicPartition, metadata *ConsumerGroupMetadata) error {
+	if err := p.checkTransactional(); err != nil {
+		return err
+	}
+	return p.executeTransactionOperation(ctx, func(ctx context.Context) error {
+		return p.handle.SendOffsetsToTransaction(ctx, offsets, metadata)
+	})
+}
+
+// CommitTransaction flushes the outstanding messages and commits the
+// current transaction. The retriable errors are retried with backoff until
+// ctx is done or the TransactionTimeout elapses. If the transaction cannot
+// be committed, it is aborted automatically and the returned
+// *TransactionError reports Aborted.
+func (p *Producer) CommitTransaction(ctx context.Context) error {
+	if err := p.checkTransactional(); err != nil {
+		return err
+	}
+	return p.executeTransactionOperation(ctx, func(ctx context.Context) error {
+		return p.handle.CommitTransaction(ctx)
+	})
+}
+
+// AbortTransaction purges the outstanding messages and aborts the current
+// transaction. The retriable errors are retried with backoff until ctx is
+// done.
+func (p *Producer) AbortTransaction(ctx context.Context) error {
+	if err := p.checkTransactional(); err != nil {
+		return err
+	}
+	for attempt := 1; ; attempt++ {
+		err := p.handle.AbortTransaction(ctx)
+		if err == nil {
+			return nil
+		}
+		if !isRetriableTransactionError(err) || !sleepContext(ctx, transactionRetryPolicy.backoff(attempt)) {
+			return newTransactionError(err, false)
+		}
+	}
+}
+
+// executeTransactionOperation retries op with backoff while it fails with a
+// retriable error, and aborts the transaction once the error is abortable,
+// or ctx is done or the TransactionTimeout elapses before the next attempt.
+// The fatal errors are returned as is, since the Producer cannot be used
+// anymore.
+func (p *Producer) executeTransactionOperation(ctx context.Context, op func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, p.transactionTimeout)
+	defer cancel()
+
+	for attempt := 1; ; attempt++ {
+		err := op(ctx)
+		if err == nil {
+			return nil
+		}
+
+		kerr, ok := err.(kafka.Error)
+		if !ok || kerr.IsFatal() {
+			return newTransactionError(err, false)
+		}
+		if kerr.IsRetriable() && !kerr.TxnRequiresAbort() &&
+			sleepContext(ctx, transactionRetryPolicy.backoff(attempt)) {
+			continue
+		}
+
+		abortErr := p.abortTransactionWithTimeout()
+		if abortErr != nil {
+			p.logger().Error("cannot abort the transaction", "error", abortErr)
+			return newTransactionError(err, false)
+		}
+		return newTransactionError(err, true)
+	}
+}
+
+func (p *Producer) abortTransactionWithTimeout() error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.transactionTimeout)
+	defer cancel()
+
+	return p.AbortTransaction(ctx)
+}
+
+func (p *Producer) initTransactions() error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.transactionTimeout)
+	defer cancel()
+
+	err := p.handle.InitTransactions(ctx)
+	if err != nil {
+		return newTransactionError(err, false)
+	}
+	return nil
+}
+
+func (p *Producer) checkTransactional() error {
+	if p.disposed {
+		return fmt.Errorf("the Producer has been disposed")
+	}
+	if !p.transactional {
+		return fmt.Errorf("the Producer is not transactional")
+	}
+	return nil
+}
+
+func isRetriableTransactionError(err error) bool {
+	if kerr, ok := err.(kafka.Error); ok {
+		return kerr.IsRetriable() && !kerr.IsFatal()
+	}
+	return false
+}
+
+// TransactionError is the error of a transactional operation.
+type TransactionError struct {
+	Err error
+	// Aborted reports whether the transaction has been aborted
+	// automatically, so a new transaction can be started.
+	Aborted bool
+}
+
+func newTransactionError(err error, aborted bool) *TransactionError {
+	return &TransactionError{
+		Err:     err,
+		Aborted: aborted,
+	}
+}
+
+func (e *TransactionError) Error() string {
+	if e.Aborted {
+		return fmt.Sprintf("transaction aborted: %v", e.Err)
+	}
+	return fmt.Sprintf("transaction failed: %v", e.Err)
+}
+
+func (e *TransactionError) Unwrap() error {
+	return e.Err
+}
+
+// IsFatal reports whether the Producer cannot be used anymore and must be
+// closed.
+func (e *TransactionError) IsFatal() bool {
+	if kerr, ok := e.Err.(kafka.Error); ok {
+		return kerr.IsFatal()
+	}
+	return false
+}
+
+// IsAbortable reports whether the transaction must be aborted before
+// starting a new one.
+func (e *TransactionError) IsAbortable() bool {
+	if kerr, ok := e.Err.(kafka.Error); ok {
+		return kerr.TxnRequiresAbort()
+	}
+	return false
+}
+
+// IsRetriable reports whether the failed operation can be retried.
+func (e *TransactionError) IsRetriable() bool {
+	return isRetriableTransactionError(e.Err)
+}
@@ -0,0 +1,71 @@
+package kafka
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestProducer_TransactionalWithoutBroker(t *testing.T) {
+	_, err := NewProducer(&ProducerOption{
+		ConfigMap: &ConfigMap{
+			"socket.timeout.ms":  10,
+			"message.timeout.ms": 10,
+		},
+		TransactionalID:    "gotest",
+		TransactionTimeout: 100 * time.Millisecond,
+	})
+	if err == nil {
+		t.Fatal("Expected NewProducer() to fail on InitTransactions()")
+	}
+	if _, ok := err.(*TransactionError); !ok {
+		t.Errorf("assert NewProducer() expect '*TransactionError', got '%T'", err)
+	}
+}
+
+func TestProducer_NotTransactional(t *testing.T) {
+	p, err := NewProducer(&ProducerOption{
+		ConfigMap: &ConfigMap{
+			"socket.timeout.ms":  10,
+			"message.timeout.ms": 10,
+		},
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer p.Close()
+
+	if err = p.BeginTransaction(); err == nil {
+		t.Error("Expected BeginTransaction() to fail")
+	}
+	if err = p.CommitTransaction(context.Background()); err == nil {
+		t.Error("Expected CommitTransaction() to fail")
+	}
+	if err = p.AbortTransaction(context.Background()); err == nil {
+		t.Error("Expected AbortTransaction() to fail")
+	}
+}
+
+func TestTransactionError(t *testing.T) {
+	cases := []struct {
+		err       Error
+		fatal     bool
+		retriable bool
+	}{
+		{NewError(ErrFenced, "fenced", true), true, false},
+		{NewError(ErrTimedOut, "timed out", false), false, false},
+	}
+
+	for _, c := range cases {
+		err := newTransactionError(c.err, false)
+		if err.IsFatal() != c.fatal {
+			t.Errorf("assert TransactionError.IsFatal() of %v expect '%v', got '%v'", c.err.Code(), c.fatal, err.IsFatal())
+		}
+		if err.IsRetriable() != c.retriable {
+			t.Errorf("assert TransactionError.IsRetriable() of %v expect '%v', got '%v'", c.err.Code(), c.retriable, err.IsRetriable())
+		}
+		if err.Unwrap() != error(c.err) {
+			t.Errorf("assert TransactionError.Unwrap() expect '%v', got '%v'", c.err, err.Unwrap())
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package kafka
+
+const (
+	// OrderByPartition handles the messages of the same partition in order.
+	OrderByPartition WorkerPoolOrdering = iota
+	// OrderByKey handles the messages of the same key in order. The offset of
+	// a partition is stored only up to the highest contiguous offset whose
+	// messages have all been handled, so the Consumer disables
+	// enable.auto.offset.store in this mode.
+	OrderByKey
+)
+
+type WorkerPoolOrdering int
+
+type WorkerPoolOption struct {
+	// Workers is the number of goroutines which invoke the MessageHandler.
+	Workers int
+	// QueueSize is the number of queued messages of a partition which
+	// makes the Consumer pause the partition until its queue is drained.
+	QueueSize int
+	// Ordering specifies which messages must be handled in order.
+	Ordering WorkerPoolOrdering
+}